@@ -0,0 +1,247 @@
+package npmp
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// Authentication
+//
+// Frames may carry an authentication trailer proving they were sent by the
+// holder of a client's pre-shared key. The trailer follows the message
+// within the frame:
+//
+//	Client ID   16 bytes, selects the key
+//	Nonce        8 random bytes
+//	Timestamp    int64 milliseconds since the Unix epoch
+//	MAC         32 byte HMAC-SHA256 over the direction, the message and the
+//	            fields above
+//
+// Both directions of a connection are signed with the key of the client. The
+// direction is a byte which isn't sent, 0 for frames from the client and 1
+// for frames from the server, so that a frame can't be reflected back to its
+// sender. A receiver rejects trailers with a bad MAC, a timestamp further
+// than its MaxClockSkew from its clock, or a nonce already seen by its
+// ReplayCache, which a server shares between all its connections.
+
+// AuthTrailerLength is the length of the authentication trailer of a frame.
+const AuthTrailerLength = 16 + 8 + 8 + sha256.Size
+
+// DefaultMaxClockSkew is the largest difference between the timestamp of a
+// trailer and the clock of the receiver an Authenticator accepts by default.
+const DefaultMaxClockSkew = time.Minute
+
+// A Direction is the direction a frame is sent in.
+type Direction byte
+
+// Directions of frames.
+const (
+	ClientToServer Direction = iota
+	ServerToClient
+)
+
+// An AuthError is returned when a frame fails authentication.
+type AuthError struct {
+	Reason string
+}
+
+func (e *AuthError) Error() string { return "Not authorized: " + e.Reason }
+
+// A KeyStore holds the pre-shared keys of clients.
+type KeyStore interface {
+	// Key returns the key of a client, false if it has none.
+	Key(clientID []byte) ([]byte, bool)
+}
+
+// KeyMap is a KeyStore of keys by hex encoded client ID.
+type KeyMap map[string][]byte
+
+// Key returns the key of a client.
+func (m KeyMap) Key(clientID []byte) ([]byte, bool) {
+	k, ok := m[hex.EncodeToString(clientID)]
+	return k, ok
+}
+
+// Sign returns b followed by an authentication trailer for the client and a
+// frame sent in direction dir.
+func Sign(b, clientID, key []byte, dir Direction, now time.Time) []byte {
+	ret := make([]byte, len(b), len(b)+AuthTrailerLength)
+	copy(ret, b)
+	id := make([]byte, 16)
+	copy(id, clientID)
+	ret = append(ret, id...)
+	nonce := make([]byte, 8)
+	rand.Read(nonce)
+	ret = append(ret, nonce...)
+	ret = binary.LittleEndian.AppendUint64(ret, uint64(now.UnixMilli()))
+	return append(ret, mac(key, dir, ret)...)
+}
+
+func mac(key []byte, dir Direction, b []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte{byte(dir)})
+	h.Write(b)
+	return h.Sum(nil)
+}
+
+// A ReplayCache remembers the nonces of the frames accepted by the
+// Authenticators sharing it, until their timestamps are too old to be
+// accepted anyway. The zero value is ready to use. A ReplayCache is safe
+// for concurrent use.
+type ReplayCache struct {
+	mu      sync.Mutex
+	seen    map[[24]byte]time.Time // Client ID and nonce to expiry
+	buckets map[int64][][24]byte   // Nonces by expiry in replayBucket steps
+	oldest  int64                  // Oldest bucket which may be left
+}
+
+// replayBucket is the span of expiries whose nonces are forgotten together.
+const replayBucket = time.Second
+
+// add records the nonce of a client until exp. It returns false if the nonce
+// was already recorded.
+func (c *ReplayCache) add(clientID, nonce []byte, exp, now time.Time) bool {
+	var k [24]byte
+	copy(k[:16], clientID)
+	copy(k[16:], nonce)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.seen == nil {
+		c.seen = make(map[[24]byte]time.Time)
+		c.buckets = make(map[int64][][24]byte)
+		c.oldest = bucketOf(now)
+	}
+	c.expire(bucketOf(now))
+	if e, ok := c.seen[k]; ok && !now.After(e) {
+		return false
+	}
+	c.seen[k] = exp
+	c.buckets[bucketOf(exp)] = append(c.buckets[bucketOf(exp)], k)
+	return true
+}
+
+// expire forgets the nonces of the buckets before current, which have all
+// expired. Each nonce is only visited once.
+func (c *ReplayCache) expire(current int64) {
+	if current-c.oldest > int64(len(c.buckets)) {
+		// After a quiet spell, skip the empty buckets.
+		for b := range c.buckets {
+			if b < current {
+				c.drop(b)
+			}
+		}
+	} else {
+		for b := c.oldest; b < current; b++ {
+			c.drop(b)
+		}
+	}
+	if current > c.oldest {
+		c.oldest = current
+	}
+}
+
+func (c *ReplayCache) drop(b int64) {
+	for _, k := range c.buckets[b] {
+		// Unless it was recorded again since, in a later bucket
+		if bucketOf(c.seen[k]) == b {
+			delete(c.seen, k)
+		}
+	}
+	delete(c.buckets, b)
+}
+
+func bucketOf(t time.Time) int64 { return t.UnixNano() / int64(replayBucket) }
+
+// An Authenticator verifies the trailers of the frames received from a
+// single peer. It is bound to the client ID of the first frame it accepts
+// and rejects frames for any other client after that. An Authenticator is
+// safe for concurrent use.
+type Authenticator struct {
+	// Keys holds the keys of the clients which may send frames.
+	Keys KeyStore
+
+	// Direction is the direction of the frames verified.
+	Direction Direction
+
+	// MaxClockSkew is the largest accepted difference between the
+	// timestamp of a frame and now. If zero, DefaultMaxClockSkew is used.
+	MaxClockSkew time.Duration
+
+	// Replays remembers the frames already accepted. It should be shared by
+	// every Authenticator of the same keys, so that a frame can't be
+	// replayed on another connection. If nil, the Authenticator only
+	// rejects frames replayed to itself.
+	Replays *ReplayCache
+
+	mu       sync.Mutex
+	clientID []byte
+	replays  ReplayCache // Used without Replays
+}
+
+// Verify checks the trailer of frame and returns the message it carries and
+// the client ID it was signed for.
+func (a *Authenticator) Verify(frame []byte, now time.Time) (msg, clientID []byte, err error) {
+	if len(frame) < AuthTrailerLength {
+		return nil, nil, &AuthError{Reason: "missing trailer"}
+	}
+	msg = frame[:len(frame)-AuthTrailerLength]
+	t := frame[len(msg):]
+	clientID = t[:16]
+	nonce := t[16:24]
+	ts := time.UnixMilli(int64(binary.LittleEndian.Uint64(t[24:32])))
+
+	key, ok := a.Keys.Key(clientID)
+	if !ok {
+		return nil, nil, &AuthError{Reason: "unknown client"}
+	}
+	if !hmac.Equal(t[32:], mac(key, a.Direction, frame[:len(frame)-sha256.Size])) {
+		return nil, nil, &AuthError{Reason: "bad signature"}
+	}
+	skew := a.MaxClockSkew
+	if skew <= 0 {
+		skew = DefaultMaxClockSkew
+	}
+	if d := now.Sub(ts); d > skew || d < -skew {
+		return nil, nil, &AuthError{Reason: "stale timestamp"}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.clientID != nil && !bytes.Equal(a.clientID, clientID) {
+		return nil, nil, &AuthError{Reason: "client ID changed"}
+	}
+	replays := a.Replays
+	if replays == nil {
+		replays = &a.replays
+	}
+	// A nonce can't be replayed once its timestamp is out of the window.
+	if !replays.add(clientID, nonce, ts.Add(skew), now) {
+		return nil, nil, &AuthError{Reason: "replayed frame"}
+	}
+	if a.clientID == nil {
+		a.clientID = append([]byte(nil), clientID...)
+	}
+	return msg, a.clientID, nil
+}
+
+// ClientID returns the client ID the Authenticator is bound to, nil until
+// it has accepted a frame.
+func (a *Authenticator) ClientID() []byte {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.clientID
+}
+
+// isNotAuthorized reports whether b is a bare NAK with NotAuthorized, which
+// a peer sends unsigned when it can't authenticate a frame.
+func isNotAuthorized(b []byte) bool {
+	p := Message(b)
+	return len(p) == minLength[NAK] && p.MessageType() == NAK && bytes.Equal(p.Cookie(), MagicCookie) &&
+		NACKResponseCode(p[4]) == NotAuthorized
+}
@@ -0,0 +1,163 @@
+package npmp
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+var (
+	testAuthID  = []byte{99, 226, 170, 251, 37, 41, 43, 236, 249, 80, 159, 109, 149, 85, 244, 19}
+	testAuthKey = []byte("secret")
+)
+
+func testAuthenticator() *Authenticator {
+	return &Authenticator{Keys: KeyMap{"63e2aafb25292becf9509f6d9555f413": testAuthKey}}
+}
+
+func expectAuthError(t *testing.T, err error, what string) {
+	t.Helper()
+	var aerr *AuthError
+	if !errors.As(err, &aerr) {
+		t.Fatalf("Incorrect error for %s. Expected AuthError, got %v", what, err)
+	}
+}
+
+func TestAuthenticator(t *testing.T) {
+	now := time.Now()
+	a := testAuthenticator()
+	msg := NewACKMessage()
+
+	frame := Sign(msg, testAuthID, testAuthKey, ClientToServer, now)
+	if len(frame) != len(msg)+AuthTrailerLength {
+		t.Fatalf("Incorrect frame length. Expected %d, got %d", len(msg)+AuthTrailerLength, len(frame))
+	}
+	got, id, err := a.Verify(frame, now)
+	if err != nil {
+		t.Fatalf("Failed to verify frame: %s", err)
+	}
+	if !bytes.Equal(got, msg) || !bytes.Equal(id, testAuthID) {
+		t.Fatalf("Incorrect message or client ID. Got %v for %x", got, id)
+	}
+
+	_, _, err = a.Verify(frame, now)
+	expectAuthError(t, err, "a replayed frame")
+
+	frame = Sign(msg, testAuthID, []byte("wrong"), ClientToServer, now)
+	_, _, err = a.Verify(frame, now)
+	expectAuthError(t, err, "a wrong key")
+
+	frame = Sign(msg, testAuthID, testAuthKey, ClientToServer, now)
+	frame[0] ^= 1
+	_, _, err = a.Verify(frame, now)
+	expectAuthError(t, err, "a modified message")
+
+	frame = Sign(msg, testAuthID, testAuthKey, ClientToServer, now.Add(-2*DefaultMaxClockSkew))
+	_, _, err = a.Verify(frame, now)
+	expectAuthError(t, err, "a stale timestamp")
+
+	other := make([]byte, 16)
+	frame = Sign(msg, other, testAuthKey, ClientToServer, now)
+	_, _, err = a.Verify(frame, now)
+	expectAuthError(t, err, "an unknown client")
+
+	_, _, err = a.Verify(msg, now)
+	expectAuthError(t, err, "a missing trailer")
+}
+
+func TestAuthenticatorBind(t *testing.T) {
+	now := time.Now()
+	other := make([]byte, 16)
+	a := &Authenticator{Keys: KeyMap{
+		"63e2aafb25292becf9509f6d9555f413": testAuthKey,
+		"00000000000000000000000000000000": testAuthKey,
+	}}
+	if _, _, err := a.Verify(Sign(NewACKMessage(), testAuthID, testAuthKey, ClientToServer, now), now); err != nil {
+		t.Fatalf("Failed to verify frame: %s", err)
+	}
+	if !bytes.Equal(a.ClientID(), testAuthID) {
+		t.Fatalf("Incorrect bound client ID. Expected %x, got %x", testAuthID, a.ClientID())
+	}
+	_, _, err := a.Verify(Sign(NewACKMessage(), other, testAuthKey, ClientToServer, now), now)
+	expectAuthError(t, err, "another client")
+}
+
+func TestCodecAuth(t *testing.T) {
+	buf := &bytes.Buffer{}
+	nak := NewNAKMessage()
+	nak.SetResponseCode(NotAuthorized)
+	NewEncoder(buf).Encode(nak)
+	enc := NewEncoder(buf)
+	enc.SetKey(testAuthID, testAuthKey, ClientToServer)
+	reg := NewRegisterMessage()
+	reg.SetClientID(testAuthID)
+	enc.Encode(reg)
+	enc.Encode(NewACKMessage())
+
+	// Until a frame is accepted a NAK with NotAuthorized may be unsigned.
+	dec := NewDecoder(buf)
+	dec.Auth = testAuthenticator()
+	m, err := dec.Decode()
+	if err != nil {
+		t.Fatalf("Failed to decode unsigned NotAuthorized: %s", err)
+	}
+	if n, ok := m.(NAKMessage); !ok || n.ResponseCode() != NotAuthorized {
+		t.Fatalf("Incorrect message. Expected NAK with NotAuthorized, got %v", m)
+	}
+	for _, mt := range []MessageType{Register, ACK} {
+		m, err := dec.Decode()
+		if err != nil {
+			t.Fatalf("Failed to decode %s message: %s", mt, err)
+		}
+		if got := Message(m.Bytes()).MessageType(); got != mt {
+			t.Fatalf("Incorrect message type. Expected %s, got %s", mt, got)
+		}
+	}
+
+	// A Register message for a client other than the one signing it
+	reg.SetClientID(make([]byte, 16))
+	enc.Encode(reg)
+	_, err = dec.Decode()
+	expectAuthError(t, err, "a mismatched client ID")
+
+	// Unsigned frames are rejected, a NAK included once the peer signs.
+	NewEncoder(buf).Encode(NewACKMessage())
+	_, err = dec.Decode()
+	expectAuthError(t, err, "an unsigned frame")
+	NewEncoder(buf).Encode(nak)
+	_, err = dec.Decode()
+	expectAuthError(t, err, "a late unsigned NotAuthorized")
+}
+
+func TestAuthenticatorDirection(t *testing.T) {
+	now := time.Now()
+	a := testAuthenticator()
+	a.Direction = ServerToClient
+	// A frame sent by the client reflected back to it
+	_, _, err := a.Verify(Sign(NewACKMessage(), testAuthID, testAuthKey, ClientToServer, now), now)
+	expectAuthError(t, err, "a reflected frame")
+	if _, _, err := a.Verify(Sign(NewACKMessage(), testAuthID, testAuthKey, ServerToClient, now), now); err != nil {
+		t.Fatalf("Failed to verify frame: %s", err)
+	}
+}
+
+func TestReplayCache(t *testing.T) {
+	now := time.Now()
+	replays := &ReplayCache{}
+	a, b := testAuthenticator(), testAuthenticator()
+	a.Replays, b.Replays = replays, replays
+	frame := Sign(NewACKMessage(), testAuthID, testAuthKey, ClientToServer, now)
+	if _, _, err := a.Verify(frame, now); err != nil {
+		t.Fatalf("Failed to verify frame: %s", err)
+	}
+	_, _, err := b.Verify(frame, now)
+	expectAuthError(t, err, "a frame replayed to another Authenticator")
+
+	// Nonces are forgotten once their frames are too old anyway.
+	later := now.Add(2 * DefaultMaxClockSkew)
+	replays.add(make([]byte, 16), make([]byte, 8), later, later)
+	if len(replays.seen) != 1 || len(replays.buckets) != 1 {
+		t.Fatalf("Incorrect cache size. Expected 1 nonce in 1 bucket, got %d in %d", len(replays.seen), len(replays.buckets))
+	}
+}
@@ -0,0 +1,907 @@
+// Package client implements an NPMP probe agent. A Client registers with a
+// server, applies the Settings it's given and runs the jobs the server
+// starts, returning their results as Data messages.
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/usi-lfkeitel/npmp"
+)
+
+// ErrNoRunner is logged by a Client with no Runner when a job is started. The
+// job is then ended.
+var ErrNoRunner = errors.New("No job runner")
+
+// A RegisterError is returned when the server rejects a registration. It
+// wraps the NAK as a *npmp.NAKError, so errors.Is(err, npmp.ErrNotAuthorized)
+// holds for a client the server doesn't accept.
+type RegisterError struct {
+	Code       npmp.NACKResponseCode
+	Diagnostic string
+}
+
+func (e *RegisterError) Error() string {
+	if e.Diagnostic != "" {
+		return fmt.Sprintf("Registration rejected: %s: %s", e.Code, e.Diagnostic)
+	}
+	return fmt.Sprintf("Registration rejected: %s", e.Code)
+}
+
+func (e *RegisterError) Unwrap() error {
+	return &npmp.NAKError{Code: e.Code, Diagnostic: e.Diagnostic}
+}
+
+// Settings holds the values received from the server.
+type Settings struct {
+	ServerIP           net.IP
+	IperfServerAddress string
+	IperfServerPort    uint16
+	Heartbeat          time.Duration
+
+	// Options is every option received, in order. Later Settings messages
+	// replace options with the same code.
+	Options []npmp.Option
+}
+
+// Option returns the value of the option with the given code.
+func (s *Settings) Option(code npmp.OptionCode) ([]byte, bool) {
+	for _, o := range s.Options {
+		if o.Code == code {
+			return o.Value, true
+		}
+	}
+	return nil, false
+}
+
+// apply merges the options of m into s.
+func (s *Settings) apply(m *npmp.SettingsMessage) {
+	for _, o := range m.Options {
+		replaced := false
+		for i := range s.Options {
+			if s.Options[i].Code == o.Code {
+				s.Options[i] = o
+				replaced = true
+			}
+		}
+		if !replaced {
+			s.Options = append(s.Options, o)
+		}
+	}
+
+	if ip, err := m.ServerIP(); err == nil {
+		s.ServerIP = ip
+	}
+	if addr, err := m.IperfServerAddress(); err == nil {
+		s.IperfServerAddress = addr
+	}
+	if port, err := m.IperfServerPort(); err == nil {
+		s.IperfServerPort = port
+	}
+	if d, err := m.HeartbeatDuration(); err == nil {
+		s.Heartbeat = d
+	}
+}
+
+// copy returns a deep enough copy of s for a job to keep.
+func (s *Settings) copy() Settings {
+	c := *s
+	c.Options = append([]npmp.Option(nil), s.Options...)
+	return c
+}
+
+// A Job is started by the server with a Start message.
+type Job struct {
+	ID       []byte    // 4 byte job ID
+	Spec     *npmp.Job // Definition sent in a JobSpec option, nil if none was sent
+	Settings Settings  // Settings when the job started, with the ones leased to it
+	Deadline time.Time // When the resources leased to the job expire, zero if none
+}
+
+// A Runner executes jobs. The returned Data message is sent to the server
+// with its job ID set to that of the job. Run should return promptly when
+// ctx is cancelled.
+type Runner interface {
+	Run(ctx context.Context, job *Job) (npmp.DataMessage, error)
+}
+
+// RunnerFunc adapts a function to the Runner interface.
+type RunnerFunc func(ctx context.Context, job *Job) (npmp.DataMessage, error)
+
+// Run calls f(ctx, job).
+func (f RunnerFunc) Run(ctx context.Context, job *Job) (npmp.DataMessage, error) {
+	return f(ctx, job)
+}
+
+// An Updater installs the client software a server offers.
+type Updater interface {
+	// Update downloads the version of the software found at repo and
+	// stages it to replace the running one.
+	Update(ctx context.Context, version string, repo *url.URL) error
+}
+
+// A Client is a probe agent. A Client can run a single connection at a time.
+type Client struct {
+	// ID is the 16 byte client ID sent when registering. Use LoadOrCreateID
+	// to keep it persistent.
+	ID []byte
+
+	// Interfaces are sent when registering. If nil, LocalInterfaces is used.
+	Interfaces []*npmp.NetInterface
+
+	// Runner executes jobs started by the server.
+	Runner Runner
+
+	// SoftwareVersion, if set, is reported to the server in a Settings
+	// message after registering.
+	SoftwareVersion string
+
+	// Updater, if set, installs the software the server offers in the
+	// ClientSoftwareVersion and ClientSoftwareRepo options when its version
+	// is newer than SoftwareVersion, see npmp.CompareVersions. The outcome
+	// is reported to the server in a SoftwareUpdate Data message.
+	Updater Updater
+
+	// OnSettings is called after a Settings message from the server has
+	// been applied.
+	OnSettings func(s Settings)
+
+	// HeartbeatMisses is the number of heartbeat intervals without a
+	// message after which the server is considered offline. If zero,
+	// npmp.DefaultHeartbeatMisses is used.
+	HeartbeatMisses int
+
+	// OnLiveness is called when the server misses too many heartbeats and
+	// is considered offline, and when it is heard from again. The
+	// connection stays open; the callback may cancel Run's context.
+	OnLiveness func(alive bool)
+
+	// TLSConfig, if set, makes DialAndRun connect with TLS. Its
+	// Certificates should hold a certificate issued to the client ID when
+	// the server asks for one.
+	TLSConfig *tls.Config
+
+	// Key, if set, is the pre-shared key the client signs its frames with.
+	// Frames from the server must be signed with it too.
+	Key []byte
+
+	// Versions are the protocol versions offered to the server. If nil,
+	// every version in npmp.SupportedVersions is offered.
+	Versions []byte
+
+	// MaxFrameSize is the largest frame accepted from the server. If zero,
+	// npmp.DefaultMaxFrameSize is used.
+	MaxFrameSize uint32
+
+	// ErrorLog specifies an optional logger for errors. If nil, the log
+	// package's standard logger is used.
+	ErrorLog *log.Logger
+
+	wmu sync.Mutex // Serializes writes
+	enc *npmp.Encoder
+
+	hb        *npmp.HeartbeatMonitor
+	heartbeat chan struct{} // Signals a change of the heartbeat interval
+
+	mu        sync.Mutex
+	version   byte
+	sequenced bool   // Whether requests carry sequence numbers
+	seq       uint32 // Sequence number of the last request
+	settings  Settings
+	pending   []*request
+	jobs      map[string]context.CancelFunc
+	specs     map[string]*npmp.Job // Job definitions waiting for a Start
+	updated   string               // Version installed or being installed
+
+	replays npmp.ReplayCache // Frames from the server, across connections
+}
+
+// A request is a message sent to the server awaiting its reply.
+type request struct {
+	mt    npmp.MessageType
+	seq   uint32
+	codes []npmp.OptionCode // Options asked for by an Inform
+	reply chan npmp.Messanger
+}
+
+// DialAndRun connects to the server at the TCP address addr, with TLS if
+// TLSConfig is set, and calls Run.
+func (c *Client) DialAndRun(ctx context.Context, addr string) error {
+	var conn net.Conn
+	var err error
+	if c.TLSConfig != nil {
+		d := tls.Dialer{Config: c.TLSConfig}
+		conn, err = d.DialContext(ctx, "tcp", addr)
+	} else {
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	return c.Run(ctx, conn)
+}
+
+// Run registers over conn and processes messages from the server until it
+// disconnects, ctx is cancelled or an error occurs. conn is closed when Run
+// returns. A nil error is returned if either side disconnected cleanly, and
+// ctx's error if it is done before registration completed.
+func (c *Client) Run(ctx context.Context, conn net.Conn) error {
+	defer conn.Close()
+	dec := npmp.NewDecoder(conn)
+	if c.MaxFrameSize != 0 {
+		dec.MaxFrameSize = c.MaxFrameSize
+	}
+
+	enc := npmp.NewEncoder(conn)
+	if c.Key != nil {
+		enc.SetKey(c.ID, c.Key, npmp.ClientToServer)
+		dec.Auth = &npmp.Authenticator{
+			Keys:      npmp.KeyMap{hex.EncodeToString(c.ID): c.Key},
+			Direction: npmp.ServerToClient,
+			Replays:   &c.replays,
+		}
+	}
+
+	c.mu.Lock()
+	c.enc = enc
+	c.settings = Settings{}
+	c.version = 0
+	c.sequenced = false
+	c.pending = nil
+	c.jobs = make(map[string]context.CancelFunc)
+	c.specs = make(map[string]*npmp.Job)
+	c.hb = &npmp.HeartbeatMonitor{Misses: c.HeartbeatMisses, OnChange: c.OnLiveness}
+	c.heartbeat = make(chan struct{}, 1)
+	c.mu.Unlock()
+
+	jobCtx, cancelJobs := context.WithCancel(ctx)
+	defer cancelJobs()
+
+	// Registration blocks on conn, which is closed if ctx is done first.
+	registered := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-registered:
+		}
+	}()
+	err := c.register(dec)
+	close(registered)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+
+	errc := make(chan error, 1)
+	go func() { errc <- c.readLoop(jobCtx, dec) }()
+	go c.runHeartbeat(jobCtx)
+	if c.SoftwareVersion != "" {
+		go c.reportVersion(jobCtx)
+	}
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		c.send(npmp.NewDisconnectMessage())
+		return nil
+	}
+}
+
+// Alive returns false while the server is considered offline because it
+// missed too many heartbeats.
+func (c *Client) Alive() bool {
+	c.mu.Lock()
+	hb := c.hb
+	c.mu.Unlock()
+	return hb == nil || hb.Alive()
+}
+
+// Version returns the protocol version in use on the current connection.
+func (c *Client) Version() byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.version
+}
+
+// Settings returns the settings received from the server so far.
+func (c *Client) Settings() Settings {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.settings.copy()
+}
+
+// register negotiates the protocol version, sends the Register message and
+// waits for the ACK and Settings. If the server doesn't negotiate versions
+// the Register message is sent with the highest version offered first and
+// resent as version 0 if the server doesn't support it.
+func (c *Client) register(dec *npmp.Decoder) error {
+	ifaces := c.Interfaces
+	if ifaces == nil {
+		var err error
+		if ifaces, err = LocalInterfaces(); err != nil {
+			return err
+		}
+	}
+
+	version, negotiated, err := c.negotiate(dec)
+	if err != nil {
+		return err
+	}
+
+	reg := npmp.NewRegisterMessage()
+	reg.SetVersion(version)
+	reg.SetClientID(c.ID)
+	for _, i := range ifaces {
+		reg.AddInterface(i)
+	}
+
+	var m npmp.Messanger
+	for {
+		if err := c.send(reg); err != nil {
+			return err
+		}
+		if m, err = dec.Decode(); err != nil {
+			return err
+		}
+		nak, ok := m.(npmp.NAKMessage)
+		if !ok {
+			break
+		}
+		if nak.ResponseCode() != npmp.UnsupportedVersion || reg.Version() == 0 || negotiated {
+			return &RegisterError{Code: nak.ResponseCode(), Diagnostic: nak.Diagnostic()}
+		}
+		reg.SetVersion(0)
+	}
+	if mt := npmp.Message(m.Bytes()).MessageType(); mt != npmp.ACK {
+		return fmt.Errorf("Unexpected %s message during registration", mt)
+	}
+
+	m, err = dec.Decode()
+	if err != nil {
+		return err
+	}
+	settings, ok := m.(*npmp.SettingsMessage)
+	if !ok {
+		return fmt.Errorf("Unexpected %s message during registration", npmp.Message(m.Bytes()).MessageType())
+	}
+	version = reg.Version()
+	if v, err := settings.ProtocolVersion(); err == nil {
+		if _, ok := npmp.NegotiateVersion(c.versions(), []byte{v}); ok {
+			version = v
+		}
+	}
+	c.setVersion(version)
+	c.applySettings(settings)
+	return nil
+}
+
+// negotiate offers the client's versions to the server in a Version message.
+// It returns the version chosen by the server, or the highest version offered
+// and false if the server doesn't negotiate versions. The Version message is
+// sent as version 0 so that every server can read it.
+func (c *Client) negotiate(dec *npmp.Decoder) (byte, bool, error) {
+	versions := c.versions()
+	highest, ok := npmp.NegotiateVersion(versions, npmp.SupportedVersions())
+	if !ok {
+		return 0, false, errors.New("No supported protocol versions offered")
+	}
+
+	vm := npmp.NewVersionMessage()
+	vm.SetVersions(versions)
+	if err := c.send(vm); err != nil {
+		return 0, false, err
+	}
+	m, err := dec.Decode()
+	if err != nil {
+		return 0, false, err
+	}
+	switch m := m.(type) {
+	case npmp.VersionMessage:
+		chosen := m.Versions()
+		if len(chosen) != 1 {
+			return 0, false, fmt.Errorf("Server chose %d protocol versions", len(chosen))
+		}
+		if _, ok := npmp.NegotiateVersion(versions, chosen); !ok {
+			return 0, false, fmt.Errorf("Server chose unsupported protocol version %d", chosen[0])
+		}
+		return chosen[0], true, nil
+	case npmp.NAKMessage:
+		if code := m.ResponseCode(); code == npmp.UnsupportedVersion || code == npmp.NotAuthorized {
+			return 0, false, &RegisterError{Code: m.ResponseCode(), Diagnostic: m.Diagnostic()}
+		}
+		return highest, false, nil // The server predates version negotiation
+	}
+	return 0, false, fmt.Errorf("Unexpected %s message during version negotiation", npmp.Message(m.Bytes()).MessageType())
+}
+
+func (c *Client) versions() []byte {
+	if c.Versions == nil {
+		return npmp.SupportedVersions()
+	}
+	return c.Versions
+}
+
+// setVersion stamps v on every message sent from then on.
+func (c *Client) setVersion(v byte) {
+	c.wmu.Lock()
+	c.enc.SetVersion(v)
+	c.wmu.Unlock()
+	c.mu.Lock()
+	c.version = v
+	c.sequenced = v >= npmp.SeqVersion
+	c.mu.Unlock()
+}
+
+func (c *Client) readLoop(ctx context.Context, dec *npmp.Decoder) error {
+	for {
+		m, err := dec.Decode()
+		if err != nil {
+			var derr *npmp.DecodeError
+			if errors.As(err, &derr) {
+				c.hb.Seen()
+				c.logf("npmp: invalid message from server: %s", err)
+				continue
+			}
+			return err
+		}
+
+		c.hb.Seen()
+		seq, sequenced := dec.Seq()
+		switch m := m.(type) {
+		case *npmp.SettingsMessage:
+			r := c.match(seq, sequenced, func(r *request) bool { return r.answeredBy(m) })
+			// The resources leased to a job are only the job's, see runJob.
+			if r == nil || r.mt != npmp.Start {
+				c.applySettings(m)
+				c.offerUpdate(ctx, m)
+			}
+			r.resolve(m)
+		case npmp.StartMessage:
+			c.startJob(ctx, m.JobID())
+		case npmp.EndMessage:
+			c.cancelJob(m.JobID())
+		case npmp.NAKMessage:
+			c.match(seq, sequenced, nil).resolve(m)
+		case npmp.Message:
+			switch m.MessageType() {
+			case npmp.Disconnect:
+				return nil
+			case npmp.ACK:
+				c.match(seq, sequenced, nil).resolve(m)
+			}
+		}
+	}
+}
+
+func (c *Client) applySettings(m *npmp.SettingsMessage) {
+	jobs, err := m.Jobs()
+	if err != nil {
+		c.logf("npmp: invalid JobSpec from server: %s", err)
+	}
+
+	c.mu.Lock()
+	for _, j := range jobs {
+		c.specs[string(j.ID)] = j
+	}
+	heartbeat := c.settings.Heartbeat
+	c.settings.apply(m)
+	if c.settings.Heartbeat != heartbeat {
+		select {
+		case c.heartbeat <- struct{}{}:
+		default:
+		}
+	}
+	s := c.settings.copy()
+	c.mu.Unlock()
+
+	if c.OnSettings != nil {
+		c.OnSettings(s)
+	}
+}
+
+// Refresh asks the server for the options with the given codes, such as the
+// HeartbeatDuration or the IperfServerAddress, and returns the client's
+// Settings once the answer has been applied. The server answers with only
+// the requested options, or rejects the request if it doesn't know one.
+func (c *Client) Refresh(ctx context.Context, codes ...npmp.OptionCode) (Settings, error) {
+	m := npmp.NewInformMessage()
+	m.SetOptions(codes)
+	reply, err := c.request(ctx, m)
+	if err != nil {
+		return Settings{}, err
+	}
+	if nak, ok := reply.(npmp.NAKMessage); ok {
+		return Settings{}, fmt.Errorf("Inform rejected: %w", nak.Err())
+	}
+	return c.Settings(), nil
+}
+
+// reportVersion tells the server the client's SoftwareVersion.
+func (c *Client) reportVersion(ctx context.Context) {
+	m := npmp.NewSettingsMessage()
+	if err := m.SetClientSoftwareVersion(c.SoftwareVersion); err != nil {
+		c.logf("npmp: software version: %s", err)
+		return
+	}
+	reply, err := c.request(ctx, m)
+	if err != nil {
+		if ctx.Err() == nil {
+			c.logf("npmp: software version: %s", err)
+		}
+		return
+	}
+	if nak, ok := reply.(npmp.NAKMessage); ok {
+		c.logf("npmp: software version rejected: %s", nak.Err())
+	}
+}
+
+// offerUpdate starts an update if the Settings offer a software version
+// newer than the running one.
+func (c *Client) offerUpdate(ctx context.Context, m *npmp.SettingsMessage) {
+	if c.Updater == nil {
+		return
+	}
+	version, err := m.ClientSoftwareVersion()
+	if err != nil {
+		return
+	}
+	repo, err := m.ClientSoftwareRepo()
+	if err != nil || npmp.CompareVersions(version, c.SoftwareVersion) <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	if c.updated == version {
+		c.mu.Unlock()
+		return
+	}
+	c.updated = version
+	c.mu.Unlock()
+
+	go c.update(ctx, version, repo)
+}
+
+// update runs the Updater and reports its outcome to the server. A failed
+// update is tried again the next time it is offered.
+func (c *Client) update(ctx context.Context, version string, repo *url.URL) {
+	res := &npmp.UpdateResult{Version: version}
+	if err := c.Updater.Update(ctx, version, repo); err != nil {
+		c.mu.Lock()
+		c.updated = ""
+		c.mu.Unlock()
+		if ctx.Err() != nil {
+			return
+		}
+		c.logf("npmp: update to %s: %s", version, err)
+		res.Error = err.Error()
+	}
+
+	data := npmp.NewDataMessage()
+	if err := data.SetUpdateResult(res); err != nil {
+		c.logf("npmp: update to %s: %s", version, err)
+		return
+	}
+	if _, err := c.request(ctx, data); err != nil && ctx.Err() == nil {
+		c.logf("npmp: update to %s: %s", version, err)
+	}
+}
+
+// runHeartbeat sends a Null message to the server every heartbeat interval
+// and checks that the server does the same, until ctx is done. The interval
+// is the latest HeartbeatDuration received, no heartbeats are sent while it
+// is zero.
+func (c *Client) runHeartbeat(ctx context.Context) {
+	hctx, stop := context.WithCancel(ctx)
+	for {
+		select {
+		case <-c.heartbeat:
+		case <-ctx.Done():
+			stop()
+			return
+		}
+		stop()
+		hctx, stop = context.WithCancel(ctx)
+		c.mu.Lock()
+		d := c.settings.Heartbeat
+		c.mu.Unlock()
+		if d > 0 {
+			go c.hb.Run(hctx, d, func() error { return c.send(npmp.NewNullMessage()) })
+		}
+	}
+}
+
+// isStartReply reports whether a Settings message can be the server's answer
+// to a Start, which carries the resources leased to the job rather than new
+// jobs.
+func isStartReply(m *npmp.SettingsMessage) bool {
+	if _, ok := m.Option(npmp.JobSpec); ok {
+		return false
+	}
+	_, port := m.Option(npmp.IperfServerPort)
+	_, deadline := m.Option(npmp.JobResourceDeadline)
+	return port || deadline
+}
+
+// send writes a message to the server.
+func (c *Client) send(m npmp.Messanger) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.enc.Encode(m)
+}
+
+// SendAndWait sends a message to the server and waits for the ACK, NAK or
+// Settings message answering it. A NAK is returned along with a
+// *npmp.NAKError carrying its response code and diagnostic. Since protocol
+// version 2 replies are matched to requests by sequence number, so any
+// number of requests may be outstanding. On older connections a reply
+// answers the oldest outstanding request, and a Settings message answers an
+// Inform only if it carries exactly the requested options, or a Start only
+// if it carries the resources leased to the job. A Settings message the
+// server pushes with those same options is taken as the reply.
+func (c *Client) SendAndWait(ctx context.Context, m npmp.Messanger) (npmp.Messanger, error) {
+	reply, err := c.request(ctx, m)
+	if err != nil {
+		return nil, err
+	}
+	if nak, ok := reply.(npmp.NAKMessage); ok {
+		return reply, nak.Err()
+	}
+	return reply, nil
+}
+
+// request sends a message to the server and waits for its reply. Replies
+// carry the sequence number of their request if the protocol version has
+// them. Otherwise the server answers requests in order so replies are
+// matched to the oldest pending request.
+func (c *Client) request(ctx context.Context, m npmp.Messanger) (npmp.Messanger, error) {
+	r := &request{
+		mt:    npmp.Message(m.Bytes()).MessageType(),
+		reply: make(chan npmp.Messanger, 1),
+	}
+	if r.mt == npmp.Inform {
+		r.codes = npmp.InformMessage{Message: npmp.Message(m.Bytes())}.Options()
+	}
+	// The request is queued while holding the write lock so the queue
+	// order matches the order on the wire.
+	c.wmu.Lock()
+	c.mu.Lock()
+	sequenced := c.sequenced
+	if sequenced {
+		c.seq++
+		r.seq = c.seq
+	}
+	c.pending = append(c.pending, r)
+	c.mu.Unlock()
+	var err error
+	if sequenced {
+		err = c.enc.EncodeSeq(m, r.seq)
+	} else {
+		err = c.enc.Encode(m)
+	}
+	c.wmu.Unlock()
+	if err != nil {
+		c.dequeue(r)
+		return nil, err
+	}
+
+	select {
+	case reply := <-r.reply:
+		return reply, nil
+	case <-ctx.Done():
+		c.dequeue(r)
+		return nil, ctx.Err()
+	}
+}
+
+// dequeue removes a request which won't wait for its reply. Only sequenced
+// requests are removed, as without sequence numbers the reply still has to
+// be matched to the request to keep the queue in step with the server.
+func (c *Client) dequeue(r *request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.sequenced {
+		return
+	}
+	for i, p := range c.pending {
+		if p == r {
+			c.pending = append(c.pending[:i:i], c.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+// match removes and returns the pending request a message answers, nil if
+// it answers none. A message with a sequence number answers the request with
+// that number. Without one it answers the oldest request, provided answers
+// reports so if given. Once requests carry sequence numbers a message
+// without one is never a reply.
+func (c *Client) match(seq uint32, sequenced bool, answers func(r *request) bool) *request {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if sequenced {
+		for i, r := range c.pending {
+			if r.seq == seq {
+				c.pending = append(c.pending[:i:i], c.pending[i+1:]...)
+				return r
+			}
+		}
+		return nil
+	}
+	if c.sequenced || len(c.pending) == 0 {
+		return nil
+	}
+	r := c.pending[0]
+	if answers != nil && !answers(r) {
+		return nil
+	}
+	c.pending = c.pending[1:]
+	return r
+}
+
+// answeredBy reports whether a Settings message without a sequence number
+// can be the reply to r: the resources leased to a Start, or exactly the
+// options an Inform asked for. Any other Settings message is sent by the
+// server on its own.
+func (r *request) answeredBy(m *npmp.SettingsMessage) bool {
+	switch r.mt {
+	case npmp.Start:
+		return isStartReply(m)
+	case npmp.Inform:
+		for _, o := range m.Options {
+			if !hasCode(r.codes, o.Code) {
+				return false
+			}
+		}
+		for _, code := range r.codes {
+			if _, ok := m.Option(code); !ok {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func hasCode(codes []npmp.OptionCode, code npmp.OptionCode) bool {
+	for _, c := range codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve passes the reply to the request, if there is one.
+func (r *request) resolve(reply npmp.Messanger) {
+	if r != nil {
+		r.reply <- reply
+	}
+}
+
+// startJob runs the job in its own goroutine. Without a Runner the job is
+// ended straight away so that the server can release it.
+func (c *Client) startJob(ctx context.Context, id []byte) {
+	id = append([]byte(nil), id...)
+	if c.Runner == nil {
+		c.logf("npmp: job %x: %s", id, ErrNoRunner)
+		c.mu.Lock()
+		delete(c.specs, string(id))
+		c.mu.Unlock()
+		go func() {
+			end := npmp.NewEndMessage()
+			end.SetJobID(id)
+			if _, err := c.SendAndWait(ctx, end); err != nil && ctx.Err() == nil {
+				c.logf("npmp: job %x: %s", id, err)
+			}
+		}()
+		return
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	c.mu.Lock()
+	if _, ok := c.jobs[string(id)]; ok {
+		c.mu.Unlock()
+		cancel()
+		return
+	}
+	c.jobs[string(id)] = cancel
+	c.mu.Unlock()
+
+	go func() {
+		defer c.finishJob(id)
+		if err := c.runJob(ctx, id); err != nil && ctx.Err() == nil {
+			c.logf("npmp: job %x: %s", id, err)
+		}
+	}()
+}
+
+// runJob announces the job to the server, runs it and sends the results.
+func (c *Client) runJob(ctx context.Context, id []byte) error {
+	start := npmp.NewStartMessage()
+	start.SetJobID(id)
+	reply, err := c.request(ctx, start)
+	if err != nil {
+		return err
+	}
+	if nak, ok := reply.(npmp.NAKMessage); ok {
+		return fmt.Errorf("Start rejected: %w", nak.Err())
+	}
+
+	c.mu.Lock()
+	job := &Job{ID: id, Spec: c.specs[string(id)], Settings: c.settings.copy()}
+	delete(c.specs, string(id))
+	c.mu.Unlock()
+
+	// The server may answer with the resources leased to the job, which
+	// must be given up by their deadline.
+	runCtx := ctx
+	if m, ok := reply.(*npmp.SettingsMessage); ok {
+		job.Settings.apply(m)
+		if t, err := m.JobResourceDeadline(); err == nil {
+			job.Deadline = t
+			var cancel context.CancelFunc
+			runCtx, cancel = context.WithDeadline(ctx, t)
+			defer cancel()
+		}
+	}
+
+	data, runErr := c.Runner.Run(runCtx, job)
+	if ctx.Err() != nil {
+		return ctx.Err() // Ended by the server or the client is shutting down
+	}
+	if runErr == nil {
+		data.SetJobID(id)
+		if _, err := c.request(ctx, data); err != nil {
+			return err
+		}
+	}
+
+	end := npmp.NewEndMessage()
+	end.SetJobID(id)
+	if _, err := c.request(ctx, end); err != nil {
+		return err
+	}
+	return runErr
+}
+
+// cancelJob stops a running job at the request of the server.
+func (c *Client) cancelJob(id []byte) {
+	c.mu.Lock()
+	cancel := c.jobs[string(id)]
+	c.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+}
+
+func (c *Client) finishJob(id []byte) {
+	c.mu.Lock()
+	cancel := c.jobs[string(id)]
+	delete(c.jobs, string(id))
+	c.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+}
+
+func (c *Client) logf(format string, args ...interface{}) {
+	if c.ErrorLog != nil {
+		c.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
@@ -0,0 +1,954 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/usi-lfkeitel/npmp"
+	"github.com/usi-lfkeitel/npmp/server"
+)
+
+var testClientID = []byte{99, 226, 170, 251, 37, 41, 43, 236, 249, 80, 159, 109, 149, 85, 244, 19}
+
+func startServer(t *testing.T, srv *server.Server) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+	return l.Addr().String()
+}
+
+func TestClientJob(t *testing.T) {
+	registered := make(chan *server.Session, 1)
+	results := make(chan npmp.DataMessage, 1)
+	ended := make(chan []byte, 1)
+
+	port := make([]byte, 2)
+	binary.LittleEndian.PutUint16(port, 5201)
+	srv := &server.Server{
+		Handler: server.Handler{
+			OnRegister: func(s *server.Session, m *npmp.RegisterMessage) (*npmp.SettingsMessage, error) {
+				if len(m.Interfaces) != 1 {
+					t.Errorf("Incorrect number of interfaces. Expected 1, got %d", len(m.Interfaces))
+				}
+				settings := npmp.NewSettingsMessage()
+				settings.AddOption(npmp.Option{Code: npmp.ServerIP, Value: []byte{10, 0, 0, 1}})
+				settings.AddOption(npmp.Option{Code: npmp.IperfServerAddress, Value: []byte("iperf.example.com")})
+				settings.AddOption(npmp.Option{Code: npmp.IperfServerPort, Value: port})
+				registered <- s
+				return settings, nil
+			},
+			OnData: func(s *server.Session, m npmp.DataMessage) error {
+				results <- m
+				return nil
+			},
+			OnEnd: func(s *server.Session, m npmp.EndMessage) error {
+				ended <- append([]byte(nil), m.JobID()...)
+				return nil
+			},
+		},
+	}
+	addr := startServer(t, srv)
+
+	c := &Client{
+		ID: testClientID,
+		Interfaces: []*npmp.NetInterface{{
+			Type:   npmp.WiredEthernet,
+			Haddr:  net.HardwareAddr{0xab, 0xcd, 0xef, 0x12, 0x34, 0x56},
+			IPAddr: net.IP{192, 168, 0, 10},
+		}},
+	}
+	mux := NewMux()
+	mux.Handle(npmp.Ping, RunnerFunc(func(ctx context.Context, job *Job) (npmp.DataMessage, error) {
+		if job.Settings.IperfServerPort != 5201 {
+			t.Errorf("Incorrect iperf port. Expected 5201, got %d", job.Settings.IperfServerPort)
+		}
+		if job.Spec == nil || job.Spec.Target != "10.0.0.2" {
+			t.Errorf("Incorrect job spec. Expected target 10.0.0.2, got %+v", job.Spec)
+		}
+		m := npmp.NewDataMessage()
+		m.SetDataType(npmp.Ping)
+		m.SetData([]byte("pong"))
+		return m, nil
+	}))
+	c.Runner = mux
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- c.DialAndRun(ctx, addr) }()
+
+	s := <-registered
+	jobID := []byte{1, 2, 3, 4}
+	job := &npmp.Job{ID: jobID, Type: npmp.Ping, Transport: npmp.ICMP, Target: "10.0.0.2", Count: 5}
+	if err := s.StartJobSpec(job); err != nil {
+		t.Fatalf("Failed to start job: %s", err)
+	}
+
+	select {
+	case m := <-results:
+		if !bytes.Equal(m.JobID(), jobID) || string(m.Data()) != "pong" {
+			t.Fatalf("Incorrect result. Expected pong for job %v, got %s for job %v", jobID, m.Data(), m.JobID())
+		}
+	case <-ctx.Done():
+		t.Fatal("Timed out waiting for job results")
+	}
+	if id := <-ended; !bytes.Equal(id, jobID) {
+		t.Fatalf("Incorrect ended job. Expected %v, got %v", jobID, id)
+	}
+
+	settings := c.Settings()
+	if !settings.ServerIP.Equal(net.IP{10, 0, 0, 1}) || settings.IperfServerAddress != "iperf.example.com" {
+		t.Fatalf("Incorrect settings: %+v", settings)
+	}
+
+	s.Close()
+	if err := <-done; err != nil {
+		t.Fatalf("Unexpected error from client: %s", err)
+	}
+}
+
+func TestClientRegisterRejected(t *testing.T) {
+	srv := &server.Server{
+		Handler: server.Handler{
+			OnRegister: func(s *server.Session, m *npmp.RegisterMessage) (*npmp.SettingsMessage, error) {
+				return nil, context.Canceled
+			},
+		},
+	}
+	addr := startServer(t, srv)
+
+	c := &Client{ID: testClientID, Interfaces: []*npmp.NetInterface{}}
+	err := c.DialAndRun(context.Background(), addr)
+	if rerr, ok := err.(*RegisterError); !ok || rerr.Code != npmp.GeneralError {
+		t.Fatalf("Incorrect error. Expected RegisterError, got %v", err)
+	}
+}
+
+func TestLoadOrCreateID(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "npmp", "client-id")
+	id, err := LoadOrCreateID(path)
+	if err != nil {
+		t.Fatalf("Failed to create ID: %s", err)
+	}
+	if len(id) != IDLength {
+		t.Fatalf("Incorrect ID length. Expected %d, got %d", IDLength, len(id))
+	}
+	id2, err := LoadOrCreateID(path)
+	if err != nil {
+		t.Fatalf("Failed to load ID: %s", err)
+	}
+	if !bytes.Equal(id, id2) {
+		t.Fatalf("ID not persisted. Expected %v, got %v", id, id2)
+	}
+}
+
+func TestClientRegisterCancel(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	defer l.Close()
+	// A server which accepts the connection but never answers
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(io.Discard, conn)
+	}()
+
+	c := &Client{ID: testClientID, Interfaces: []*npmp.NetInterface{}}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := c.DialAndRun(ctx, l.Addr().String()); err != context.DeadlineExceeded {
+		t.Fatalf("Incorrect error. Expected DeadlineExceeded, got %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("Registration took %s to stop after the deadline", d)
+	}
+}
+
+func TestClientRegisterFallback(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	defer l.Close()
+
+	// A server which only understands version 0 and doesn't negotiate
+	versions := make(chan byte, 2)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		enc, dec := npmp.NewEncoder(conn), npmp.NewDecoder(conn)
+		for {
+			m, err := dec.Decode()
+			if err != nil {
+				return
+			}
+			if npmp.Message(m.Bytes()).MessageType() == npmp.Version {
+				nak := npmp.NewNAKMessage()
+				nak.SetResponseCode(npmp.InvalidData)
+				enc.Encode(nak)
+				continue
+			}
+			v := npmp.Message(m.Bytes()).Version()
+			versions <- v
+			if v != 0 {
+				nak := npmp.NewNAKMessage()
+				nak.SetResponseCode(npmp.UnsupportedVersion)
+				enc.Encode(nak)
+				continue
+			}
+			enc.Encode(npmp.NewACKMessage())
+			enc.Encode(npmp.NewSettingsMessage())
+			enc.Encode(npmp.NewDisconnectMessage())
+		}
+	}()
+
+	c := &Client{ID: testClientID, Interfaces: []*npmp.NetInterface{}}
+	if err := c.DialAndRun(context.Background(), l.Addr().String()); err != nil {
+		t.Fatalf("Unexpected error from client: %s", err)
+	}
+	if v := <-versions; v != npmp.MaxVersion {
+		t.Fatalf("Incorrect first version. Expected %d, got %d", npmp.MaxVersion, v)
+	}
+	if v := <-versions; v != 0 {
+		t.Fatalf("Incorrect fallback version. Expected 0, got %d", v)
+	}
+}
+
+func TestClientJobPort(t *testing.T) {
+	registered := make(chan *server.Session, 1)
+	ended := make(chan struct{}, 1)
+	srv := &server.Server{
+		Ports: server.NewPortPool(5301, 5301),
+		Handler: server.Handler{
+			OnRegister: func(s *server.Session, m *npmp.RegisterMessage) (*npmp.SettingsMessage, error) {
+				registered <- s
+				return nil, nil
+			},
+			OnEnd: func(s *server.Session, m npmp.EndMessage) error {
+				ended <- struct{}{}
+				return nil
+			},
+		},
+	}
+	addr := startServer(t, srv)
+
+	jobs := make(chan *Job, 1)
+	c := &Client{
+		ID: testClientID,
+		Runner: RunnerFunc(func(ctx context.Context, job *Job) (npmp.DataMessage, error) {
+			jobs <- job
+			m := npmp.NewDataMessage()
+			m.SetDataType(npmp.Iperf3)
+			return m, nil
+		}),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go c.DialAndRun(ctx, addr)
+
+	s := <-registered
+	deadline := time.Now().Add(time.Minute).Truncate(time.Millisecond)
+	job := &npmp.Job{ID: []byte{1, 2, 3, 4}, Type: npmp.Iperf3, Target: "10.0.0.1",
+		Duration: time.Second, Parallel: 1, Deadline: deadline}
+	if err := s.StartJobSpec(job); err != nil {
+		t.Fatalf("Failed to start job: %s", err)
+	}
+
+	select {
+	case j := <-jobs:
+		if j.Settings.IperfServerPort != 5301 {
+			t.Fatalf("Incorrect iperf port. Expected 5301, got %d", j.Settings.IperfServerPort)
+		}
+		if !j.Deadline.Equal(deadline) {
+			t.Fatalf("Incorrect deadline. Expected %s, got %s", deadline, j.Deadline)
+		}
+	case <-ctx.Done():
+		t.Fatal("Timed out waiting for job")
+	}
+	select {
+	case <-ended:
+	case <-ctx.Done():
+		t.Fatal("Timed out waiting for job to end")
+	}
+	if srv.Ports.Available() != 1 {
+		t.Fatal("Port not released after job ended")
+	}
+}
+
+func TestClientConcurrentJobs(t *testing.T) {
+	registered := make(chan *server.Session, 1)
+	srv := &server.Server{
+		Ports: server.NewPortPool(5301, 5302),
+		Handler: server.Handler{
+			OnRegister: func(s *server.Session, m *npmp.RegisterMessage) (*npmp.SettingsMessage, error) {
+				registered <- s
+				return nil, nil
+			},
+		},
+	}
+	addr := startServer(t, srv)
+
+	// Both jobs hold their leases until the other one started.
+	jobs := make(chan *Job, 2)
+	release := make(chan struct{})
+	c := &Client{
+		ID: testClientID,
+		Runner: RunnerFunc(func(ctx context.Context, job *Job) (npmp.DataMessage, error) {
+			jobs <- job
+			<-release
+			m := npmp.NewDataMessage()
+			m.SetDataType(npmp.Iperf3)
+			return m, nil
+		}),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go c.DialAndRun(ctx, addr)
+
+	s := <-registered
+	for _, id := range [][]byte{{1, 1, 1, 1}, {2, 2, 2, 2}} {
+		job := &npmp.Job{ID: id, Type: npmp.Iperf3, Target: "10.0.0.1", Duration: time.Second, Parallel: 1}
+		if err := s.StartJobSpec(job); err != nil {
+			t.Fatalf("Failed to start job: %s", err)
+		}
+	}
+
+	var started []*Job
+	for len(started) < 2 {
+		select {
+		case j := <-jobs:
+			started = append(started, j)
+		case <-ctx.Done():
+			t.Fatal("Timed out waiting for jobs")
+		}
+	}
+	ports := make(map[string]uint16)
+	for _, l := range srv.Ports.Leases() {
+		ports[string(l.JobID)] = l.Port
+	}
+	for _, j := range started {
+		if port := ports[string(j.ID)]; port == 0 || j.Settings.IperfServerPort != port {
+			t.Fatalf("Incorrect iperf port for job %v. Expected %d, got %d", j.ID, port, j.Settings.IperfServerPort)
+		}
+	}
+	close(release)
+	if settings := c.Settings(); settings.IperfServerPort != 0 {
+		t.Fatal("Incorrect client settings. Expected no leased port")
+	}
+}
+
+func TestClientHeartbeat(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	defer l.Close()
+
+	// A server which asks for heartbeats but only sends one when told to
+	nulls := make(chan struct{}, 100)
+	beat := make(chan struct{})
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		enc, dec := npmp.NewEncoder(conn), npmp.NewDecoder(conn)
+		if _, err := dec.Decode(); err != nil { // Version
+			return
+		}
+		version := npmp.NewVersionMessage()
+		version.SetVersions([]byte{0})
+		enc.Encode(version)
+		if _, err := dec.Decode(); err != nil { // Register
+			return
+		}
+		settings := npmp.NewSettingsMessage()
+		settings.SetHeartbeatDuration(20 * time.Millisecond)
+		enc.Encode(npmp.NewACKMessage())
+		enc.Encode(settings)
+		go func() {
+			<-beat
+			enc.Encode(npmp.NewNullMessage())
+		}()
+		for {
+			m, err := dec.Decode()
+			if err != nil {
+				return
+			}
+			if npmp.Message(m.Bytes()).MessageType() == npmp.Null {
+				nulls <- struct{}{}
+			}
+		}
+	}()
+
+	liveness := make(chan bool, 2)
+	c := &Client{
+		ID:              testClientID,
+		Interfaces:      []*npmp.NetInterface{},
+		HeartbeatMisses: 2,
+		OnLiveness:      func(alive bool) { liveness <- alive },
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.DialAndRun(ctx, l.Addr().String()) }()
+
+	if alive := <-liveness; alive {
+		t.Fatal("Incorrect liveness. Expected offline")
+	}
+	if c.Alive() {
+		t.Fatal("Incorrect client state. Expected the server offline")
+	}
+	select {
+	case <-nulls:
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for a heartbeat from the client")
+	}
+	close(beat)
+	if alive := <-liveness; !alive {
+		t.Fatal("Incorrect liveness. Expected online")
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Unexpected error from client: %s", err)
+	}
+}
+
+func TestClientVersion(t *testing.T) {
+	for _, test := range []struct {
+		server, client []byte
+		expected       byte
+	}{
+		{nil, nil, npmp.MaxVersion},
+		{[]byte{0}, nil, 0},
+		{nil, []byte{0}, 0},
+	} {
+		registered := make(chan byte, 1)
+		srv := &server.Server{
+			Versions: test.server,
+			Handler: server.Handler{
+				OnRegister: func(s *server.Session, m *npmp.RegisterMessage) (*npmp.SettingsMessage, error) {
+					registered <- m.Version()
+					return nil, nil
+				},
+			},
+		}
+		addr := startServer(t, srv)
+
+		settings := make(chan struct{}, 1)
+		c := &Client{
+			ID:         testClientID,
+			Interfaces: []*npmp.NetInterface{},
+			Versions:   test.client,
+			OnSettings: func(s Settings) { settings <- struct{}{} },
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() { done <- c.DialAndRun(ctx, addr) }()
+
+		<-settings
+		if v := <-registered; v != test.expected {
+			t.Fatalf("Incorrect Register version. Expected %d, got %d", test.expected, v)
+		}
+		if c.Version() != test.expected {
+			t.Fatalf("Incorrect client version. Expected %d, got %d", test.expected, c.Version())
+		}
+		cancel()
+		if err := <-done; err != nil {
+			t.Fatalf("Unexpected error from client: %s", err)
+		}
+	}
+}
+
+func TestClientVersionRejected(t *testing.T) {
+	addr := startServer(t, &server.Server{Versions: []byte{0}})
+	c := &Client{ID: testClientID, Interfaces: []*npmp.NetInterface{}, Versions: []byte{1}}
+	err := c.DialAndRun(context.Background(), addr)
+	var rerr *RegisterError
+	if !errors.As(err, &rerr) || rerr.Code != npmp.UnsupportedVersion {
+		t.Fatalf("Incorrect error. Expected RegisterError with UnsupportedVersion, got %v", err)
+	}
+}
+
+func TestClientAuth(t *testing.T) {
+	key := []byte("secret")
+	registered := make(chan struct{}, 1)
+	srv := &server.Server{
+		Keys: npmp.KeyMap{hex.EncodeToString(testClientID): key},
+		Handler: server.Handler{
+			OnRegister: func(s *server.Session, m *npmp.RegisterMessage) (*npmp.SettingsMessage, error) {
+				registered <- struct{}{}
+				return nil, nil
+			},
+		},
+	}
+	addr := startServer(t, srv)
+
+	c := &Client{ID: testClientID, Interfaces: []*npmp.NetInterface{}, Key: []byte("wrong")}
+	err := c.DialAndRun(context.Background(), addr)
+	var rerr *RegisterError
+	if !errors.As(err, &rerr) || rerr.Code != npmp.NotAuthorized {
+		t.Fatalf("Incorrect error. Expected RegisterError with NotAuthorized, got %v", err)
+	}
+	if !errors.Is(err, npmp.ErrNotAuthorized) {
+		t.Fatalf("Incorrect error. Expected %v to be ErrNotAuthorized", err)
+	}
+
+	settings := make(chan struct{}, 1)
+	c = &Client{
+		ID:         testClientID,
+		Interfaces: []*npmp.NetInterface{},
+		Key:        key,
+		OnSettings: func(s Settings) { settings <- struct{}{} },
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.DialAndRun(ctx, addr) }()
+	<-registered
+	<-settings
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Unexpected error from client: %s", err)
+	}
+}
+
+func TestClientTLS(t *testing.T) {
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "npmp test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("Failed to create CA certificate: %s", err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	issue := func(cn string) tls.Certificate {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(time.Now().UnixNano()),
+			Subject:      pkix.Name{CommonName: cn},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+			IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatalf("Failed to create certificate: %s", err)
+		}
+		return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	}
+
+	srv := &server.Server{TLSConfig: &tls.Config{
+		Certificates: []tls.Certificate{issue("npmp server")},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	}}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	go srv.Serve(tls.NewListener(l, srv.TLSConfig))
+	t.Cleanup(func() { srv.Close() })
+	addr := l.Addr().String()
+
+	c := &Client{
+		ID:         testClientID,
+		Interfaces: []*npmp.NetInterface{},
+		TLSConfig:  &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{issue("00000000000000000000000000000000")}},
+	}
+	err = c.DialAndRun(context.Background(), addr)
+	var rerr *RegisterError
+	if !errors.As(err, &rerr) || rerr.Code != npmp.NotAuthorized {
+		t.Fatalf("Incorrect error. Expected RegisterError with NotAuthorized, got %v", err)
+	}
+
+	settings := make(chan struct{}, 1)
+	c.TLSConfig = &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{issue(hex.EncodeToString(testClientID))}}
+	c.OnSettings = func(s Settings) { settings <- struct{}{} }
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.DialAndRun(ctx, addr) }()
+	<-settings
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Unexpected error from client: %s", err)
+	}
+}
+
+// testUpdater records the updates it is asked to install.
+type testUpdater struct {
+	updates chan string
+	err     error
+}
+
+func (u *testUpdater) Update(ctx context.Context, version string, repo *url.URL) error {
+	u.updates <- version + " " + repo.String()
+	return u.err
+}
+
+func TestClientUpdate(t *testing.T) {
+	repo, _ := url.Parse("https://example.com/probe")
+	results := make(chan *npmp.UpdateResult, 2)
+	srv := &server.Server{
+		Updates: &server.UpdatePolicy{Version: "1.1.0", Repo: repo},
+		Handler: server.Handler{
+			OnData: func(s *server.Session, m npmp.DataMessage) error {
+				res, err := m.UpdateResult()
+				if err != nil {
+					return err
+				}
+				results <- res
+				return nil
+			},
+		},
+	}
+	addr := startServer(t, srv)
+
+	tests := []struct {
+		err    error
+		result string
+	}{
+		{nil, ""},
+		{errors.New("Checksum mismatch"), "Checksum mismatch"},
+	}
+	for _, tt := range tests {
+		u := &testUpdater{updates: make(chan string, 1), err: tt.err}
+		c := &Client{
+			ID:              testClientID,
+			Interfaces:      []*npmp.NetInterface{},
+			SoftwareVersion: "1.0.0",
+			Updater:         u,
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() { done <- c.DialAndRun(ctx, addr) }()
+
+		if got, expected := <-u.updates, "1.1.0 "+repo.String(); got != expected {
+			t.Fatalf("Incorrect update. Expected %q, got %q", expected, got)
+		}
+		select {
+		case res := <-results:
+			if res.Version != "1.1.0" || res.Error != tt.result {
+				t.Fatalf("Incorrect update result. Expected error %q, got %+v", tt.result, res)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for the update result")
+		}
+		cancel()
+		if err := <-done; err != nil {
+			t.Fatalf("Unexpected error from client: %s", err)
+		}
+	}
+}
+
+func TestClientRefresh(t *testing.T) {
+	heartbeat := time.Hour
+	srv := &server.Server{
+		Options: server.OptionProviderFunc(func(s *server.Session, code npmp.OptionCode) ([]byte, bool) {
+			if code != npmp.HeartbeatDuration {
+				return nil, false
+			}
+			m := npmp.NewSettingsMessage()
+			m.SetHeartbeatDuration(heartbeat)
+			return m.Option(npmp.HeartbeatDuration)
+		}),
+	}
+	addr := startServer(t, srv)
+
+	registered := make(chan struct{}, 1)
+	c := &Client{
+		ID:         testClientID,
+		Interfaces: []*npmp.NetInterface{},
+		OnSettings: func(s Settings) {
+			select {
+			case registered <- struct{}{}:
+			default:
+			}
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.DialAndRun(ctx, addr) }()
+	<-registered
+
+	s, err := c.Refresh(ctx, npmp.HeartbeatDuration)
+	if err != nil {
+		t.Fatalf("Failed to refresh: %s", err)
+	}
+	if s.Heartbeat != heartbeat {
+		t.Fatalf("Incorrect heartbeat. Expected %s, got %s", heartbeat, s.Heartbeat)
+	}
+	if _, err := c.Refresh(ctx, npmp.IperfServerAddress); err == nil {
+		t.Fatal("Incorrect result. Expected an error for an option the server can't provide")
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Unexpected error from client: %s", err)
+	}
+}
+
+func TestClientPushDuringRequest(t *testing.T) {
+	// Without sequence numbers the push must be told apart from the reply.
+	for _, versions := range [][]byte{nil, {1}} {
+		testClientPushDuringRequest(t, versions)
+	}
+}
+
+func testClientPushDuringRequest(t *testing.T, versions []byte) {
+	heartbeat := time.Hour
+	srv := &server.Server{
+		Options: server.OptionProviderFunc(func(s *server.Session, code npmp.OptionCode) ([]byte, bool) {
+			// A push sent before the reply
+			push := npmp.NewSettingsMessage()
+			push.SetIperfServerAddress("iperf.example.com")
+			s.Send(push)
+			m := npmp.NewSettingsMessage()
+			m.SetHeartbeatDuration(heartbeat)
+			return m.Option(npmp.HeartbeatDuration)
+		}),
+	}
+	addr := startServer(t, srv)
+
+	registered := make(chan struct{}, 1)
+	c := &Client{
+		ID:         testClientID,
+		Interfaces: []*npmp.NetInterface{},
+		Versions:   versions,
+		OnSettings: func(s Settings) {
+			select {
+			case registered <- struct{}{}:
+			default:
+			}
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.DialAndRun(ctx, addr) }()
+	<-registered
+
+	inform := npmp.NewInformMessage()
+	inform.SetOptions([]npmp.OptionCode{npmp.HeartbeatDuration})
+	reply, err := c.SendAndWait(ctx, inform)
+	if err != nil {
+		t.Fatalf("Failed to send Inform: %s", err)
+	}
+	if _, ok := reply.(*npmp.SettingsMessage).Option(npmp.HeartbeatDuration); !ok {
+		t.Fatalf("Incorrect reply on version %d. Expected the requested HeartbeatDuration, got %v", c.Version(), reply.Bytes())
+	}
+	if s := c.Settings(); s.IperfServerAddress != "iperf.example.com" {
+		t.Fatalf("Incorrect iperf server address on version %d. Expected the pushed iperf.example.com, got %q", c.Version(), s.IperfServerAddress)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Unexpected error from client: %s", err)
+	}
+}
+
+func TestClientPushDuringInformV1(t *testing.T) {
+	srv := &server.Server{
+		Options: server.OptionProviderFunc(func(s *server.Session, code npmp.OptionCode) ([]byte, bool) {
+			// A push with more than the requested option isn't the reply
+			push := npmp.NewSettingsMessage()
+			push.SetHeartbeatDuration(2 * time.Hour)
+			push.SetIperfServerAddress("iperf.example.com")
+			s.Send(push)
+			m := npmp.NewSettingsMessage()
+			m.SetHeartbeatDuration(time.Hour)
+			return m.Option(npmp.HeartbeatDuration)
+		}),
+	}
+	addr := startServer(t, srv)
+
+	registered := make(chan struct{}, 1)
+	c := &Client{
+		ID:         testClientID,
+		Interfaces: []*npmp.NetInterface{},
+		Versions:   []byte{1},
+		OnSettings: func(s Settings) {
+			select {
+			case registered <- struct{}{}:
+			default:
+			}
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.DialAndRun(ctx, addr) }()
+	<-registered
+	if c.Version() != 1 {
+		t.Fatalf("Incorrect version. Expected 1, got %d", c.Version())
+	}
+
+	inform := npmp.NewInformMessage()
+	inform.SetOptions([]npmp.OptionCode{npmp.HeartbeatDuration})
+	reply, err := c.SendAndWait(ctx, inform)
+	if err != nil {
+		t.Fatalf("Failed to send Inform: %s", err)
+	}
+	if _, ok := reply.(*npmp.SettingsMessage).Option(npmp.IperfServerAddress); ok {
+		t.Fatal("Incorrect reply. Expected the reply, got the push")
+	}
+	if s := c.Settings(); s.IperfServerAddress != "iperf.example.com" {
+		t.Fatalf("Incorrect iperf server address. Expected the pushed iperf.example.com, got %q", s.IperfServerAddress)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Unexpected error from client: %s", err)
+	}
+}
+
+func TestClientSendAndWait(t *testing.T) {
+	srv := &server.Server{}
+	addr := startServer(t, srv)
+
+	registered := make(chan struct{}, 1)
+	c := &Client{
+		ID:         testClientID,
+		Interfaces: []*npmp.NetInterface{},
+		OnSettings: func(s Settings) {
+			select {
+			case registered <- struct{}{}:
+			default:
+			}
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.DialAndRun(ctx, addr) }()
+	<-registered
+	if c.Version() < npmp.SeqVersion {
+		t.Fatalf("Incorrect version. Expected at least %d, got %d", npmp.SeqVersion, c.Version())
+	}
+
+	// Pipelined requests are each answered with their own reply.
+	errs := make(chan error, 20)
+	for i := 0; i < 10; i++ {
+		go func() {
+			data := npmp.NewDataMessage()
+			data.SetJobID([]byte{1, 2, 3, 4})
+			_, err := c.SendAndWait(ctx, data)
+			if !errors.Is(err, npmp.ErrInvalidData) {
+				errs <- fmt.Errorf("Incorrect error. Expected ErrInvalidData, got %v", err)
+				return
+			}
+			errs <- nil
+		}()
+		go func() {
+			reply, err := c.SendAndWait(ctx, npmp.NewSettingsMessage())
+			if err != nil {
+				errs <- err
+				return
+			}
+			if mt := npmp.Message(reply.Bytes()).MessageType(); mt != npmp.ACK {
+				errs <- fmt.Errorf("Incorrect reply. Expected ACK, got %s", mt)
+				return
+			}
+			errs <- nil
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Unexpected error from client: %s", err)
+	}
+}
+
+func TestClientNoRunner(t *testing.T) {
+	ended := make(chan []byte, 1)
+	srv := &server.Server{
+		Handler: server.Handler{
+			OnEnd: func(s *server.Session, m npmp.EndMessage) error {
+				ended <- append([]byte(nil), m.JobID()...)
+				return nil
+			},
+		},
+	}
+	addr := startServer(t, srv)
+
+	registered := make(chan struct{}, 1)
+	c := &Client{
+		ID:         testClientID,
+		Interfaces: []*npmp.NetInterface{},
+		ErrorLog:   log.New(io.Discard, "", 0),
+		OnSettings: func(s Settings) {
+			select {
+			case registered <- struct{}{}:
+			default:
+			}
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.DialAndRun(ctx, addr) }()
+	<-registered
+
+	s := srv.Session(testClientID)
+	id := []byte{1, 2, 3, 4}
+	if err := s.StartJob(id); err != nil {
+		t.Fatalf("Failed to start job: %s", err)
+	}
+	select {
+	case got := <-ended:
+		if !bytes.Equal(got, id) {
+			t.Fatalf("Incorrect job ID. Expected %v, got %v", id, got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the job to end")
+	}
+	if err := s.EndJob(id); err != server.ErrUnknownJob {
+		t.Fatalf("Incorrect error. Expected ErrUnknownJob, got %v", err)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Unexpected error from client: %s", err)
+	}
+}
@@ -0,0 +1,96 @@
+package client
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/usi-lfkeitel/npmp"
+)
+
+// IDLength is the length of a client ID.
+const IDLength = 16
+
+// LoadOrCreateID reads a client ID from the file at path. If the file
+// doesn't exist a new random ID is generated and written to it so the client
+// keeps the same ID across restarts.
+func LoadOrCreateID(path string) ([]byte, error) {
+	id, err := os.ReadFile(path)
+	if err == nil {
+		if len(id) != IDLength {
+			return nil, fmt.Errorf("Invalid client ID in %s: %d bytes", path, len(id))
+		}
+		return id, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	id = make([]byte, IDLength)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, id, 0600); err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+// LocalInterfaces returns the interfaces of the host which are up, not
+// loopback and have a hardware address, along with all of their IPv4 and
+// IPv6 addresses. IPAddr is set to the first IPv4 address for servers which
+// only understand version 0 Register messages.
+func LocalInterfaces() ([]*npmp.NetInterface, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	netifs := make([]*npmp.NetInterface, 0, len(ifaces))
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		if len(iface.HardwareAddr) == 0 {
+			continue
+		}
+
+		netif := &npmp.NetInterface{
+			Type:   npmp.WiredEthernet,
+			Haddr:  iface.HardwareAddr,
+			IPAddr: net.IPv4zero.To4(),
+		}
+		if isWireless(iface.Name) {
+			netif.Type = npmp.WirelessEthernet
+		}
+
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			netif.Addrs = append(netif.Addrs, ipnet)
+			if ip := ipnet.IP.To4(); ip != nil && netif.IPAddr.Equal(net.IPv4zero) {
+				netif.IPAddr = ip
+			}
+		}
+		netifs = append(netifs, netif)
+	}
+	return netifs, nil
+}
+
+// isWireless reports whether the named interface is a wireless device. This
+// is only detected on Linux, other systems report all interfaces as wired.
+func isWireless(name string) bool {
+	_, err := os.Stat(filepath.Join("/sys/class/net", name, "wireless"))
+	return err == nil
+}
@@ -0,0 +1,40 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/usi-lfkeitel/npmp"
+)
+
+// ErrNoJobSpec is returned by a Mux for a job without a JobSpec.
+var ErrNoJobSpec = errors.New("Job has no JobSpec")
+
+// A Mux is a Runner which dispatches jobs to other Runners according to the
+// Type of their JobSpec.
+type Mux struct {
+	runners map[npmp.DataType]Runner
+}
+
+// NewMux returns an empty Mux.
+func NewMux() *Mux {
+	return &Mux{runners: make(map[npmp.DataType]Runner)}
+}
+
+// Handle registers the Runner for jobs of type t, replacing any existing one.
+func (m *Mux) Handle(t npmp.DataType, r Runner) {
+	m.runners[t] = r
+}
+
+// Run calls the Runner registered for the job's type.
+func (m *Mux) Run(ctx context.Context, job *Job) (npmp.DataMessage, error) {
+	if job.Spec == nil {
+		return npmp.DataMessage{}, ErrNoJobSpec
+	}
+	r, ok := m.runners[job.Spec.Type]
+	if !ok {
+		return npmp.DataMessage{}, fmt.Errorf("No runner for %s jobs", job.Spec.Type)
+	}
+	return r.Run(ctx, job)
+}
@@ -0,0 +1,220 @@
+package npmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+// Framing
+//
+// NPMP messages don't carry their own length so a stream transport such as
+// TCP needs framing. Each frame is a four byte little endian length followed
+// by exactly that many bytes of message data.
+//
+// Since protocol version 2 a frame may carry a sequence number. The high bit
+// of its length is then set and the payload starts with the four byte little
+// endian sequence number, which is covered by the authentication trailer. A
+// client numbers the requests it sends and the server answers each with the
+// sequence number of the request, so that replies to pipelined requests can
+// be told apart. Frames without one are answered without one. A Decoder
+// always accepts both kinds of frame but an Encoder only writes sequence
+// numbers when asked to, as older peers can't read them.
+
+// DefaultMaxFrameSize is the largest frame a Decoder will accept unless its
+// MaxFrameSize is changed.
+const DefaultMaxFrameSize = 1 << 20
+
+// SeqVersion is the lowest protocol version with sequence numbers.
+const SeqVersion = 2
+
+// frameHeaderLength is the length of the frame length prefix.
+const frameHeaderLength = 4
+
+// seqFlag is set in the length of frames carrying a sequence number.
+const seqFlag = 1 << 31
+
+// seqLength is the length of the sequence number of a frame.
+const seqLength = 4
+
+// ErrFrameTooLarge is returned when a frame exceeds the maximum frame size.
+var ErrFrameTooLarge = errors.New("Frame exceeds maximum size")
+
+// A DecodeError is returned by a Decoder when a complete frame was read but
+// the message within it is invalid. The stream is still usable and the
+// next frame may be decoded.
+type DecodeError struct {
+	Frame []byte // Raw frame payload
+	Err   error  // Error returned by Parse
+}
+
+func (e *DecodeError) Error() string { return e.Err.Error() }
+func (e *DecodeError) Unwrap() error { return e.Err }
+
+// An Encoder writes framed messages to an output stream. An Encoder is not
+// safe for concurrent use.
+type Encoder struct {
+	w        io.Writer
+	version  int // Stamped on every message if not negative
+	clientID []byte
+	key      []byte // Signs every frame if set
+	dir      Direction
+}
+
+// NewEncoder returns an Encoder that writes to w.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w, version: -1}
+}
+
+// SetVersion makes the Encoder write v as the protocol version in the header
+// of every message it encodes from then on, which is how a connection uses
+// the version it negotiated.
+func (e *Encoder) SetVersion(v byte) { e.version = int(v) }
+
+// SetKey makes the Encoder add an authentication trailer for the client to
+// every frame it writes from then on, for frames sent in direction dir.
+func (e *Encoder) SetKey(clientID, key []byte, dir Direction) {
+	e.clientID = append([]byte(nil), clientID...)
+	e.key = append([]byte(nil), key...)
+	e.dir = dir
+}
+
+// Encode writes the framed bytes of m to the stream. The frame is written
+// with a single call to Write.
+func (e *Encoder) Encode(m Messanger) error {
+	return e.encode(m, 0, false)
+}
+
+// EncodeSeq writes the framed bytes of m to the stream with the sequence
+// number seq. The peer must support SeqVersion.
+func (e *Encoder) EncodeSeq(m Messanger, seq uint32) error {
+	return e.encode(m, seq, true)
+}
+
+func (e *Encoder) encode(m Messanger, seq uint32, sequenced bool) error {
+	b := m.Bytes()
+	if e.version >= 0 && len(b) >= headerLength {
+		b = append([]byte(nil), b...)
+		Message(b).SetVersion(byte(e.version))
+	}
+	if sequenced {
+		b = append(binary.LittleEndian.AppendUint32(nil, seq), b...)
+	}
+	if e.key != nil {
+		b = Sign(b, e.clientID, e.key, e.dir, time.Now())
+	}
+	if len(b) >= seqFlag {
+		return ErrFrameTooLarge
+	}
+	l := uint32(len(b))
+	if sequenced {
+		l |= seqFlag
+	}
+	frame := make([]byte, frameHeaderLength, frameHeaderLength+len(b))
+	binary.LittleEndian.PutUint32(frame, l)
+	frame = append(frame, b...)
+	_, err := e.w.Write(frame)
+	return err
+}
+
+// A Decoder reads framed messages from an input stream. A Decoder is not safe
+// for concurrent use.
+type Decoder struct {
+	r io.Reader
+
+	// MaxFrameSize is the largest frame the Decoder will read. Larger frames
+	// cause Decode to return ErrFrameTooLarge. The stream can't be recovered
+	// after that error since the frame isn't consumed.
+	MaxFrameSize uint32
+
+	// Auth, if set, verifies the authentication trailer of every frame.
+	// Frames failing verification are returned as a *DecodeError wrapping
+	// an *AuthError, except a bare NAK with NotAuthorized before Auth
+	// accepted a frame, which is how the peer reports that it couldn't
+	// authenticate us. Once the peer signs its frames it has no reason to
+	// send that NAK unsigned.
+	Auth *Authenticator
+
+	seq       uint32
+	sequenced bool
+}
+
+// NewDecoder returns a Decoder that reads from r with a MaxFrameSize of
+// DefaultMaxFrameSize.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: r, MaxFrameSize: DefaultMaxFrameSize}
+}
+
+// Decode reads the next frame and returns it through Parse. io.EOF is
+// returned if the stream ends cleanly between frames, io.ErrUnexpectedEOF if
+// it ends within one. A *DecodeError is returned if the frame doesn't contain
+// a valid message. Each message is read into its own buffer and may be
+// retained by the caller.
+func (d *Decoder) Decode() (Messanger, error) {
+	d.seq, d.sequenced = 0, false
+	b, sequenced, err := d.readFrame()
+	if err != nil {
+		return nil, err
+	}
+	if sequenced {
+		if len(b) < seqLength {
+			return nil, &DecodeError{Frame: b, Err: errors.New("Frame too short for sequence number")}
+		}
+		d.seq, d.sequenced = binary.LittleEndian.Uint32(b), true
+	}
+	msg, clientID := b, []byte(nil)
+	if d.Auth != nil {
+		if msg, clientID, err = d.Auth.Verify(b, time.Now()); err != nil {
+			unsigned := b
+			if sequenced {
+				unsigned = b[seqLength:]
+			}
+			if d.Auth.ClientID() == nil && isNotAuthorized(unsigned) {
+				return Parse(unsigned)
+			}
+			return nil, &DecodeError{Frame: b, Err: err}
+		}
+	}
+	if sequenced {
+		msg = msg[seqLength:]
+	}
+	m, err := Parse(msg)
+	if err != nil {
+		return nil, &DecodeError{Frame: b, Err: err}
+	}
+	if r, ok := m.(*RegisterMessage); ok && clientID != nil && !bytes.Equal(r.ClientID(), clientID) {
+		return nil, &DecodeError{Frame: b, Err: &AuthError{Reason: "client ID mismatch"}}
+	}
+	return m, nil
+}
+
+// Seq returns the sequence number of the frame last read by Decode, false if
+// it had none. The sequence number is also returned for frames which didn't
+// contain a valid message, so that they can be answered.
+func (d *Decoder) Seq() (uint32, bool) { return d.seq, d.sequenced }
+
+// readFrame reads the next frame and returns its payload and whether it
+// starts with a sequence number.
+func (d *Decoder) readFrame() ([]byte, bool, error) {
+	header := make([]byte, frameHeaderLength)
+	if _, err := io.ReadFull(d.r, header); err != nil {
+		return nil, false, err
+	}
+	l := binary.LittleEndian.Uint32(header)
+	sequenced := l&seqFlag != 0
+	l &^= seqFlag
+	if l > d.MaxFrameSize {
+		return nil, false, ErrFrameTooLarge
+	}
+
+	b := make([]byte, l)
+	if _, err := io.ReadFull(d.r, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, false, err
+	}
+	return b, sequenced, nil
+}
@@ -0,0 +1,147 @@
+package npmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestCodec(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	messages := validMessages()
+	go func() {
+		enc := NewEncoder(client)
+		for _, m := range messages {
+			if err := enc.Encode(m); err != nil {
+				t.Errorf("Failed to encode message: %s", err)
+			}
+		}
+		client.Close()
+	}()
+
+	dec := NewDecoder(server)
+	for _, expected := range messages {
+		m, err := dec.Decode()
+		if err != nil {
+			t.Fatalf("Failed to decode message: %s", err)
+		}
+		if !bytes.Equal(m.Bytes(), expected.Bytes()) {
+			t.Fatalf("Incorrect message. Expected %v, got %v", expected.Bytes(), m.Bytes())
+		}
+	}
+	if _, err := dec.Decode(); err != io.EOF {
+		t.Fatalf("Incorrect error. Expected EOF, got %v", err)
+	}
+}
+
+func TestDecoderErrors(t *testing.T) {
+	buf := &bytes.Buffer{}
+	NewEncoder(buf).Encode(NewDataMessage())
+	dec := NewDecoder(buf)
+	dec.MaxFrameSize = 8
+	if _, err := dec.Decode(); err != ErrFrameTooLarge {
+		t.Fatalf("Incorrect error. Expected ErrFrameTooLarge, got %v", err)
+	}
+
+	buf.Reset()
+	NewEncoder(buf).Encode(NewDataMessage())
+	buf.Truncate(buf.Len() - 2)
+	if _, err := NewDecoder(buf).Decode(); err != io.ErrUnexpectedEOF {
+		t.Fatalf("Incorrect error. Expected ErrUnexpectedEOF, got %v", err)
+	}
+
+	// A frame containing a message too short for its type
+	buf.Reset()
+	l := make([]byte, 4)
+	binary.LittleEndian.PutUint32(l, 5)
+	buf.Write(l)
+	buf.Write(NewStartMessage().Bytes()[:5])
+	_, err := NewDecoder(buf).Decode()
+	var derr *DecodeError
+	if !errors.As(err, &derr) {
+		t.Fatalf("Incorrect error. Expected DecodeError, got %v", err)
+	}
+	var lerr *LengthError
+	if !errors.As(err, &lerr) {
+		t.Fatalf("Incorrect error. Expected wrapped LengthError, got %v", derr.Err)
+	}
+}
+
+func TestEncoderVersion(t *testing.T) {
+	buf := &bytes.Buffer{}
+	enc := NewEncoder(buf)
+	settings := NewSettingsMessage()
+	settings.SetProtocolVersion(1)
+	enc.Encode(settings)
+	enc.SetVersion(1)
+	enc.Encode(settings)
+
+	dec := NewDecoder(buf)
+	for _, expected := range []byte{0, 1} {
+		m, err := dec.Decode()
+		if err != nil {
+			t.Fatalf("Failed to decode message: %s", err)
+		}
+		if v := Message(m.Bytes()).Version(); v != expected {
+			t.Fatalf("Incorrect version. Expected %d, got %d", expected, v)
+		}
+	}
+	if settings.Version() != 0 {
+		t.Fatalf("Incorrect version of the original message. Expected 0, got %d", settings.Version())
+	}
+}
+
+func TestEncoderSeq(t *testing.T) {
+	buf := &bytes.Buffer{}
+	enc := NewEncoder(buf)
+	enc.EncodeSeq(NewACKMessage(), 7)
+	enc.Encode(NewACKMessage())
+
+	dec := NewDecoder(buf)
+	for _, expected := range []struct {
+		seq       uint32
+		sequenced bool
+	}{{7, true}, {0, false}} {
+		m, err := dec.Decode()
+		if err != nil {
+			t.Fatalf("Failed to decode message: %s", err)
+		}
+		if !bytes.Equal(m.Bytes(), NewACKMessage().Bytes()) {
+			t.Fatalf("Incorrect message. Expected %v, got %v", NewACKMessage().Bytes(), m.Bytes())
+		}
+		if seq, ok := dec.Seq(); seq != expected.seq || ok != expected.sequenced {
+			t.Fatalf("Incorrect sequence number. Expected %d (%t), got %d (%t)", expected.seq, expected.sequenced, seq, ok)
+		}
+	}
+
+	// The sequence number is covered by the authentication trailer.
+	key := []byte("secret")
+	buf.Reset()
+	enc = NewEncoder(buf)
+	enc.SetKey(testAuthID, key, ClientToServer)
+	enc.EncodeSeq(NewACKMessage(), 7)
+	buf.Bytes()[frameHeaderLength] = 8
+	dec = NewDecoder(buf)
+	dec.Auth = &Authenticator{Keys: KeyMap{hex.EncodeToString(testAuthID): key}}
+	var aerr *AuthError
+	if _, err := dec.Decode(); !errors.As(err, &aerr) {
+		t.Fatalf("Incorrect error. Expected AuthError, got %v", err)
+	}
+	if seq, ok := dec.Seq(); seq != 8 || !ok {
+		t.Fatalf("Incorrect sequence number. Expected 8, got %d (%t)", seq, ok)
+	}
+
+	// A sequenced frame too short for its sequence number
+	buf.Reset()
+	buf.Write([]byte{2, 0, 0, 0x80, 1, 2})
+	var derr *DecodeError
+	if _, err := NewDecoder(buf).Decode(); !errors.As(err, &derr) {
+		t.Fatalf("Incorrect error. Expected DecodeError, got %v", err)
+	}
+}
@@ -0,0 +1,100 @@
+package npmp
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// DefaultHeartbeatMisses is the number of heartbeat intervals without a
+// message after which a peer is considered offline.
+const DefaultHeartbeatMisses = 3
+
+// A HeartbeatMonitor tracks the liveness of a peer which is expected to send
+// a message, a Null message if it has nothing else to say, at least once
+// every heartbeat interval. Seen is called for every message received from
+// the peer and Tick once every interval. The peer is offline once Misses
+// intervals in a row pass without a message, and back online with the next
+// message. A new monitor considers the peer online.
+type HeartbeatMonitor struct {
+	// Misses is the number of intervals a peer may miss before it is
+	// offline. If zero, DefaultHeartbeatMisses is used.
+	Misses int
+
+	// OnChange, if set, is called when the peer goes offline or comes
+	// back online. It must not call the monitor.
+	OnChange func(alive bool)
+
+	mu      sync.Mutex
+	seen    bool
+	missed  int
+	offline bool
+}
+
+// Seen records a message from the peer.
+func (h *HeartbeatMonitor) Seen() {
+	h.mu.Lock()
+	h.seen = true
+	h.missed = 0
+	changed := h.offline
+	h.offline = false
+	h.mu.Unlock()
+	if changed && h.OnChange != nil {
+		h.OnChange(true)
+	}
+}
+
+// Tick ends a heartbeat interval. It returns false if the peer is offline.
+func (h *HeartbeatMonitor) Tick() bool {
+	misses := h.Misses
+	if misses <= 0 {
+		misses = DefaultHeartbeatMisses
+	}
+	h.mu.Lock()
+	if !h.seen {
+		h.missed++
+	}
+	h.seen = false
+	changed := !h.offline && h.missed >= misses
+	if changed {
+		h.offline = true
+	}
+	alive := !h.offline
+	h.mu.Unlock()
+	if changed && h.OnChange != nil {
+		h.OnChange(false)
+	}
+	return alive
+}
+
+// Alive returns false if the peer is offline.
+func (h *HeartbeatMonitor) Alive() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return !h.offline
+}
+
+// Missed returns the number of intervals in a row without a message.
+func (h *HeartbeatMonitor) Missed() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.missed
+}
+
+// Run calls send and Tick every interval until ctx is done or send fails.
+// send is expected to write a Null message to the peer.
+func (h *HeartbeatMonitor) Run(ctx context.Context, interval time.Duration, send func() error) error {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := send(); err != nil {
+				return err
+			}
+			h.Tick()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package npmp
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestHeartbeatMonitor(t *testing.T) {
+	var events []bool
+	h := &HeartbeatMonitor{Misses: 2, OnChange: func(alive bool) { events = append(events, alive) }}
+
+	h.Seen()
+	if !h.Tick() || h.Missed() != 0 {
+		t.Fatalf("Incorrect state after a heartbeat. Expected alive with 0 missed, got %d missed", h.Missed())
+	}
+	if !h.Tick() || h.Missed() != 1 {
+		t.Fatalf("Incorrect state after one miss. Expected alive with 1 missed, got %d missed", h.Missed())
+	}
+	if h.Tick() || h.Alive() {
+		t.Fatal("Incorrect state after two misses. Expected offline")
+	}
+	h.Tick()
+	if len(events) != 1 || events[0] {
+		t.Fatalf("Incorrect events. Expected [false], got %v", events)
+	}
+
+	h.Seen()
+	if !h.Alive() || h.Missed() != 0 {
+		t.Fatal("Incorrect state after a message. Expected alive")
+	}
+	if len(events) != 2 || !events[1] {
+		t.Fatalf("Incorrect events. Expected [false true], got %v", events)
+	}
+}
+
+func TestHeartbeatMonitorRun(t *testing.T) {
+	offline := make(chan struct{})
+	h := &HeartbeatMonitor{Misses: 2, OnChange: func(alive bool) {
+		if !alive {
+			close(offline)
+		}
+	}}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sent := make(chan struct{}, 10)
+	go h.Run(ctx, 10*time.Millisecond, func() error {
+		sent <- struct{}{}
+		return nil
+	})
+	select {
+	case <-offline:
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for the peer to go offline")
+	}
+	if len(sent) < 2 {
+		t.Fatalf("Incorrect heartbeats sent. Expected at least 2, got %d", len(sent))
+	}
+}
@@ -0,0 +1,327 @@
+package iperf
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/usi-lfkeitel/npmp"
+)
+
+// Side is the end of an iperf2 test that wrote a report.
+type Side int
+
+const (
+	ClientReport Side = iota // iperf -c, the sender
+	ServerReport             // iperf -s, the receiver
+)
+
+var (
+	iperf2CSV      = regexp.MustCompile(`^\d{14},`)
+	iperf2Line     = regexp.MustCompile(`^\[\s*(\d+|SUM(?:-\d+)?)\]\s+([\d.]+)\s*-\s*([\d.]+)\s+sec\s+([\d.]+)\s+([KMGT]?)Bytes\s+([\d.]+)\s+([KMGT]?)bits/sec(.*)$`)
+	iperf2Jitter   = regexp.MustCompile(`^\s*([\d.]+)\s+ms\s+(\d+)/\s*(\d+)`)
+	iperf2Retry    = regexp.MustCompile(`^\s*\d+/\d+\s+(\d+)(?:\s*$|\s+\S+/)`)
+	iperf2Sent     = regexp.MustCompile(`^\[\s*\d+\]\s+Sent\s+(\d+)\s+datagrams`)
+	iperf2Started  = regexp.MustCompile(` on (\d{4}-\d\d-\d\d \d\d:\d\d:\d\d) \(UTC\)`)
+	iperf2Units    = map[string]float64{"": 1, "K": 1e3, "M": 1e6, "G": 1e9, "T": 1e12}
+	iperf2ByteUnit = map[string]float64{"": 1, "K": 1 << 10, "M": 1 << 20, "G": 1 << 30, "T": 1 << 40}
+)
+
+// iperf2Stat is one line of results of an iperf2 report.
+type iperf2Stat struct {
+	id          string // Stream ID, "SUM" for the sum of parallel streams
+	start, end  float64
+	bytes       uint64
+	bps         float64
+	retransmits uint32
+	jitter      float64 // Milliseconds
+	lost        uint64
+	packets     uint64
+	peer        bool // Part of the server report received by a UDP client
+}
+
+// iperf2Report collects the lines of a report before they're summarized.
+type iperf2Report struct {
+	stats   []iperf2Stat
+	udp     bool
+	sent    uint64 // Datagrams sent by a UDP client
+	started time.Time
+}
+
+// ParseIperf2 reads an iperf2 report in either the CSV format of -y C or the
+// text format, including the enhanced text of -e. side tells whether the
+// report was written by the client or the server since CSV reports don't say.
+//
+// Client reports fill in Sent, and Received too if the report includes the
+// server report of a UDP test. Server reports fill in Received. Parallel
+// streams are summarized from their SUM lines. Dual tests (-d and -r) aren't
+// supported.
+func ParseIperf2(r io.Reader, side Side) (*npmp.IperfResult, error) {
+	var rep iperf2Report
+	if err := rep.read(r, side); err != nil {
+		return nil, err
+	}
+
+	var local, peer []iperf2Stat
+	for _, s := range rep.stats {
+		if s.peer {
+			peer = append(peer, s)
+		} else {
+			local = append(local, s)
+		}
+	}
+	if len(local) == 0 {
+		return nil, errors.New("iperf2: report has no results")
+	}
+
+	res := &npmp.IperfResult{
+		Transport: npmp.TCP,
+		Start:     rep.started,
+		Parallel:  uint8(streams(local)),
+	}
+	if rep.udp {
+		res.Transport = npmp.UDP
+	}
+	intervals, sum := summarize(local)
+	for _, s := range intervals {
+		res.Intervals = append(res.Intervals, npmp.IperfInterval{
+			Start:         seconds(s.start),
+			End:           seconds(s.end),
+			Bytes:         s.bytes,
+			BitsPerSecond: s.bps,
+			Retransmits:   s.retransmits,
+		})
+	}
+	res.Duration = seconds(sum.end)
+
+	if side == ServerReport {
+		res.Received = sum.summary()
+		return res, nil
+	}
+	res.Sent = sum.summary()
+	res.Sent.Packets = rep.sent
+	if len(peer) > 0 {
+		_, psum := summarize(peer)
+		res.Received = psum.summary()
+	}
+	return res, nil
+}
+
+// Iperf2Message parses an iperf2 report and returns it as an Iperf2 Data
+// message for the given job.
+func Iperf2Message(jobID []byte, side Side, r io.Reader) (npmp.DataMessage, error) {
+	res, err := ParseIperf2(r, side)
+	if err != nil {
+		return npmp.DataMessage{}, err
+	}
+	return message(jobID, npmp.Iperf2, res)
+}
+
+func (rep *iperf2Report) read(r io.Reader, side Side) error {
+	sc := bufio.NewScanner(r)
+	peer := false
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if iperf2CSV.MatchString(line) {
+			s, err := parseIperf2CSV(line, side)
+			if err != nil {
+				return fmt.Errorf("iperf2: line %d: %w", n, err)
+			}
+			rep.udp = rep.udp || s.packets > 0
+			rep.stats = append(rep.stats, s)
+			continue
+		}
+
+		switch {
+		case strings.Contains(line, "UDP port"):
+			rep.udp = true
+		case strings.HasSuffix(line, "Server Report:"):
+			peer = true
+		}
+		if m := iperf2Started.FindStringSubmatch(line); m != nil && rep.started.IsZero() {
+			rep.started, _ = time.Parse("2006-01-02 15:04:05", m[1])
+		}
+		if m := iperf2Sent.FindStringSubmatch(line); m != nil {
+			v, _ := strconv.ParseUint(m[1], 10, 64)
+			rep.sent += v
+		}
+		if m := iperf2Line.FindStringSubmatch(line); m != nil {
+			s, err := parseIperf2Text(m, rep.udp)
+			if err != nil {
+				return fmt.Errorf("iperf2: line %d: %w", n, err)
+			}
+			s.peer = peer
+			rep.udp = rep.udp || s.packets > 0
+			rep.stats = append(rep.stats, s)
+		}
+	}
+	return sc.Err()
+}
+
+// parseIperf2CSV parses a line of -y C output:
+//
+//	timestamp,src,sport,dst,dport,id,interval,bytes,bps[,jitter,lost,total,lost%,ooo]
+//
+// The UDP fields are only present in lines of the server report.
+func parseIperf2CSV(line string, side Side) (iperf2Stat, error) {
+	f := strings.Split(line, ",")
+	if len(f) != 9 && len(f) < 14 {
+		return iperf2Stat{}, fmt.Errorf("%d CSV fields", len(f))
+	}
+	s := iperf2Stat{id: f[5]}
+	if s.id == "-1" {
+		s.id = "SUM"
+	}
+	start, end, ok := strings.Cut(f[6], "-")
+	if !ok {
+		return iperf2Stat{}, fmt.Errorf("invalid interval %q", f[6])
+	}
+	var err error
+	if s.start, err = strconv.ParseFloat(start, 64); err != nil {
+		return iperf2Stat{}, err
+	}
+	if s.end, err = strconv.ParseFloat(end, 64); err != nil {
+		return iperf2Stat{}, err
+	}
+	if s.bytes, err = strconv.ParseUint(f[7], 10, 64); err != nil {
+		return iperf2Stat{}, err
+	}
+	if s.bps, err = strconv.ParseFloat(f[8], 64); err != nil {
+		return iperf2Stat{}, err
+	}
+	if len(f) >= 14 {
+		if s.jitter, err = strconv.ParseFloat(f[9], 64); err != nil {
+			return iperf2Stat{}, err
+		}
+		if s.lost, err = strconv.ParseUint(f[10], 10, 64); err != nil {
+			return iperf2Stat{}, err
+		}
+		if s.packets, err = strconv.ParseUint(f[11], 10, 64); err != nil {
+			return iperf2Stat{}, err
+		}
+		s.peer = side == ClientReport
+	}
+	return s, nil
+}
+
+// parseIperf2Text converts the submatches of iperf2Line.
+func parseIperf2Text(m []string, udp bool) (iperf2Stat, error) {
+	s := iperf2Stat{id: m[1]}
+	if strings.HasPrefix(s.id, "SUM") {
+		s.id = "SUM"
+	}
+	var err error
+	if s.start, err = strconv.ParseFloat(m[2], 64); err != nil {
+		return iperf2Stat{}, err
+	}
+	if s.end, err = strconv.ParseFloat(m[3], 64); err != nil {
+		return iperf2Stat{}, err
+	}
+	b, err := strconv.ParseFloat(m[4], 64)
+	if err != nil {
+		return iperf2Stat{}, err
+	}
+	s.bytes = uint64(b*iperf2ByteUnit[m[5]] + 0.5)
+	if s.bps, err = strconv.ParseFloat(m[6], 64); err != nil {
+		return iperf2Stat{}, err
+	}
+	s.bps *= iperf2Units[m[7]]
+
+	rest := m[8]
+	if j := iperf2Jitter.FindStringSubmatch(rest); j != nil {
+		s.jitter, _ = strconv.ParseFloat(j[1], 64)
+		s.lost, _ = strconv.ParseUint(j[2], 10, 64)
+		s.packets, _ = strconv.ParseUint(j[3], 10, 64)
+	} else if r := iperf2Retry.FindStringSubmatch(rest); r != nil && !udp {
+		v, _ := strconv.ParseUint(r[1], 10, 32)
+		s.retransmits = uint32(v)
+	}
+	return s, nil
+}
+
+func (s *iperf2Stat) summary() npmp.IperfSummary {
+	return npmp.IperfSummary{
+		Bytes:         s.bytes,
+		BitsPerSecond: s.bps,
+		Retransmits:   s.retransmits,
+		Jitter:        seconds(s.jitter / 1000),
+		LostPackets:   s.lost,
+		Packets:       s.packets,
+	}
+}
+
+// add accumulates the stats of another stream over the same interval.
+func (s *iperf2Stat) add(o iperf2Stat) {
+	s.bytes += o.bytes
+	s.bps += o.bps
+	s.retransmits += o.retransmits
+	s.lost += o.lost
+	s.packets += o.packets
+	s.jitter = max(s.jitter, o.jitter)
+	s.end = max(s.end, o.end)
+}
+
+// streams counts the streams that aren't sums.
+func streams(stats []iperf2Stat) int {
+	ids := make(map[string]bool)
+	for _, s := range stats {
+		if s.id != "SUM" {
+			ids[s.id] = true
+		}
+	}
+	return max(len(ids), 1)
+}
+
+// summarize splits the lines into intervals and the summary of the whole
+// test. Each stream ends with a line starting at 0, unless it only has that
+// line. The SUM lines are used if there are any, otherwise the streams are
+// added together.
+func summarize(stats []iperf2Stat) (intervals []iperf2Stat, sum iperf2Stat) {
+	hasSum := false
+	for _, s := range stats {
+		hasSum = hasSum || s.id == "SUM"
+	}
+
+	seen := make(map[string]bool)
+	index := make(map[[2]float64]int)
+	for _, s := range stats {
+		if hasSum != (s.id == "SUM") {
+			continue
+		}
+		if s.start == 0 && seen[s.id] {
+			sum.add(s)
+			continue
+		}
+		seen[s.id] = true
+		k := [2]float64{s.start, s.end}
+		if i, ok := index[k]; ok {
+			intervals[i].add(s)
+			continue
+		}
+		index[k] = len(intervals)
+		intervals = append(intervals, s)
+	}
+
+	// A stream with a single line reported only its summary.
+	if sum.end == 0 && allStartAtZero(intervals) {
+		for _, s := range intervals {
+			sum.add(s)
+		}
+		return nil, sum
+	}
+	return intervals, sum
+}
+
+func allStartAtZero(stats []iperf2Stat) bool {
+	for _, s := range stats {
+		if s.start != 0 {
+			return false
+		}
+	}
+	return true
+}
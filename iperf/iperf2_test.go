@@ -0,0 +1,158 @@
+package iperf
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/usi-lfkeitel/npmp"
+)
+
+func parseIperf2Fixture(t *testing.T, name string, side Side) *npmp.IperfResult {
+	f, err := os.Open(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatalf("Failed to open fixture: %s", err)
+	}
+	defer f.Close()
+	res, err := ParseIperf2(f, side)
+	if err != nil {
+		t.Fatalf("Failed to parse %s: %s", name, err)
+	}
+	return res
+}
+
+func TestParseIperf2TCPCSV(t *testing.T) {
+	res := parseIperf2Fixture(t, "iperf2_tcp_client.csv", ClientReport)
+	if res.Transport != npmp.TCP || res.Parallel != 2 {
+		t.Fatalf("Incorrect test parameters: %+v", res)
+	}
+	if res.Sent.Bytes != 234618880 || res.Sent.BitsPerSecond != 938195272 {
+		t.Fatalf("Incorrect sender summary: %+v", res.Sent)
+	}
+	if res.Received != (npmp.IperfSummary{}) {
+		t.Fatalf("Incorrect receiver summary. Expected none, got %+v", res.Received)
+	}
+	if len(res.Intervals) != 2 || res.Intervals[1].Bytes != 117833728 || res.Intervals[1].Start != time.Second {
+		t.Fatalf("Incorrect intervals: %+v", res.Intervals)
+	}
+	if res.Duration != 2*time.Second {
+		t.Fatalf("Incorrect duration. Expected 2s, got %s", res.Duration)
+	}
+}
+
+func TestParseIperf2UDPCSV(t *testing.T) {
+	res := parseIperf2Fixture(t, "iperf2_udp_client.csv", ClientReport)
+	if res.Transport != npmp.UDP || res.Parallel != 1 {
+		t.Fatalf("Incorrect test parameters: %+v", res)
+	}
+	if res.Sent.Bytes != 263130 || len(res.Intervals) != 2 {
+		t.Fatalf("Incorrect sender results: %+v %+v", res.Sent, res.Intervals)
+	}
+	if res.Received.Bytes != 260190 || res.Received.Jitter != 41*time.Microsecond ||
+		res.Received.LostPackets != 2 || res.Received.Packets != 179 {
+		t.Fatalf("Incorrect receiver summary: %+v", res.Received)
+	}
+
+	// The same line read on the server is the server's own result.
+	lines, _ := os.ReadFile(filepath.Join("testdata", "iperf2_udp_client.csv"))
+	last := strings.Split(strings.TrimSpace(string(lines)), "\n")[3]
+	res, err := ParseIperf2(strings.NewReader(last), ServerReport)
+	if err != nil {
+		t.Fatalf("Failed to parse server line: %s", err)
+	}
+	if res.Transport != npmp.UDP || res.Received.Packets != 179 || res.Sent.Bytes != 0 {
+		t.Fatalf("Incorrect server result: %+v", res)
+	}
+}
+
+func TestParseIperf2TCPEnhanced(t *testing.T) {
+	res := parseIperf2Fixture(t, "iperf2_tcp_client_enhanced.txt", ClientReport)
+	if res.Transport != npmp.TCP || res.Parallel != 2 {
+		t.Fatalf("Incorrect test parameters: %+v", res)
+	}
+	if !res.Start.Equal(time.Date(2026, 1, 2, 2, 0, 0, 0, time.UTC)) {
+		t.Fatalf("Incorrect start. Expected 2026-01-02 02:00:00 UTC, got %s", res.Start)
+	}
+	if res.Sent.Bytes != 224<<20 || res.Sent.BitsPerSecond != 938e6 || res.Sent.Retransmits != 15 {
+		t.Fatalf("Incorrect sender summary: %+v", res.Sent)
+	}
+	if len(res.Intervals) != 2 || res.Intervals[0].Retransmits != 12 || res.Intervals[1].BitsPerSecond != 943e6 {
+		t.Fatalf("Incorrect intervals: %+v", res.Intervals)
+	}
+	if res.Duration != 2000500*time.Microsecond {
+		t.Fatalf("Incorrect duration. Expected 2.0005s, got %s", res.Duration)
+	}
+}
+
+func TestParseIperf2UDPEnhanced(t *testing.T) {
+	res := parseIperf2Fixture(t, "iperf2_udp_client_enhanced.txt", ClientReport)
+	if res.Transport != npmp.UDP {
+		t.Fatalf("Incorrect transport. Expected UDP, got %s", res.Transport)
+	}
+	if res.Sent.Bytes != 257<<10 || res.Sent.Packets != 180 || res.Sent.Retransmits != 0 {
+		t.Fatalf("Incorrect sender summary: %+v", res.Sent)
+	}
+	if res.Received.Bytes != 254<<10 || res.Received.Jitter != 41*time.Microsecond ||
+		res.Received.LostPackets != 2 || res.Received.Packets != 179 {
+		t.Fatalf("Incorrect receiver summary: %+v", res.Received)
+	}
+	if len(res.Intervals) != 2 {
+		t.Fatalf("Incorrect intervals. Expected 2, got %d", len(res.Intervals))
+	}
+}
+
+func TestParseIperf2Server(t *testing.T) {
+	res := parseIperf2Fixture(t, "iperf2_tcp_server_enhanced.txt", ServerReport)
+	if res.Transport != npmp.TCP || res.Parallel != 1 {
+		t.Fatalf("Incorrect test parameters: %+v", res)
+	}
+	if res.Sent.Bytes != 0 || res.Received.Bytes != 224<<20 || res.Received.BitsPerSecond != 939e6 {
+		t.Fatalf("Incorrect summaries: %+v %+v", res.Sent, res.Received)
+	}
+	if len(res.Intervals) != 2 || res.Intervals[0].Bytes != 112<<20 {
+		t.Fatalf("Incorrect intervals: %+v", res.Intervals)
+	}
+}
+
+func TestParseIperf2SummaryOnly(t *testing.T) {
+	report := "[  3]  0.0-10.0 sec  1.10 GBytes   941 Mbits/sec\n"
+	res, err := ParseIperf2(strings.NewReader(report), ClientReport)
+	if err != nil {
+		t.Fatalf("Failed to parse report: %s", err)
+	}
+	if len(res.Intervals) != 0 || res.Duration != 10*time.Second || res.Sent.BitsPerSecond != 941e6 {
+		t.Fatalf("Incorrect result: %+v", res)
+	}
+
+	if _, err := ParseIperf2(strings.NewReader("connect failed: Connection refused\n"), ClientReport); err == nil {
+		t.Fatal("Expected error parsing report without results")
+	}
+	if _, err := ParseIperf2(strings.NewReader("20260102020000,a,b,c,d\n"), ClientReport); err == nil {
+		t.Fatal("Expected error parsing truncated CSV line")
+	}
+}
+
+func TestIperf2Message(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "iperf2_udp_client_enhanced.txt"))
+	if err != nil {
+		t.Fatalf("Failed to open fixture: %s", err)
+	}
+	defer f.Close()
+
+	m, err := Iperf2Message([]byte{1, 2, 3, 4}, ClientReport, f)
+	if err != nil {
+		t.Fatalf("Failed to create message: %s", err)
+	}
+	if m.Type() != npmp.Iperf2 {
+		t.Fatalf("Incorrect data type. Expected Iperf2, got %s", m.Type())
+	}
+	res, err := m.IperfResult()
+	if err != nil {
+		t.Fatalf("Failed to decode result: %s", err)
+	}
+	if res.Received.Packets != 179 {
+		t.Fatalf("Incorrect packets. Expected 179, got %d", res.Received.Packets)
+	}
+}
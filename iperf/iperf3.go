@@ -0,0 +1,179 @@
+// Package iperf converts the reports of the iperf2 and iperf3 tools into
+// npmp.IperfResult values and Data messages.
+package iperf
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/usi-lfkeitel/npmp"
+)
+
+// An Iperf3Error is returned when an iperf3 report contains an error instead
+// of results.
+type Iperf3Error struct {
+	Message string
+}
+
+func (e *Iperf3Error) Error() string { return "iperf3: " + e.Message }
+
+// iperf3Report is the subset of the iperf3 -J output used to build a result.
+type iperf3Report struct {
+	Start struct {
+		Timestamp struct {
+			TimeSecs int64 `json:"timesecs"`
+		} `json:"timestamp"`
+		TestStart struct {
+			Protocol   string  `json:"protocol"`
+			NumStreams int     `json:"num_streams"`
+			Duration   float64 `json:"duration"`
+			Reverse    int     `json:"reverse"`
+			Bidir      int     `json:"bidir"`
+		} `json:"test_start"`
+	} `json:"start"`
+	Intervals []struct {
+		Sum             *iperf3Sum `json:"sum"`
+		SumBidirReverse *iperf3Sum `json:"sum_bidir_reverse"`
+	} `json:"intervals"`
+	End struct {
+		Sum                     *iperf3Sum `json:"sum"`
+		SumSent                 *iperf3Sum `json:"sum_sent"`
+		SumReceived             *iperf3Sum `json:"sum_received"`
+		SumSentBidirReverse     *iperf3Sum `json:"sum_sent_bidir_reverse"`
+		SumReceivedBidirReverse *iperf3Sum `json:"sum_received_bidir_reverse"`
+	} `json:"end"`
+	Error string `json:"error"`
+}
+
+type iperf3Sum struct {
+	Start         float64 `json:"start"`
+	End           float64 `json:"end"`
+	Seconds       float64 `json:"seconds"`
+	Bytes         uint64  `json:"bytes"`
+	BitsPerSecond float64 `json:"bits_per_second"`
+	Retransmits   uint32  `json:"retransmits"`
+	JitterMs      float64 `json:"jitter_ms"`
+	LostPackets   uint64  `json:"lost_packets"`
+	Packets       uint64  `json:"packets"`
+}
+
+func (s *iperf3Sum) summary() npmp.IperfSummary {
+	if s == nil {
+		return npmp.IperfSummary{}
+	}
+	return npmp.IperfSummary{
+		Bytes:         s.Bytes,
+		BitsPerSecond: s.BitsPerSecond,
+		Retransmits:   s.Retransmits,
+		Jitter:        seconds(s.JitterMs / 1000),
+		LostPackets:   s.LostPackets,
+		Packets:       s.Packets,
+	}
+}
+
+func (s *iperf3Sum) interval(reverse bool) npmp.IperfInterval {
+	return npmp.IperfInterval{
+		Start:         seconds(s.Start),
+		End:           seconds(s.End),
+		Bytes:         s.Bytes,
+		BitsPerSecond: s.BitsPerSecond,
+		Retransmits:   s.Retransmits,
+		Reverse:       reverse,
+	}
+}
+
+// ParseIperf3 reads the JSON report written by iperf3 -J on the client. TCP
+// and UDP tests are supported in normal, reverse (-R) and bidirectional
+// (--bidir) modes. Reports from iperf3 versions without separate UDP sender
+// and receiver sums are also accepted.
+func ParseIperf3(r io.Reader) (*npmp.IperfResult, error) {
+	var rep iperf3Report
+	if err := json.NewDecoder(r).Decode(&rep); err != nil {
+		return nil, err
+	}
+	if rep.Error != "" {
+		return nil, &Iperf3Error{Message: rep.Error}
+	}
+
+	ts := rep.Start.TestStart
+	res := &npmp.IperfResult{
+		Reverse:       ts.Reverse != 0,
+		Bidirectional: ts.Bidir != 0,
+		Parallel:      uint8(ts.NumStreams),
+		Duration:      seconds(ts.Duration),
+	}
+	if rep.Start.Timestamp.TimeSecs != 0 {
+		res.Start = time.Unix(rep.Start.Timestamp.TimeSecs, 0)
+	}
+	switch strings.ToUpper(ts.Protocol) {
+	case "TCP":
+		res.Transport = npmp.TCP
+	case "UDP":
+		res.Transport = npmp.UDP
+	default:
+		return nil, fmt.Errorf("iperf3: unknown protocol %q", ts.Protocol)
+	}
+
+	end := rep.End
+	switch {
+	case end.SumSent != nil || end.SumReceived != nil:
+		res.Sent = end.SumSent.summary()
+		res.Received = end.SumReceived.summary()
+	case end.Sum != nil:
+		// Older UDP reports have a single sum, the packet statistics are
+		// those of the receiver.
+		res.Sent = npmp.IperfSummary{
+			Bytes:         end.Sum.Bytes,
+			BitsPerSecond: end.Sum.BitsPerSecond,
+			Packets:       end.Sum.Packets,
+		}
+		res.Received = end.Sum.summary()
+	default:
+		return nil, errors.New("iperf3: report has no end summary")
+	}
+	if res.Bidirectional {
+		res.ReverseSent = end.SumSentBidirReverse.summary()
+		res.ReverseReceived = end.SumReceivedBidirReverse.summary()
+	}
+	if end.SumSent != nil && end.SumSent.End > 0 {
+		res.Duration = seconds(end.SumSent.End)
+	}
+
+	for _, i := range rep.Intervals {
+		if i.Sum != nil {
+			res.Intervals = append(res.Intervals, i.Sum.interval(res.Reverse))
+		}
+		if i.SumBidirReverse != nil {
+			res.Intervals = append(res.Intervals, i.SumBidirReverse.interval(true))
+		}
+	}
+	return res, nil
+}
+
+// Iperf3Message parses an iperf3 JSON report and returns it as an Iperf3 Data
+// message for the given job.
+func Iperf3Message(jobID []byte, r io.Reader) (npmp.DataMessage, error) {
+	res, err := ParseIperf3(r)
+	if err != nil {
+		return npmp.DataMessage{}, err
+	}
+	return message(jobID, npmp.Iperf3, res)
+}
+
+func message(jobID []byte, t npmp.DataType, res *npmp.IperfResult) (npmp.DataMessage, error) {
+	m := npmp.NewDataMessage()
+	m.SetJobID(jobID)
+	if err := m.SetIperfResult(t, res); err != nil {
+		return npmp.DataMessage{}, err
+	}
+	return m, nil
+}
+
+// seconds converts fractional seconds to a Duration.
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
@@ -0,0 +1,131 @@
+package iperf
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/usi-lfkeitel/npmp"
+)
+
+func parseFixture(t *testing.T, name string) (*npmp.IperfResult, error) {
+	f, err := os.Open(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatalf("Failed to open fixture: %s", err)
+	}
+	defer f.Close()
+	return ParseIperf3(f)
+}
+
+func TestParseIperf3TCP(t *testing.T) {
+	res, err := parseFixture(t, "iperf3_tcp.json")
+	if err != nil {
+		t.Fatalf("Failed to parse report: %s", err)
+	}
+	if res.Transport != npmp.TCP || res.Reverse || res.Bidirectional || res.Parallel != 1 {
+		t.Fatalf("Incorrect test parameters: %+v", res)
+	}
+	if !res.Start.Equal(time.Unix(1767319200, 0)) {
+		t.Fatalf("Incorrect start. Expected %s, got %s", time.Unix(1767319200, 0), res.Start)
+	}
+	if res.Sent.Bytes != 352583680 || res.Sent.Retransmits != 15 {
+		t.Fatalf("Incorrect sender summary: %+v", res.Sent)
+	}
+	if res.Received.Bytes != 351536128 || res.Received.BitsPerSecond != 936396227.4 {
+		t.Fatalf("Incorrect receiver summary: %+v", res.Received)
+	}
+	if len(res.Intervals) != 3 || res.Intervals[0].Retransmits != 12 || res.Intervals[2].End != 3000102*time.Microsecond {
+		t.Fatalf("Incorrect intervals: %+v", res.Intervals)
+	}
+}
+
+func TestParseIperf3UDP(t *testing.T) {
+	res, err := parseFixture(t, "iperf3_udp.json")
+	if err != nil {
+		t.Fatalf("Failed to parse report: %s", err)
+	}
+	if res.Transport != npmp.UDP {
+		t.Fatalf("Incorrect transport. Expected UDP, got %s", res.Transport)
+	}
+	if res.Received.Jitter != 41*time.Microsecond || res.Received.LostPackets != 2 || res.Received.Packets != 179 {
+		t.Fatalf("Incorrect receiver summary: %+v", res.Received)
+	}
+	if res.Sent.Bytes != 261340 || res.Received.Bytes != 258420 {
+		t.Fatalf("Incorrect bytes. Expected 261340 sent and 258420 received, got %d and %d", res.Sent.Bytes, res.Received.Bytes)
+	}
+
+	res, err = parseFixture(t, "iperf3_udp_legacy.json")
+	if err != nil {
+		t.Fatalf("Failed to parse legacy report: %s", err)
+	}
+	if res.Received.Jitter != 118*time.Microsecond || res.Received.LostPercent() != 6.25 || res.Sent.Packets != 16 {
+		t.Fatalf("Incorrect legacy summary: %+v %+v", res.Sent, res.Received)
+	}
+}
+
+func TestParseIperf3Reverse(t *testing.T) {
+	res, err := parseFixture(t, "iperf3_reverse.json")
+	if err != nil {
+		t.Fatalf("Failed to parse report: %s", err)
+	}
+	if !res.Reverse || res.Parallel != 2 {
+		t.Fatalf("Incorrect test parameters: %+v", res)
+	}
+	if res.Sent.Retransmits != 40 || res.Received.Bytes != 234487808 {
+		t.Fatalf("Incorrect summaries: %+v %+v", res.Sent, res.Received)
+	}
+	for _, i := range res.Intervals {
+		if !i.Reverse {
+			t.Fatalf("Interval not marked reverse: %+v", i)
+		}
+	}
+}
+
+func TestParseIperf3Bidir(t *testing.T) {
+	res, err := parseFixture(t, "iperf3_bidir.json")
+	if err != nil {
+		t.Fatalf("Failed to parse report: %s", err)
+	}
+	if !res.Bidirectional {
+		t.Fatal("Result not marked bidirectional")
+	}
+	if res.Sent.Bytes != 112590848 || res.ReverseSent.Bytes != 105512960 || res.ReverseReceived.Bytes != 104857600 {
+		t.Fatalf("Incorrect summaries: %+v %+v %+v", res.Sent, res.ReverseSent, res.ReverseReceived)
+	}
+	if len(res.Intervals) != 2 || res.Intervals[0].Reverse || !res.Intervals[1].Reverse {
+		t.Fatalf("Incorrect intervals: %+v", res.Intervals)
+	}
+}
+
+func TestParseIperf3Error(t *testing.T) {
+	_, err := parseFixture(t, "iperf3_error.json")
+	var ierr *Iperf3Error
+	if !errors.As(err, &ierr) || ierr.Message != "unable to connect to server: Connection refused" {
+		t.Fatalf("Incorrect error. Expected Iperf3Error, got %v", err)
+	}
+}
+
+func TestIperf3Message(t *testing.T) {
+	b, err := os.ReadFile(filepath.Join("testdata", "iperf3_tcp.json"))
+	if err != nil {
+		t.Fatalf("Failed to read fixture: %s", err)
+	}
+	jobID := []byte{1, 2, 3, 4}
+	m, err := Iperf3Message(jobID, bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("Failed to build message: %s", err)
+	}
+	if m.Type() != npmp.Iperf3 || !bytes.Equal(m.JobID(), jobID) {
+		t.Fatalf("Incorrect message. Expected Iperf3 for job %v, got %s for job %v", jobID, m.Type(), m.JobID())
+	}
+	res, err := m.IperfResult()
+	if err != nil {
+		t.Fatalf("Failed to decode result: %s", err)
+	}
+	if res.Sent.Bytes != 352583680 {
+		t.Fatalf("Incorrect sent bytes. Expected 352583680, got %d", res.Sent.Bytes)
+	}
+}
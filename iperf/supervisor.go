@@ -0,0 +1,237 @@
+package iperf
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"net"
+	"os/exec"
+	"strconv"
+	"sync"
+
+	"github.com/usi-lfkeitel/npmp"
+	"github.com/usi-lfkeitel/npmp/server"
+	"github.com/usi-lfkeitel/npmp/throughput"
+)
+
+// ErrSupervisorClosed is returned by StartLease after Close.
+var ErrSupervisorClosed = errors.New("Supervisor closed")
+
+// A Supervisor is a server.LeaseHandler which runs an iperf server on each
+// leased port. The server is started when the port is leased and killed when
+// the lease is released, on the job's End, or when its deadline passes.
+type Supervisor struct {
+	// Command is the iperf3 executable, run as "Command -s -p <port> -1".
+	// If empty, the built in throughput server is run instead.
+	Command string
+
+	// Args are extra arguments given to Command, such as "-B <address>".
+	Args []string
+
+	// ListenAddress is the host the built in server listens on. If empty,
+	// it listens on all addresses.
+	ListenAddress string
+
+	// Address is sent to clients as the IperfServerAddress. If empty, the
+	// session uses the address the client connected to.
+	Address string
+
+	// Version is sent to clients as the IperfServerVersion. If zero, 3 is
+	// sent when Command is set and nothing is sent otherwise.
+	Version byte
+
+	// ErrorLog specifies an optional logger for errors. If nil, the log
+	// package's standard logger is used.
+	ErrorLog *log.Logger
+
+	mu      sync.Mutex
+	running map[uint16]*instance
+	closed  bool
+}
+
+// An instance is an iperf server run for a lease.
+type instance struct {
+	lease server.Lease
+	cmd   *exec.Cmd
+	srv   *throughput.Server
+	done  chan struct{} // Closed once the server exited
+}
+
+var _ server.LeaseHandler = (*Supervisor)(nil)
+
+// StartLease starts a server on the leased port and adds its address and
+// version to m. A job renewing its lease keeps its running server.
+func (s *Supervisor) StartLease(l server.Lease, m *npmp.SettingsMessage) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrSupervisorClosed
+	}
+	old := s.running[l.Port]
+	s.mu.Unlock()
+
+	if old == nil || !sameJob(old.lease, l) {
+		if old != nil {
+			s.stop(old)
+		}
+		in, err := s.start(l)
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		if s.running == nil {
+			s.running = make(map[uint16]*instance)
+		}
+		closed := s.closed
+		if !closed {
+			s.running[l.Port] = in
+		}
+		s.mu.Unlock()
+		go s.reap(in)
+		if closed {
+			s.stop(in)
+			return ErrSupervisorClosed
+		}
+	}
+
+	if s.Address != "" {
+		if err := m.SetIperfServerAddress(s.Address); err != nil {
+			return err
+		}
+	}
+	if v := s.version(); v != 0 {
+		m.SetIperfServerVersion(v)
+	}
+	return nil
+}
+
+// EndLease kills the server of the lease.
+func (s *Supervisor) EndLease(l server.Lease) {
+	s.mu.Lock()
+	in := s.running[l.Port]
+	if in == nil || !sameJob(in.lease, l) {
+		in = nil
+	}
+	s.mu.Unlock()
+	if in != nil {
+		s.stop(in)
+	}
+}
+
+// Running returns the ports with a running server in no particular order.
+func (s *Supervisor) Running() []uint16 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ports := make([]uint16, 0, len(s.running))
+	for port := range s.running {
+		ports = append(ports, port)
+	}
+	return ports
+}
+
+// Close kills every running server. Leases started afterwards are refused.
+func (s *Supervisor) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	running := make([]*instance, 0, len(s.running))
+	for _, in := range s.running {
+		running = append(running, in)
+	}
+	s.mu.Unlock()
+	for _, in := range running {
+		s.stop(in)
+	}
+	return nil
+}
+
+func (s *Supervisor) version() byte {
+	if s.Version != 0 || s.Command == "" {
+		return s.Version
+	}
+	return 3
+}
+
+func (s *Supervisor) start(l server.Lease) (*instance, error) {
+	in := &instance{lease: l, done: make(chan struct{})}
+	port := strconv.Itoa(int(l.Port))
+	if s.Command != "" {
+		args := append([]string{"-s", "-p", port, "-1"}, s.Args...)
+		in.cmd = exec.Command(s.Command, args...)
+		if err := in.cmd.Start(); err != nil {
+			return nil, err
+		}
+		return in, nil
+	}
+
+	addr := net.JoinHostPort(s.ListenAddress, port)
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	// The lease deadline is enforced by EndLease, which follows renewals.
+	in.srv = &throughput.Server{ErrorLog: s.ErrorLog}
+	go func() {
+		in.srv.Serve(ln, pc)
+		close(in.done)
+	}()
+	return in, nil
+}
+
+// reap waits for the server to exit and forgets it.
+func (s *Supervisor) reap(in *instance) {
+	if in.cmd != nil {
+		if err := in.cmd.Wait(); err != nil && !killed(err) {
+			s.logf("npmp: iperf server on port %d: %s", in.lease.Port, err)
+		}
+		close(in.done)
+	} else {
+		<-in.done
+	}
+	s.mu.Lock()
+	if s.running[in.lease.Port] == in {
+		delete(s.running, in.lease.Port)
+	}
+	s.mu.Unlock()
+}
+
+// stop kills the server and waits for it to be reaped.
+func (s *Supervisor) stop(in *instance) {
+	s.kill(in)
+	<-in.done
+	s.mu.Lock()
+	if s.running[in.lease.Port] == in {
+		delete(s.running, in.lease.Port)
+	}
+	s.mu.Unlock()
+}
+
+func (s *Supervisor) kill(in *instance) {
+	if in.cmd != nil {
+		in.cmd.Process.Kill()
+	} else {
+		in.srv.Close()
+	}
+}
+
+func (s *Supervisor) logf(format string, args ...interface{}) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+func sameJob(a, b server.Lease) bool {
+	return bytes.Equal(a.ClientID, b.ClientID) && bytes.Equal(a.JobID, b.JobID)
+}
+
+// killed reports whether a process exited because it was killed.
+func killed(err error) bool {
+	var ee *exec.ExitError
+	return errors.As(err, &ee) && !ee.Exited()
+}
@@ -0,0 +1,194 @@
+package iperf
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/usi-lfkeitel/npmp"
+	"github.com/usi-lfkeitel/npmp/server"
+	"github.com/usi-lfkeitel/npmp/throughput"
+)
+
+// fakeIperf writes a script which records its arguments and waits to be
+// killed.
+func fakeIperf(t *testing.T) (cmd, argsFile string) {
+	dir := t.TempDir()
+	argsFile = filepath.Join(dir, "args")
+	cmd = filepath.Join(dir, "iperf3")
+	script := "#!/bin/sh\necho \"$@\" > " + argsFile + ".tmp\nmv " + argsFile + ".tmp " + argsFile + "\nexec sleep 60\n"
+	if err := os.WriteFile(cmd, []byte(script), 0755); err != nil {
+		t.Fatalf("Failed to write fake iperf: %s", err)
+	}
+	return cmd, argsFile
+}
+
+func freePort(t *testing.T) uint16 {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	defer l.Close()
+	return uint16(l.Addr().(*net.TCPAddr).Port)
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for end := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(end) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSupervisorCommand(t *testing.T) {
+	cmd, argsFile := fakeIperf(t)
+	sup := &Supervisor{Command: cmd, Address: "iperf.example.com"}
+	defer sup.Close()
+	pool := server.NewPortPool(5301, 5302)
+	pool.Handler = sup
+
+	l, err := pool.Lease([]byte{1}, []byte{2}, time.Time{})
+	if err != nil {
+		t.Fatalf("Failed to lease port: %s", err)
+	}
+	m := npmp.NewSettingsMessage()
+	if err := sup.StartLease(l, m); err != nil {
+		t.Fatalf("Failed to start server: %s", err)
+	}
+	if addr, _ := m.IperfServerAddress(); addr != "iperf.example.com" {
+		t.Fatalf("Incorrect server address. Expected iperf.example.com, got %q", addr)
+	}
+	if v, _ := m.IperfServerVersion(); v != 3 {
+		t.Fatalf("Incorrect server version. Expected 3, got %d", v)
+	}
+
+	var args []byte
+	waitFor(t, "iperf to start", func() bool {
+		args, err = os.ReadFile(argsFile)
+		return err == nil
+	})
+	if got := strings.TrimSpace(string(args)); got != "-s -p 5301 -1" {
+		t.Fatalf("Incorrect iperf arguments. Expected \"-s -p 5301 -1\", got %q", got)
+	}
+
+	// Leasing again keeps the running server.
+	if err := sup.StartLease(l, m); err != nil {
+		t.Fatalf("Failed to renew lease: %s", err)
+	}
+	if running := sup.Running(); len(running) != 1 || running[0] != 5301 {
+		t.Fatalf("Incorrect running servers. Expected [5301], got %v", running)
+	}
+
+	pool.Release([]byte{1}, []byte{2})
+	if running := sup.Running(); len(running) != 0 {
+		t.Fatalf("Incorrect running servers after release. Expected none, got %v", running)
+	}
+}
+
+func TestSupervisorDeadline(t *testing.T) {
+	cmd, _ := fakeIperf(t)
+	sup := &Supervisor{Command: cmd}
+	defer sup.Close()
+	pool := server.NewPortPool(5301, 5301)
+	pool.Handler = sup
+
+	l, err := pool.Lease([]byte{1}, []byte{2}, time.Now().Add(200*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Failed to lease port: %s", err)
+	}
+	m := npmp.NewSettingsMessage()
+	if err := sup.StartLease(l, m); err != nil {
+		t.Fatalf("Failed to start server: %s", err)
+	}
+	if len(sup.Running()) != 1 {
+		t.Fatalf("Incorrect running servers. Expected 1, got %v", sup.Running())
+	}
+	waitFor(t, "the server to be killed", func() bool { return len(sup.Running()) == 0 })
+}
+
+func TestSupervisorBuiltin(t *testing.T) {
+	port := freePort(t)
+	sup := &Supervisor{ListenAddress: "127.0.0.1"}
+	defer sup.Close()
+	pool := server.NewPortPool(port, port)
+	pool.Handler = sup
+
+	l, err := pool.Lease([]byte{1}, []byte{2}, time.Now().Add(10*time.Second))
+	if err != nil {
+		t.Fatalf("Failed to lease port: %s", err)
+	}
+	m := npmp.NewSettingsMessage()
+	if err := sup.StartLease(l, m); err != nil {
+		t.Fatalf("Failed to start server: %s", err)
+	}
+	if _, ok := m.Option(npmp.IperfServerVersion); ok {
+		t.Fatalf("Incorrect settings. Expected no server version for the built in server")
+	}
+
+	spec := &npmp.Job{
+		ID:        []byte{1, 2, 3, 4},
+		Type:      npmp.Iperf3,
+		Transport: npmp.TCP,
+		Target:    "127.0.0.1",
+		Duration:  200 * time.Millisecond,
+		Parallel:  1,
+	}
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port)))
+	res, err := throughput.Run(context.Background(), addr, spec)
+	if err != nil {
+		t.Fatalf("Failed to run test: %s", err)
+	}
+	if res.Received.Bytes == 0 {
+		t.Fatalf("Incorrect bytes. Expected a non zero count, got 0")
+	}
+
+	pool.Release([]byte{1}, []byte{2})
+	if _, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		t.Fatalf("Incorrect state. Expected the server to be closed after release")
+	}
+}
+
+func TestSupervisorRenew(t *testing.T) {
+	port := freePort(t)
+	sup := &Supervisor{ListenAddress: "127.0.0.1"}
+	defer sup.Close()
+	pool := server.NewPortPool(port, port)
+	pool.Handler = sup
+
+	l, err := pool.Lease([]byte{1}, []byte{2}, time.Now().Add(300*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Failed to lease port: %s", err)
+	}
+	if err := sup.StartLease(l, npmp.NewSettingsMessage()); err != nil {
+		t.Fatalf("Failed to start server: %s", err)
+	}
+	if l, err = pool.Lease([]byte{1}, []byte{2}, time.Now().Add(10*time.Second)); err != nil {
+		t.Fatalf("Failed to renew lease: %s", err)
+	}
+	if err := sup.StartLease(l, npmp.NewSettingsMessage()); err != nil {
+		t.Fatalf("Failed to renew server: %s", err)
+	}
+
+	// The test outlasts the first deadline.
+	spec := &npmp.Job{
+		ID:        []byte{1, 2, 3, 4},
+		Type:      npmp.Iperf3,
+		Transport: npmp.TCP,
+		Target:    "127.0.0.1",
+		Duration:  500 * time.Millisecond,
+		Parallel:  1,
+	}
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port)))
+	if _, err := throughput.Run(context.Background(), addr, spec); err != nil {
+		t.Fatalf("Failed to run test after renewal: %s", err)
+	}
+	if len(sup.Running()) != 1 {
+		t.Fatalf("Incorrect running servers. Expected 1, got %v", sup.Running())
+	}
+}
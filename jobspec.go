@@ -0,0 +1,232 @@
+package npmp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Transport is the protocol a job uses to reach its target.
+type Transport byte
+
+const (
+	TCP  Transport = 0
+	UDP  Transport = 1
+	ICMP Transport = 2 // Ping jobs only
+)
+
+func (t Transport) String() string {
+	switch t {
+	case TCP:
+		return "TCP"
+	case UDP:
+		return "UDP"
+	case ICMP:
+		return "ICMP"
+	}
+	return fmt.Sprintf("Transport(%d)", byte(t))
+}
+
+// jobSpecVersion is the version of the JobSpec encoding written by
+// MarshalBinary.
+const jobSpecVersion = 1
+
+// jobSpecFixedLength is the length of a version 1 JobSpec without the target.
+const jobSpecFixedLength = 1 + 4 + 1 + 1 + 1 + 1 + 2 + 4 + 4 + 8 + 8 + 8 + 2
+
+// ErrUnknownJobSpecVersion is returned when decoding a JobSpec encoded with a
+// newer version of the format.
+var ErrUnknownJobSpecVersion = errors.New("Unknown JobSpec version")
+
+// A JobError describes an invalid field of a Job.
+type JobError struct {
+	Field  string
+	Reason string
+}
+
+func (e *JobError) Error() string {
+	return fmt.Sprintf("Invalid job %s: %s", e.Field, e.Reason)
+}
+
+// A Job defines a test for a client to run. It's carried in the JobSpec option
+// of a Settings message and started with a Start message with the same ID.
+//
+// The version 1 encoding is, with integers little endian:
+//
+//	version     1 byte, 1
+//	ID          4 bytes
+//	Type        1 byte DataType
+//	Transport   1 byte
+//	flags       1 byte, bit 0 Reverse, bit 1 Bidirectional
+//	Parallel    1 byte
+//	Count       uint16
+//	Duration    uint32 milliseconds
+//	Interval    uint32 milliseconds
+//	Bitrate     uint64 bits per second
+//	Schedule    int64 milliseconds since the Unix epoch, 0 for immediately
+//	Deadline    int64 milliseconds since the Unix epoch, 0 for none
+//	Target      uint16 length followed by UTF-8 text
+type Job struct {
+	ID            []byte    // 4 byte job ID matching the Start message
+	Type          DataType  // Kind of test and of the Data message it produces
+	Transport     Transport // TCP or UDP, and ICMP for Ping
+	Target        string    // Host or host:port to test against
+	Duration      time.Duration
+	Interval      time.Duration // Time between ping probes or iperf reports
+	Count         uint16        // Number of ping probes
+	Parallel      uint8         // Number of parallel iperf streams
+	Bitrate       uint64        // Target bits per second, 0 for unlimited
+	Reverse       bool          // Server sends, client receives
+	Bidirectional bool          // Both sides send at once
+	Schedule      time.Time     // When to start, zero for immediately
+	Deadline      time.Time     // When results are due, zero for none
+}
+
+// Validate checks the job is complete and consistent.
+func (j *Job) Validate() error {
+	if len(j.ID) != 4 {
+		return &JobError{Field: "ID", Reason: fmt.Sprintf("%d bytes, need 4", len(j.ID))}
+	}
+	if j.Target == "" || len(j.Target) > math.MaxUint16 {
+		return &JobError{Field: "Target", Reason: "must be set"}
+	}
+	if j.Duration < 0 || j.Duration.Milliseconds() > math.MaxUint32 {
+		return &JobError{Field: "Duration", Reason: "out of range"}
+	}
+	if j.Interval < 0 || j.Interval.Milliseconds() > math.MaxUint32 {
+		return &JobError{Field: "Interval", Reason: "out of range"}
+	}
+	if !j.Schedule.IsZero() && !j.Deadline.IsZero() && j.Deadline.Before(j.Schedule) {
+		return &JobError{Field: "Deadline", Reason: "before Schedule"}
+	}
+
+	switch j.Type {
+	case Ping:
+		if j.Count == 0 {
+			return &JobError{Field: "Count", Reason: "must be at least 1 for Ping"}
+		}
+		if j.Transport > ICMP {
+			return &JobError{Field: "Transport", Reason: j.Transport.String()}
+		}
+	case Iperf2, Iperf3:
+		if j.Duration <= 0 {
+			return &JobError{Field: "Duration", Reason: "must be set for iperf"}
+		}
+		if j.Parallel == 0 {
+			return &JobError{Field: "Parallel", Reason: "must be at least 1 for iperf"}
+		}
+		if j.Transport != TCP && j.Transport != UDP {
+			return &JobError{Field: "Transport", Reason: j.Transport.String() + " not supported by iperf"}
+		}
+	default:
+		return &JobError{Field: "Type", Reason: j.Type.String()}
+	}
+	return nil
+}
+
+// MarshalBinary validates the job and returns its encoding.
+func (j *Job) MarshalBinary() ([]byte, error) {
+	if err := j.Validate(); err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, jobSpecFixedLength, jobSpecFixedLength+len(j.Target))
+	b[0] = jobSpecVersion
+	copy(b[1:5], j.ID)
+	b[5] = byte(j.Type)
+	b[6] = byte(j.Transport)
+	if j.Reverse {
+		b[7] |= 1
+	}
+	if j.Bidirectional {
+		b[7] |= 2
+	}
+	b[8] = j.Parallel
+	binary.LittleEndian.PutUint16(b[9:], j.Count)
+	binary.LittleEndian.PutUint32(b[11:], uint32(j.Duration.Milliseconds()))
+	binary.LittleEndian.PutUint32(b[15:], uint32(j.Interval.Milliseconds()))
+	binary.LittleEndian.PutUint64(b[19:], j.Bitrate)
+	binary.LittleEndian.PutUint64(b[27:], uint64(unixMilli(j.Schedule)))
+	binary.LittleEndian.PutUint64(b[35:], uint64(unixMilli(j.Deadline)))
+	binary.LittleEndian.PutUint16(b[43:], uint16(len(j.Target)))
+	return append(b, j.Target...), nil
+}
+
+// UnmarshalBinary decodes and validates a job.
+func (j *Job) UnmarshalBinary(b []byte) error {
+	if len(b) == 0 {
+		return &JobError{Field: "encoding", Reason: "empty"}
+	}
+	if b[0] != jobSpecVersion {
+		return ErrUnknownJobSpecVersion
+	}
+	if len(b) < jobSpecFixedLength {
+		return &JobError{Field: "encoding", Reason: "truncated"}
+	}
+	l := int(binary.LittleEndian.Uint16(b[43:]))
+	if len(b) != jobSpecFixedLength+l {
+		return &JobError{Field: "encoding", Reason: "incorrect target length"}
+	}
+
+	*j = Job{
+		ID:            append([]byte(nil), b[1:5]...),
+		Type:          DataType(b[5]),
+		Transport:     Transport(b[6]),
+		Reverse:       b[7]&1 != 0,
+		Bidirectional: b[7]&2 != 0,
+		Parallel:      b[8],
+		Count:         binary.LittleEndian.Uint16(b[9:]),
+		Duration:      time.Duration(binary.LittleEndian.Uint32(b[11:])) * time.Millisecond,
+		Interval:      time.Duration(binary.LittleEndian.Uint32(b[15:])) * time.Millisecond,
+		Bitrate:       binary.LittleEndian.Uint64(b[19:]),
+		Schedule:      fromUnixMilli(int64(binary.LittleEndian.Uint64(b[27:]))),
+		Deadline:      fromUnixMilli(int64(binary.LittleEndian.Uint64(b[35:]))),
+		Target:        string(b[jobSpecFixedLength:]),
+	}
+	return j.Validate()
+}
+
+// AddJob appends a JobSpec option for j. A Settings message may carry
+// several jobs.
+func (p *SettingsMessage) AddJob(j *Job) error {
+	b, err := j.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	p.AddOption(Option{Code: JobSpec, Value: b})
+	return nil
+}
+
+// Jobs decodes every JobSpec option of the message.
+func (p *SettingsMessage) Jobs() ([]*Job, error) {
+	var jobs []*Job
+	for _, o := range p.Options {
+		if o.Code != JobSpec {
+			continue
+		}
+		j := &Job{}
+		if err := j.UnmarshalBinary(o.Value); err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, nil
+}
+
+// unixMilli returns t in milliseconds since the Unix epoch, or 0 if t is zero.
+func unixMilli(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixMilli()
+}
+
+// fromUnixMilli is the inverse of unixMilli.
+func fromUnixMilli(ms int64) time.Time {
+	if ms == 0 {
+		return time.Time{}
+	}
+	return time.UnixMilli(ms)
+}
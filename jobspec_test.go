@@ -0,0 +1,96 @@
+package npmp
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestJobRoundTrip(t *testing.T) {
+	schedule := time.UnixMilli(time.Date(2026, 1, 2, 2, 0, 0, 0, time.UTC).UnixMilli())
+	jobs := []*Job{
+		{
+			ID:        []byte{0, 0, 0, 1},
+			Type:      Iperf3,
+			Transport: TCP,
+			Target:    "iperf.example.com:5201",
+			Duration:  10 * time.Second,
+			Interval:  time.Second,
+			Parallel:  4,
+			Reverse:   true,
+			Schedule:  schedule,
+			Deadline:  schedule.Add(5 * time.Minute),
+		},
+		{
+			ID:        []byte{0, 0, 0, 2},
+			Type:      Ping,
+			Transport: ICMP,
+			Target:    "192.0.2.1",
+			Count:     20,
+			Interval:  200 * time.Millisecond,
+		},
+	}
+
+	m := NewSettingsMessage()
+	for _, j := range jobs {
+		if err := m.AddJob(j); err != nil {
+			t.Fatalf("Failed to add job: %s", err)
+		}
+	}
+	s, err := ConvertToSettings(Message(m.Bytes()))
+	if err != nil {
+		t.Fatalf("Failed to process settings: %s", err)
+	}
+	decoded, err := s.Jobs()
+	if err != nil {
+		t.Fatalf("Failed to decode jobs: %s", err)
+	}
+	if !reflect.DeepEqual(decoded, jobs) {
+		t.Fatalf("Incorrect jobs. Expected %+v, got %+v", jobs, decoded)
+	}
+	if err := s.ValidateOptions(); err != nil {
+		t.Fatalf("Failed to validate options: %s", err)
+	}
+}
+
+func TestJobValidation(t *testing.T) {
+	valid := func() *Job {
+		return &Job{ID: []byte{1, 2, 3, 4}, Type: Iperf2, Transport: UDP, Target: "host", Duration: time.Second, Parallel: 1}
+	}
+
+	tests := []struct {
+		field  string
+		modify func(j *Job)
+	}{
+		{"ID", func(j *Job) { j.ID = []byte{1} }},
+		{"Target", func(j *Job) { j.Target = "" }},
+		{"Duration", func(j *Job) { j.Duration = 0 }},
+		{"Parallel", func(j *Job) { j.Parallel = 0 }},
+		{"Transport", func(j *Job) { j.Transport = ICMP }},
+		{"Type", func(j *Job) { j.Type = DataType(99) }},
+		{"Count", func(j *Job) { j.Type = Ping }},
+		{"Deadline", func(j *Job) {
+			j.Schedule = time.Now()
+			j.Deadline = j.Schedule.Add(-time.Second)
+		}},
+	}
+	for _, test := range tests {
+		j := valid()
+		test.modify(j)
+		_, err := j.MarshalBinary()
+		var jerr *JobError
+		if !errors.As(err, &jerr) || jerr.Field != test.field {
+			t.Fatalf("Incorrect error. Expected JobError for %s, got %v", test.field, err)
+		}
+	}
+
+	b, _ := valid().MarshalBinary()
+	if err := (&Job{}).UnmarshalBinary(b[:len(b)-1]); err == nil {
+		t.Fatal("Expected error decoding truncated job")
+	}
+	b[0] = 2
+	if err := (&Job{}).UnmarshalBinary(b); err != ErrUnknownJobSpecVersion {
+		t.Fatalf("Incorrect error. Expected ErrUnknownJobSpecVersion, got %v", err)
+	}
+}
@@ -1,8 +1,9 @@
 package npmp
 
 import (
+	"bytes"
 	"encoding/binary"
-	"errors"
+	"fmt"
 	"net"
 )
 
@@ -55,33 +56,118 @@ const (
 	WirelessEthernet NetType = 1
 )
 
+// A NetInterface describes a network interface of a client. Version 0
+// messages carry a 6 byte hardware address and a single IPv4 address per
+// interface, only IPAddr is used. Version 1 and later carry a variable length
+// hardware address and any number of IPv4 and IPv6 addresses with their
+// prefix lengths in Addrs. When a version 1 message is processed IPAddr is
+// set to the first address.
 type NetInterface struct {
 	Type   NetType
 	Haddr  net.HardwareAddr
 	IPAddr net.IP
+	Addrs  []*net.IPNet
 }
 
+// Address families used in version 1 interface records.
+const (
+	familyIPv4 = 4
+	familyIPv6 = 6
+)
+
 func (p *RegisterMessage) ClientID() []byte      { return p.Message[4:20] }
 func (p *RegisterMessage) SetClientID(id []byte) { copy(p.ClientID(), id) }
 func (p *RegisterMessage) IfCount() byte         { return p.Message[20] }
 func (p *RegisterMessage) Process() error {
+	if err := p.Message.validateType(Register); err != nil {
+		return err
+	}
+	ifaces, err := p.interfaces()
+	if err != nil {
+		return err
+	}
+	p.Interfaces = ifaces
+	return nil
+}
+
+// interfaces parses the interface records of the message according to its
+// version.
+func (p *RegisterMessage) interfaces() ([]*NetInterface, error) {
+	if p.Version() == 0 {
+		return p.interfacesV0()
+	}
+	return p.interfacesV1()
+}
+
+// interfacesV0 parses fixed 11 byte records: type, 6 byte hardware address
+// and 4 byte IPv4 address.
+func (p *RegisterMessage) interfacesV0() ([]*NetInterface, error) {
 	c := int(p.IfCount())
 	// base header + Register message header + 11 bytes per interface
-	if len(p.Message) < 4+17+(11*c) {
-		return errors.New("REGISTER message too small")
+	if min := 4 + 17 + (11 * c); len(p.Message) < min {
+		return nil, &LengthError{Type: Register, Length: len(p.Message), Min: min}
 	}
 
-	p.Interfaces = make([]*NetInterface, c)
-
+	ifaces := make([]*NetInterface, c)
 	for i := 0; i < c; i++ {
 		netif := &NetInterface{
 			Type:   NetType(p.Message[21+(i*11)]),
 			Haddr:  net.HardwareAddr(p.Message[22+(i*11) : 28+(i*11)]),
 			IPAddr: net.IP(p.Message[28+(i*11) : 32+(i*11)]),
 		}
-		p.Interfaces[i] = netif
+		ifaces[i] = netif
 	}
-	return nil
+	return ifaces, nil
+}
+
+// interfacesV1 parses variable length records: type, hardware address length,
+// hardware address, address count and for each address its family, prefix
+// length and 4 or 16 byte address.
+func (p *RegisterMessage) interfacesV1() ([]*NetInterface, error) {
+	c := int(p.IfCount())
+	b := p.Message[21:]
+	ifaces := make([]*NetInterface, c)
+	for i := 0; i < c; i++ {
+		if len(b) < 2 || len(b) < 3+int(b[1]) {
+			return nil, ErrTruncatedInterface
+		}
+		netif := &NetInterface{
+			Type:  NetType(b[0]),
+			Haddr: net.HardwareAddr(b[2 : 2+b[1]]),
+		}
+		b = b[2+b[1]:]
+
+		addrs := int(b[0])
+		b = b[1:]
+		netif.Addrs = make([]*net.IPNet, addrs)
+		for j := 0; j < addrs; j++ {
+			if len(b) < 2 {
+				return nil, ErrTruncatedInterface
+			}
+			l := net.IPv4len
+			if b[0] == familyIPv6 {
+				l = net.IPv6len
+			} else if b[0] != familyIPv4 {
+				return nil, fmt.Errorf("Unknown address family %d", b[0])
+			}
+			if int(b[1]) > l*8 {
+				return nil, fmt.Errorf("Invalid prefix length %d", b[1])
+			}
+			if len(b) < 2+l {
+				return nil, ErrTruncatedInterface
+			}
+			netif.Addrs[j] = &net.IPNet{
+				IP:   net.IP(b[2 : 2+l]),
+				Mask: net.CIDRMask(int(b[1]), l*8),
+			}
+			b = b[2+l:]
+		}
+		if addrs > 0 {
+			netif.IPAddr = netif.Addrs[0].IP
+		}
+		ifaces[i] = netif
+	}
+	return ifaces, nil
 }
 
 func (p *RegisterMessage) AddInterface(i *NetInterface) {
@@ -92,18 +178,83 @@ func (p *RegisterMessage) AddInterface(i *NetInterface) {
 	p.Message[20] = byte(len(p.Interfaces))
 }
 
+// Bytes encodes the message with the interface record layout of its version.
+// Version 0 can only carry IPv4, an interface without an IPv4 address is sent
+// as 0.0.0.0.
 func (p *RegisterMessage) Bytes() []byte {
-	ret := p.Message[:4]                       // Base header
+	ret := make([]byte, 0, 21+len(p.Interfaces)*11)
+	ret = append(ret, p.Message[:4]...)        // Base header
 	ret = append(ret, p.ClientID()...)         // Add client ID
 	ret = append(ret, byte(len(p.Interfaces))) // Add number of interfaces
 	for _, i := range p.Interfaces {           // Add interfaces
-		ret = append(ret, byte(i.Type))              // Add interface type
-		ret = append(ret, []byte(i.Haddr)...)        // Add interface MAC address
-		ret = append(ret, []byte(i.IPAddr.To4())...) // Add interface IP address
+		ret = append(ret, byte(i.Type)) // Add interface type
+		if p.Version() == 0 {
+			ret = append(ret, i.v0Haddr()...)  // Add interface MAC address
+			ret = append(ret, i.v0IPAddr()...) // Add interface IP address
+			continue
+		}
+
+		ret = append(ret, byte(len(i.Haddr))) // Add hardware address length
+		ret = append(ret, i.Haddr...)         // Add hardware address
+		addrs := i.addrs()
+		ret = append(ret, byte(len(addrs))) // Add number of addresses
+		for _, a := range addrs {
+			ones, _ := a.Mask.Size()
+			if ip := a.IP.To4(); ip != nil {
+				ret = append(ret, familyIPv4, byte(ones))
+				ret = append(ret, ip...)
+			} else {
+				ret = append(ret, familyIPv6, byte(ones))
+				ret = append(ret, a.IP.To16()...)
+			}
+		}
 	}
 	return ret
 }
 
+// v0Haddr returns the hardware address padded or truncated to 6 bytes.
+func (i *NetInterface) v0Haddr() []byte {
+	haddr := make([]byte, 6)
+	copy(haddr, i.Haddr)
+	return haddr
+}
+
+// v0IPAddr returns the first IPv4 address of the interface, or 0.0.0.0.
+func (i *NetInterface) v0IPAddr() []byte {
+	if ip := i.IPAddr.To4(); ip != nil {
+		return ip
+	}
+	for _, a := range i.Addrs {
+		if ip := a.IP.To4(); ip != nil {
+			return ip
+		}
+	}
+	return net.IPv4zero.To4()
+}
+
+// addrs returns the addresses to encode in a version 1 record, at most 255.
+// If Addrs is empty IPAddr is used as a host address.
+func (i *NetInterface) addrs() []*net.IPNet {
+	addrs := i.Addrs
+	if len(addrs) == 0 && i.IPAddr != nil {
+		bits := net.IPv6len * 8
+		if i.IPAddr.To4() != nil {
+			bits = net.IPv4len * 8
+		}
+		addrs = []*net.IPNet{{IP: i.IPAddr, Mask: net.CIDRMask(bits, bits)}}
+	}
+	var valid []*net.IPNet
+	for _, a := range addrs {
+		if a != nil && a.IP.To16() != nil {
+			valid = append(valid, a)
+		}
+	}
+	if len(valid) > 255 {
+		valid = valid[:255]
+	}
+	return valid
+}
+
 type StartMessage struct {
 	Message
 }
@@ -155,6 +306,17 @@ func (p *InformMessage) SetOptions(o []OptionCode) {
 	}
 }
 
+// A VersionMessage lists the protocol versions supported by its sender, one
+// byte each. The reply to it carries only the version chosen.
+type VersionMessage struct {
+	Message
+}
+
+func (p VersionMessage) Versions() []byte { return append([]byte(nil), p.Message[4:]...) }
+func (p *VersionMessage) SetVersions(v []byte) {
+	p.Message = append(p.Message[:4], v...) // Replace everything after the header
+}
+
 type NAKMessage struct {
 	Message
 }
@@ -165,19 +327,48 @@ func (p NAKMessage) SetResponseCode(code NACKResponseCode) { p.Message[4] = byte
 type SettingsMessage struct {
 	Message
 	Options []Option
+
+	read []Option // Options as parsed by Process
 }
 
+// Process parses the Option TLVs of the message into Options. Each option is
+// a one byte code, a four byte little endian length and the value. Pad is a
+// single byte which is skipped, OpEnd is a single byte which ends parsing.
+// Neither is kept in Options, Bytes writes them back as they were read as
+// long as Options is unchanged. Option values share the underlying array of
+// the message.
 func (p *SettingsMessage) Process() error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
 	start := 4 // Starting offset of first Option
 	p.Options = make([]Option, 0)
+	p.read = nil
 	for start < len(p.Message) {
-		len := binary.LittleEndian.Uint32(p.Message[5:9]) // Option length
+		code := OptionCode(p.Message[start])
+		if code == Pad {
+			start++
+			continue
+		}
+		if code == OpEnd {
+			break
+		}
+
+		if len(p.Message)-start < 5 {
+			return ErrTruncatedOption
+		}
+		l := binary.LittleEndian.Uint32(p.Message[start+1 : start+5]) // Option length
+		if uint64(l) > uint64(len(p.Message)-start-5) {
+			return ErrTruncatedOption
+		}
+		end := start + 5 + int(l) // Starting offset + Option header + length of option
 		p.Options = append(p.Options, Option{
-			Code:  OptionCode(p.Message[start]),
-			Value: p.Message[9:len],
+			Code:  code,
+			Value: p.Message[start+5 : end : end],
 		}) // Add Option
-		start = start + 5 + int(len) // Starting offset + Option header + length of option
+		start = end
 	}
+	p.read = append(make([]Option, 0, len(p.Options)), p.Options...)
 	return nil
 }
 
@@ -193,10 +384,32 @@ func (p *SettingsMessage) StripOptions() {
 	p.Options = nil
 }
 
+// Bytes encodes the base header and Options. A processed message whose
+// Options are unchanged is written as it was read, with its Pad bytes and
+// anything after OpEnd. Pad and OpEnd are framing codes without a length:
+// an Option with either code is written as a single byte, followed by the
+// value for OpEnd.
 func (p *SettingsMessage) Bytes() []byte {
-	ret := p.Message[:4] // Base header
-	l := make([]byte, 4) // Used to encode option length
+	if p.read != nil && sameOptions(p.Options, p.read) {
+		return append([]byte(nil), p.Message...)
+	}
+	size := 4
 	for _, o := range p.Options {
+		size += 5 + len(o.Value)
+	}
+	ret := make([]byte, 4, size)
+	copy(ret, p.Message[:4]) // Base header
+	l := make([]byte, 4)     // Used to encode option length
+	for _, o := range p.Options {
+		switch o.Code {
+		case Pad:
+			ret = append(ret, byte(Pad))
+			continue
+		case OpEnd:
+			ret = append(ret, byte(OpEnd))
+			ret = append(ret, o.Value...)
+			continue
+		}
 		// Lengths are 4 bytes long, must encode a slice of bytes
 		binary.LittleEndian.PutUint32(l, uint32(len(o.Value)))
 		ret = append(ret, byte(o.Code)) // Add Option code
@@ -206,6 +419,18 @@ func (p *SettingsMessage) Bytes() []byte {
 	return ret
 }
 
+func sameOptions(a, b []Option) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Code != b[i].Code || !bytes.Equal(a[i].Value, b[i].Value) {
+			return false
+		}
+	}
+	return true
+}
+
 // NPMP Message Types
 const (
 	Null       MessageType = 0
@@ -240,9 +465,10 @@ const (
 
 // NPMP Data Message Types
 const (
-	Ping   DataType = 0
-	Iperf2 DataType = 1
-	Iperf3 DataType = 2
+	Ping           DataType = 0
+	Iperf2         DataType = 1
+	Iperf3         DataType = 2
+	SoftwareUpdate DataType = 3
 )
 
 // NPMP NACK Response Codes
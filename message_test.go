@@ -2,6 +2,7 @@ package npmp
 
 import (
 	"bytes"
+	"math/rand"
 	"net"
 	"testing"
 )
@@ -241,3 +242,159 @@ func TestSettingsMessage(t *testing.T) {
 		t.Fatalf("Incorrect Option Value. Expected %s, got %s", repo, o.Value)
 	}
 }
+
+func TestSettingsMessageProcess(t *testing.T) {
+	m := NewSettingsMessage()
+	m.AddOption(Option{Code: ServerIP, Value: []byte{10, 0, 0, 1}})
+	m.AddOption(Option{Code: ClientSoftwareRepo, Value: []byte(`http://repo.example.com/client/latest`)})
+	m.AddOption(Option{Code: JobSpec, Value: []byte{}})
+	m.AddOption(Option{Code: HeartbeatDuration, Value: []byte{0x10, 0x27, 0, 0}})
+
+	// Pad bytes and OpEnd are skipped but written back as they were read.
+	b := append([]byte{}, m.Bytes()[:4]...)
+	b = append(b, byte(Pad), byte(Pad))
+	b = append(b, m.Bytes()[4:]...)
+	b = append(b, byte(Pad), byte(OpEnd), 0xde, 0xad)
+
+	s, err := ConvertToSettings(Message(b))
+	if err != nil {
+		t.Fatalf("Failed to process settings: %s", err)
+	}
+	expected := m.Options
+	if len(s.Options) != len(expected) {
+		t.Fatalf("Incorrect options length. Expected %d, got %d", len(expected), len(s.Options))
+	}
+	for i, o := range s.Options {
+		if o.Code != expected[i].Code {
+			t.Fatalf("Incorrect Option Code. Expected %s, got %s", expected[i].Code, o.Code)
+		}
+		if !bytes.Equal(o.Value, expected[i].Value) {
+			t.Fatalf("Incorrect Option Value. Expected %v, got %v", expected[i].Value, o.Value)
+		}
+	}
+	if !bytes.Equal(s.Bytes(), b) {
+		t.Fatalf("Incorrect bytes. Expected %v, got %v", b, s.Bytes())
+	}
+	if v, ok := s.Option(HeartbeatDuration); !ok || !bytes.Equal(v, []byte{0x10, 0x27, 0, 0}) {
+		t.Fatalf("Incorrect HeartbeatDuration. Expected %v, got %v", []byte{0x10, 0x27, 0, 0}, v)
+	}
+	// Once changed the options are encoded without the framing.
+	s.SetIperfServerPort(5201)
+	if _, err := ConvertToSettings(Message(s.Bytes())); err != nil {
+		t.Fatalf("Failed to process changed settings: %s", err)
+	}
+	if bytes.Contains(s.Bytes(), []byte{byte(OpEnd), 0xde, 0xad}) {
+		t.Fatalf("Incorrect bytes. Expected no OpEnd, got %v", s.Bytes())
+	}
+
+	// An option length running past the end of the message
+	b = m.Bytes()
+	b[5] = 200
+	if _, err := ConvertToSettings(Message(b)); err != ErrTruncatedOption {
+		t.Fatalf("Incorrect error. Expected ErrTruncatedOption, got %v", err)
+	}
+	// A truncated option header
+	if _, err := ConvertToSettings(Message(m.Bytes()[:7])); err != ErrTruncatedOption {
+		t.Fatalf("Incorrect error. Expected ErrTruncatedOption, got %v", err)
+	}
+}
+
+func TestSettingsMessageRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		m := NewSettingsMessage()
+		for j := r.Intn(10); j > 0; j-- {
+			v := make([]byte, r.Intn(300))
+			r.Read(v)
+			m.AddOption(Option{Code: OptionCode(1 + r.Intn(254)), Value: v})
+		}
+
+		b := m.Bytes()
+		s, err := ConvertToSettings(Message(b))
+		if err != nil {
+			t.Fatalf("Failed to process settings: %s", err)
+		}
+		if len(s.Options) != len(m.Options) {
+			t.Fatalf("Incorrect options length. Expected %d, got %d", len(m.Options), len(s.Options))
+		}
+		if !bytes.Equal(s.Bytes(), b) {
+			t.Fatalf("Settings message did not round trip")
+		}
+		// Re-encoding must not corrupt the processed options
+		if !bytes.Equal(s.Bytes(), b) {
+			t.Fatalf("Settings message changed after encoding")
+		}
+	}
+}
+
+func TestRegisterMessageIPv6(t *testing.T) {
+	_, v6net, _ := net.ParseCIDR("2001:db8::10/64")
+	v6net.IP = net.ParseIP("2001:db8::10")
+	v4net := &net.IPNet{IP: net.IP{192, 168, 0, 10}, Mask: net.CIDRMask(24, 32)}
+	haddr := net.HardwareAddr([]byte{0xab, 0xcd, 0xef, 0x12, 0x34, 0x56})
+
+	m := NewRegisterMessage()
+	m.SetVersion(1)
+	m.AddInterface(&NetInterface{
+		Type:  WiredEthernet,
+		Haddr: haddr,
+		Addrs: []*net.IPNet{v6net, v4net},
+	})
+	m.AddInterface(&NetInterface{
+		Type:   WirelessEthernet,
+		Haddr:  net.HardwareAddr{1, 2, 3, 4, 5, 6, 7, 8}, // EUI-64
+		IPAddr: net.IP{10, 0, 0, 1},
+	})
+
+	p, err := Parse(m.Bytes())
+	if err != nil {
+		t.Fatalf("Failed to parse version 1 Register message: %s", err)
+	}
+	r := p.(*RegisterMessage)
+	if len(r.Interfaces) != 2 {
+		t.Fatalf("Incorrect number of interfaces. Expected 2, got %d", len(r.Interfaces))
+	}
+
+	iface := r.Interfaces[0]
+	if !bytes.Equal(iface.Haddr, haddr) {
+		t.Fatalf("Incorrect interface MAC address. Expected %s, got %s", haddr, iface.Haddr)
+	}
+	if len(iface.Addrs) != 2 {
+		t.Fatalf("Incorrect number of addresses. Expected 2, got %d", len(iface.Addrs))
+	}
+	if iface.Addrs[0].String() != "2001:db8::10/64" || iface.Addrs[1].String() != "192.168.0.10/24" {
+		t.Fatalf("Incorrect addresses. Expected [2001:db8::10/64 192.168.0.10/24], got %v", iface.Addrs)
+	}
+	if !iface.IPAddr.Equal(v6net.IP) {
+		t.Fatalf("Incorrect interface IP address. Expected %s, got %s", v6net.IP, iface.IPAddr)
+	}
+
+	iface = r.Interfaces[1]
+	if len(iface.Haddr) != 8 || iface.Addrs[0].String() != "10.0.0.1/32" {
+		t.Fatalf("Incorrect interface. Expected 8 byte hardware address and 10.0.0.1/32, got %s and %v", iface.Haddr, iface.Addrs)
+	}
+	if !bytes.Equal(r.Bytes(), m.Bytes()) {
+		t.Fatalf("Register message did not round trip")
+	}
+
+	// Version 0 falls back to the first IPv4 address
+	m.SetVersion(0)
+	p, err = Parse(m.Bytes())
+	if err != nil {
+		t.Fatalf("Failed to parse version 0 Register message: %s", err)
+	}
+	r = p.(*RegisterMessage)
+	if !r.Interfaces[0].IPAddr.Equal(v4net.IP) {
+		t.Fatalf("Incorrect interface IP address. Expected %s, got %s", v4net.IP, r.Interfaces[0].IPAddr)
+	}
+	if !bytes.Equal(r.Interfaces[1].Haddr, []byte{1, 2, 3, 4, 5, 6}) {
+		t.Fatalf("Incorrect interface MAC address. Expected truncated address, got %s", r.Interfaces[1].Haddr)
+	}
+
+	// Records running past the end of the message
+	m.SetVersion(1)
+	b := m.Bytes()
+	if _, err := Parse(b[:len(b)-1]); err != ErrTruncatedInterface {
+		t.Fatalf("Incorrect error. Expected ErrTruncatedInterface, got %v", err)
+	}
+}
@@ -0,0 +1,80 @@
+package npmp
+
+import (
+	"errors"
+	"unicode/utf8"
+)
+
+// NAK diagnostics
+//
+// A NAK may carry a diagnostic after its response code, a short UTF-8 text
+// for humans explaining why the message was rejected. Peers which don't
+// know about diagnostics ignore it. A NAK with NotAuthorized sent in reply
+// to a frame that failed authentication never carries one.
+
+// Errors for each NACKResponseCode. errors.Is reports a *NAKError as one of
+// these when their codes match, whatever its diagnostic.
+var (
+	ErrGeneral            error = &NAKError{Code: GeneralError}
+	ErrNotAuthorized      error = &NAKError{Code: NotAuthorized}
+	ErrUnsupportedVersion error = &NAKError{Code: UnsupportedVersion}
+	ErrNoPortsAvailable   error = &NAKError{Code: NoPortsAvailable}
+	ErrInvalidData        error = &NAKError{Code: InvalidData}
+)
+
+// A NAKError is a NAK as an error. It's returned when a request is answered
+// by a NAK, and server handlers may return one to choose the NAK sent.
+type NAKError struct {
+	Code       NACKResponseCode
+	Diagnostic string // Optional explanation carried in the NAK
+}
+
+func (e *NAKError) Error() string {
+	if e.Diagnostic != "" {
+		return "NAK " + e.Code.String() + ": " + e.Diagnostic
+	}
+	return "NAK " + e.Code.String()
+}
+
+// Is reports whether target is a *NAKError with the same code and either no
+// diagnostic or the same one.
+func (e *NAKError) Is(target error) bool {
+	t, ok := target.(*NAKError)
+	return ok && t.Code == e.Code && (t.Diagnostic == "" || t.Diagnostic == e.Diagnostic)
+}
+
+// Err returns the NAK as a *NAKError.
+func (p NAKMessage) Err() error {
+	return &NAKError{Code: p.ResponseCode(), Diagnostic: p.Diagnostic()}
+}
+
+// Diagnostic returns the diagnostic of the NAK, empty if it has none or it
+// isn't valid UTF-8.
+func (p NAKMessage) Diagnostic() string {
+	d := p.Message[minLength[NAK]:]
+	if !utf8.Valid(d) {
+		return ""
+	}
+	return string(d)
+}
+
+// SetDiagnostic replaces the diagnostic of the NAK.
+func (p *NAKMessage) SetDiagnostic(d string) {
+	p.Message = append(p.Message[:minLength[NAK]], d...)
+}
+
+// NewNAKFromError returns the NAK reporting err. The response code and
+// diagnostic are those of the first *NAKError in err's chain. Any other
+// error is reported as GeneralError without a diagnostic, so that its text
+// isn't disclosed to the peer.
+func NewNAKFromError(err error) NAKMessage {
+	m := NewNAKMessage()
+	var nerr *NAKError
+	if errors.As(err, &nerr) {
+		m.SetResponseCode(nerr.Code)
+		if nerr.Diagnostic != "" {
+			m.SetDiagnostic(nerr.Diagnostic)
+		}
+	}
+	return m
+}
@@ -0,0 +1,48 @@
+package npmp
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestNAKError(t *testing.T) {
+	err := fmt.Errorf("Leasing port: %w", &NAKError{Code: NoPortsAvailable, Diagnostic: "pool exhausted"})
+	if !errors.Is(err, ErrNoPortsAvailable) {
+		t.Fatalf("Incorrect result. Expected %v to be ErrNoPortsAvailable", err)
+	}
+	if errors.Is(err, ErrGeneral) {
+		t.Fatalf("Incorrect result. Expected %v not to be ErrGeneral", err)
+	}
+	if errors.Is(err, &NAKError{Code: NoPortsAvailable, Diagnostic: "other"}) {
+		t.Fatalf("Incorrect result. Expected %v not to match another diagnostic", err)
+	}
+
+	nak := NewNAKFromError(err)
+	p, perr := Parse(nak.Bytes())
+	if perr != nil {
+		t.Fatalf("Failed to parse NAK: %s", perr)
+	}
+	decoded := p.(NAKMessage)
+	if decoded.ResponseCode() != NoPortsAvailable || decoded.Diagnostic() != "pool exhausted" {
+		t.Fatalf("Incorrect NAK. Expected NoPortsAvailable with a diagnostic, got %s %q", decoded.ResponseCode(), decoded.Diagnostic())
+	}
+	if expected := "NAK NoPortsAvailable: pool exhausted"; decoded.Err().Error() != expected {
+		t.Fatalf("Incorrect error. Expected %q, got %q", expected, decoded.Err())
+	}
+
+	// Other errors aren't disclosed.
+	nak = NewNAKFromError(errors.New("Database unavailable"))
+	if nak.ResponseCode() != GeneralError || nak.Diagnostic() != "" || len(nak.Bytes()) != minLength[NAK] {
+		t.Fatalf("Incorrect NAK. Expected a bare GeneralError, got %v", nak.Bytes())
+	}
+	if !errors.Is(nak.Err(), ErrGeneral) {
+		t.Fatalf("Incorrect result. Expected %v to be ErrGeneral", nak.Err())
+	}
+
+	nak.SetDiagnostic("try later")
+	nak.SetDiagnostic("")
+	if len(nak.Bytes()) != minLength[NAK] {
+		t.Fatalf("Incorrect length. Expected %d, got %d", minLength[NAK], len(nak.Bytes()))
+	}
+}
@@ -36,9 +36,9 @@ func (i MessageType) String() string {
 	return _MessageType_name[_MessageType_index[i]:_MessageType_index[i+1]]
 }
 
-const _DataType_name = "PingIperf2Iperf3"
+const _DataType_name = "PingIperf2Iperf3SoftwareUpdate"
 
-var _DataType_index = [...]uint8{0, 4, 10, 16}
+var _DataType_index = [...]uint8{0, 4, 10, 16, 30}
 
 func (i DataType) String() string {
 	if i >= DataType(len(_DataType_index)-1) {
@@ -0,0 +1,340 @@
+package npmp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Option encodings
+//
+// Each OptionCode has a single canonical encoding. Integers are little endian
+// like the option lengths.
+//
+//	ServerIP               4 byte IPv4 or 16 byte IPv6 address
+//	IperfServerAddress     host name or IP address as UTF-8 text
+//	IperfServerPort        uint16
+//	IperfServerVersion     1 byte major version of the iperf server
+//	JobResourceDeadline    int64 milliseconds since the Unix epoch
+//	ProtocolVersion        1 byte protocol version
+//	ClientSoftwareVersion  version as UTF-8 text
+//	ClientSoftwareRepo     absolute URL as UTF-8 text
+//	HeartbeatDuration      uint32 milliseconds
+//
+// JobSpec and VendorOptions carry structured data of their own.
+//
+// A HeartbeatDuration in the registration Settings asks both sides to send a
+// message, a Null message if nothing else, at least once per interval. A peer
+// is considered offline after DefaultHeartbeatMisses silent intervals, see
+// HeartbeatMonitor. Zero disables heartbeats.
+
+// ErrNoOption is returned by the typed option getters when the Settings
+// message doesn't contain the option.
+var ErrNoOption = errors.New("Option not present")
+
+// An OptionError is returned when an option value doesn't match the
+// canonical encoding of its code.
+type OptionError struct {
+	Code   OptionCode
+	Reason string
+}
+
+func (e *OptionError) Error() string {
+	return fmt.Sprintf("Invalid %s option: %s", e.Code, e.Reason)
+}
+
+// Option returns the value of the first option with the given code.
+func (p *SettingsMessage) Option(code OptionCode) ([]byte, bool) {
+	for _, o := range p.Options {
+		if o.Code == code {
+			return o.Value, true
+		}
+	}
+	return nil, false
+}
+
+// SetOption replaces any options with the given code by a single option.
+// The option keeps the position of the first one replaced.
+func (p *SettingsMessage) SetOption(code OptionCode, value []byte) {
+	replaced := false
+	opts := p.Options[:0]
+	for _, o := range p.Options {
+		if o.Code != code {
+			opts = append(opts, o)
+		} else if !replaced {
+			opts = append(opts, Option{Code: code, Value: value})
+			replaced = true
+		}
+	}
+	p.Options = opts
+	if !replaced {
+		p.AddOption(Option{Code: code, Value: value})
+	}
+}
+
+// ValidateOptions checks every option with a defined encoding can be decoded.
+func (p *SettingsMessage) ValidateOptions() error {
+	for _, o := range p.Options {
+		var err error
+		switch o.Code {
+		case ServerIP:
+			_, err = decodeIP(o)
+		case IperfServerAddress, ClientSoftwareVersion:
+			_, err = decodeText(o)
+		case IperfServerPort:
+			_, err = decodeUint(o, 2)
+		case IperfServerVersion, ProtocolVersion:
+			_, err = decodeUint(o, 1)
+		case JobResourceDeadline:
+			_, err = decodeUint(o, 8)
+		case ClientSoftwareRepo:
+			_, err = decodeURL(o)
+		case HeartbeatDuration:
+			_, err = decodeUint(o, 4)
+		case JobSpec:
+			err = (&Job{}).UnmarshalBinary(o.Value)
+		case VendorOptions:
+			err = p.validateVendorOptions()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// option returns the first option with the given code or ErrNoOption.
+func (p *SettingsMessage) option(code OptionCode) (Option, error) {
+	v, ok := p.Option(code)
+	if !ok {
+		return Option{}, ErrNoOption
+	}
+	return Option{Code: code, Value: v}, nil
+}
+
+func (p *SettingsMessage) ServerIP() (net.IP, error) {
+	o, err := p.option(ServerIP)
+	if err != nil {
+		return nil, err
+	}
+	return decodeIP(o)
+}
+
+func (p *SettingsMessage) SetServerIP(ip net.IP) error {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	} else if ip = ip.To16(); ip == nil {
+		return &OptionError{Code: ServerIP, Reason: "not an IP address"}
+	}
+	p.SetOption(ServerIP, append([]byte(nil), ip...))
+	return nil
+}
+
+func (p *SettingsMessage) IperfServerAddress() (string, error) {
+	o, err := p.option(IperfServerAddress)
+	if err != nil {
+		return "", err
+	}
+	return decodeText(o)
+}
+
+func (p *SettingsMessage) SetIperfServerAddress(addr string) error {
+	return p.setText(IperfServerAddress, addr)
+}
+
+func (p *SettingsMessage) IperfServerPort() (uint16, error) {
+	o, err := p.option(IperfServerPort)
+	if err != nil {
+		return 0, err
+	}
+	v, err := decodeUint(o, 2)
+	return uint16(v), err
+}
+
+func (p *SettingsMessage) SetIperfServerPort(port uint16) {
+	b := make([]byte, 2)
+	binary.LittleEndian.PutUint16(b, port)
+	p.SetOption(IperfServerPort, b)
+}
+
+func (p *SettingsMessage) IperfServerVersion() (byte, error) {
+	o, err := p.option(IperfServerVersion)
+	if err != nil {
+		return 0, err
+	}
+	v, err := decodeUint(o, 1)
+	return byte(v), err
+}
+
+func (p *SettingsMessage) SetIperfServerVersion(v byte) {
+	p.SetOption(IperfServerVersion, []byte{v})
+}
+
+func (p *SettingsMessage) JobResourceDeadline() (time.Time, error) {
+	o, err := p.option(JobResourceDeadline)
+	if err != nil {
+		return time.Time{}, err
+	}
+	v, err := decodeUint(o, 8)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.UnixMilli(int64(v)), nil
+}
+
+func (p *SettingsMessage) SetJobResourceDeadline(t time.Time) {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, uint64(t.UnixMilli()))
+	p.SetOption(JobResourceDeadline, b)
+}
+
+func (p *SettingsMessage) ProtocolVersion() (byte, error) {
+	o, err := p.option(ProtocolVersion)
+	if err != nil {
+		return 0, err
+	}
+	v, err := decodeUint(o, 1)
+	return byte(v), err
+}
+
+func (p *SettingsMessage) SetProtocolVersion(v byte) {
+	p.SetOption(ProtocolVersion, []byte{v})
+}
+
+func (p *SettingsMessage) ClientSoftwareVersion() (string, error) {
+	o, err := p.option(ClientSoftwareVersion)
+	if err != nil {
+		return "", err
+	}
+	return decodeText(o)
+}
+
+func (p *SettingsMessage) SetClientSoftwareVersion(v string) error {
+	return p.setText(ClientSoftwareVersion, v)
+}
+
+// CompareVersions returns -1, 0 or 1 when the software version a is older
+// than, the same as or newer than b. Versions are compared as dot separated
+// numbers where possible, so 1.10.0 is newer than 1.9.2, and as text
+// otherwise. A leading "v" is ignored.
+func CompareVersions(a, b string) int {
+	as := strings.Split(strings.TrimPrefix(a, "v"), ".")
+	bs := strings.Split(strings.TrimPrefix(b, "v"), ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		x, xerr := strconv.ParseUint(as[i], 10, 64)
+		y, yerr := strconv.ParseUint(bs[i], 10, 64)
+		switch {
+		case xerr == nil && yerr == nil && x < y:
+			return -1
+		case xerr == nil && yerr == nil && x > y:
+			return 1
+		case xerr != nil || yerr != nil:
+			if c := strings.Compare(as[i], bs[i]); c != 0 {
+				return c
+			}
+		}
+	}
+	switch {
+	case len(as) < len(bs):
+		return -1
+	case len(as) > len(bs):
+		return 1
+	}
+	return 0
+}
+
+func (p *SettingsMessage) ClientSoftwareRepo() (*url.URL, error) {
+	o, err := p.option(ClientSoftwareRepo)
+	if err != nil {
+		return nil, err
+	}
+	return decodeURL(o)
+}
+
+// SetClientSoftwareRepo sets the repository URL, which must be absolute.
+func (p *SettingsMessage) SetClientSoftwareRepo(u *url.URL) error {
+	if u == nil || !u.IsAbs() || u.Host == "" {
+		return &OptionError{Code: ClientSoftwareRepo, Reason: "URL must be absolute"}
+	}
+	p.SetOption(ClientSoftwareRepo, []byte(u.String()))
+	return nil
+}
+
+func (p *SettingsMessage) HeartbeatDuration() (time.Duration, error) {
+	o, err := p.option(HeartbeatDuration)
+	if err != nil {
+		return 0, err
+	}
+	v, err := decodeUint(o, 4)
+	return time.Duration(v) * time.Millisecond, err
+}
+
+// SetHeartbeatDuration sets the heartbeat interval. It's sent with millisecond
+// precision and must be between 0 and math.MaxUint32 milliseconds.
+func (p *SettingsMessage) SetHeartbeatDuration(d time.Duration) error {
+	ms := d.Milliseconds()
+	if ms < 0 || ms > math.MaxUint32 {
+		return &OptionError{Code: HeartbeatDuration, Reason: "duration out of range"}
+	}
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, uint32(ms))
+	p.SetOption(HeartbeatDuration, b)
+	return nil
+}
+
+func (p *SettingsMessage) setText(code OptionCode, s string) error {
+	if s == "" || !utf8.ValidString(s) {
+		return &OptionError{Code: code, Reason: "must be non-empty UTF-8 text"}
+	}
+	p.SetOption(code, []byte(s))
+	return nil
+}
+
+func decodeIP(o Option) (net.IP, error) {
+	if len(o.Value) != net.IPv4len && len(o.Value) != net.IPv6len {
+		return nil, &OptionError{Code: o.Code, Reason: fmt.Sprintf("%d byte address", len(o.Value))}
+	}
+	return net.IP(o.Value), nil
+}
+
+func decodeText(o Option) (string, error) {
+	if len(o.Value) == 0 || !utf8.Valid(o.Value) {
+		return "", &OptionError{Code: o.Code, Reason: "must be non-empty UTF-8 text"}
+	}
+	return string(o.Value), nil
+}
+
+func decodeURL(o Option) (*url.URL, error) {
+	s, err := decodeText(o)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(s)
+	if err != nil || !u.IsAbs() || u.Host == "" {
+		return nil, &OptionError{Code: o.Code, Reason: "URL must be absolute"}
+	}
+	return u, nil
+}
+
+// decodeUint decodes a little endian unsigned integer of exactly size bytes.
+func decodeUint(o Option, size int) (uint64, error) {
+	if len(o.Value) != size {
+		return 0, &OptionError{Code: o.Code, Reason: fmt.Sprintf("expected %d bytes, got %d", size, len(o.Value))}
+	}
+	switch size {
+	case 1:
+		return uint64(o.Value[0]), nil
+	case 2:
+		return uint64(binary.LittleEndian.Uint16(o.Value)), nil
+	case 4:
+		return uint64(binary.LittleEndian.Uint32(o.Value)), nil
+	}
+	return binary.LittleEndian.Uint64(o.Value), nil
+}
@@ -0,0 +1,123 @@
+package npmp
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestTypedOptions(t *testing.T) {
+	m := NewSettingsMessage()
+	if _, err := m.ServerIP(); err != ErrNoOption {
+		t.Fatalf("Incorrect error. Expected ErrNoOption, got %v", err)
+	}
+
+	repo, _ := url.Parse("https://repo.example.com/client/latest")
+	deadline := time.UnixMilli(time.Now().UnixMilli())
+	if err := m.SetServerIP(net.ParseIP("10.0.0.1")); err != nil {
+		t.Fatalf("Failed to set ServerIP: %s", err)
+	}
+	if err := m.SetIperfServerAddress("iperf.example.com"); err != nil {
+		t.Fatalf("Failed to set IperfServerAddress: %s", err)
+	}
+	m.SetIperfServerPort(5201)
+	m.SetIperfServerVersion(3)
+	m.SetJobResourceDeadline(deadline)
+	m.SetProtocolVersion(1)
+	if err := m.SetClientSoftwareVersion("1.2.3"); err != nil {
+		t.Fatalf("Failed to set ClientSoftwareVersion: %s", err)
+	}
+	if err := m.SetClientSoftwareRepo(repo); err != nil {
+		t.Fatalf("Failed to set ClientSoftwareRepo: %s", err)
+	}
+	if err := m.SetHeartbeatDuration(30 * time.Second); err != nil {
+		t.Fatalf("Failed to set HeartbeatDuration: %s", err)
+	}
+	// Setting again replaces the option
+	if err := m.SetServerIP(net.ParseIP("2001:db8::1")); err != nil {
+		t.Fatalf("Failed to set ServerIP: %s", err)
+	}
+	if len(m.Options) != 9 {
+		t.Fatalf("Incorrect options length. Expected 9, got %d", len(m.Options))
+	}
+
+	s, err := ConvertToSettings(Message(m.Bytes()))
+	if err != nil {
+		t.Fatalf("Failed to process settings: %s", err)
+	}
+	if err := s.ValidateOptions(); err != nil {
+		t.Fatalf("Failed to validate options: %s", err)
+	}
+	if ip, _ := s.ServerIP(); !ip.Equal(net.ParseIP("2001:db8::1")) {
+		t.Fatalf("Incorrect ServerIP. Expected 2001:db8::1, got %s", ip)
+	}
+	if addr, _ := s.IperfServerAddress(); addr != "iperf.example.com" {
+		t.Fatalf("Incorrect IperfServerAddress. Expected iperf.example.com, got %s", addr)
+	}
+	if port, _ := s.IperfServerPort(); port != 5201 {
+		t.Fatalf("Incorrect IperfServerPort. Expected 5201, got %d", port)
+	}
+	if v, _ := s.IperfServerVersion(); v != 3 {
+		t.Fatalf("Incorrect IperfServerVersion. Expected 3, got %d", v)
+	}
+	if d, _ := s.JobResourceDeadline(); !d.Equal(deadline) {
+		t.Fatalf("Incorrect JobResourceDeadline. Expected %s, got %s", deadline, d)
+	}
+	if v, _ := s.ProtocolVersion(); v != 1 {
+		t.Fatalf("Incorrect ProtocolVersion. Expected 1, got %d", v)
+	}
+	if v, _ := s.ClientSoftwareVersion(); v != "1.2.3" {
+		t.Fatalf("Incorrect ClientSoftwareVersion. Expected 1.2.3, got %s", v)
+	}
+	if u, _ := s.ClientSoftwareRepo(); u.String() != repo.String() {
+		t.Fatalf("Incorrect ClientSoftwareRepo. Expected %s, got %s", repo, u)
+	}
+	if d, _ := s.HeartbeatDuration(); d != 30*time.Second {
+		t.Fatalf("Incorrect HeartbeatDuration. Expected 30s, got %s", d)
+	}
+}
+
+func TestTypedOptionErrors(t *testing.T) {
+	m := NewSettingsMessage()
+	m.AddOption(Option{Code: IperfServerPort, Value: []byte{1, 2, 3}})
+	var oerr *OptionError
+	if _, err := m.IperfServerPort(); !errors.As(err, &oerr) || oerr.Code != IperfServerPort {
+		t.Fatalf("Incorrect error. Expected OptionError, got %v", err)
+	}
+	if err := m.ValidateOptions(); !errors.As(err, &oerr) {
+		t.Fatalf("Incorrect error. Expected OptionError, got %v", err)
+	}
+
+	if err := m.SetServerIP(nil); !errors.As(err, &oerr) {
+		t.Fatalf("Incorrect error. Expected OptionError, got %v", err)
+	}
+	if err := m.SetClientSoftwareRepo(&url.URL{Path: "/relative"}); !errors.As(err, &oerr) {
+		t.Fatalf("Incorrect error. Expected OptionError, got %v", err)
+	}
+	if err := m.SetHeartbeatDuration(-time.Second); !errors.As(err, &oerr) {
+		t.Fatalf("Incorrect error. Expected OptionError, got %v", err)
+	}
+	if err := m.SetClientSoftwareVersion(""); !errors.As(err, &oerr) {
+		t.Fatalf("Incorrect error. Expected OptionError, got %v", err)
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		expected int
+	}{
+		{"1.9.2", "1.10.0", -1},
+		{"v1.10", "1.10", 0},
+		{"1.10.1", "1.10", 1},
+		{"2.0.0-rc1", "2.0.0-rc2", -1},
+		{"1.0", "", 1},
+	}
+	for _, tt := range tests {
+		if got := CompareVersions(tt.a, tt.b); got != tt.expected {
+			t.Fatalf("Incorrect result for %s and %s. Expected %d, got %d", tt.a, tt.b, tt.expected, got)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package npmp
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// MaxVersion is the highest protocol version understood by this package.
+// Messages with a higher version in their header are rejected by Parse,
+// except Version messages which are how the version is negotiated.
+//
+// Version 1 changed the interface records of a Register message to carry
+// IPv6 addresses. All other messages are identical to version 0. Version 2
+// adds sequence numbers to frames, see SeqVersion, and leaves the messages
+// as they are in version 1.
+const MaxVersion byte = 2
+
+// A VersionError is returned when a message header carries a protocol version
+// this package does not understand.
+type VersionError struct {
+	Version byte
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("Unsupported protocol version %d", e.Version)
+}
+
+// A CookieError is returned when a message header does not contain MagicCookie.
+type CookieError struct {
+	Cookie []byte
+}
+
+func (e *CookieError) Error() string {
+	return fmt.Sprintf("Invalid magic cookie %v", e.Cookie)
+}
+
+// An UnknownTypeError is returned when a message header carries a MessageType
+// not defined by the protocol.
+type UnknownTypeError struct {
+	Type MessageType
+}
+
+func (e *UnknownTypeError) Error() string {
+	return fmt.Sprintf("Unknown message type %d", byte(e.Type))
+}
+
+// Parse validates the header of b and returns the message wrapped in its
+// concrete type. Register and Settings messages are returned as pointers with
+// Process() already called. Disconnect, ACK and Null messages have no
+// dedicated type and are returned as a bare Message. The returned message
+// shares its underlying array with b.
+//
+// Every message is validated before it's returned so malformed or truncated
+// input results in an error, never a panic. Parse is safe to use on
+// untrusted data.
+func Parse(b []byte) (Messanger, error) {
+	p := Message(b)
+	if len(p) < headerLength {
+		return nil, &LengthError{Type: Null, Length: len(p), Min: headerLength}
+	}
+	if p.Version() > MaxVersion && p.MessageType() != Version {
+		return nil, &VersionError{Version: p.Version()}
+	}
+	if !bytes.Equal(p.Cookie(), MagicCookie) {
+		return nil, &CookieError{Cookie: append([]byte(nil), p.Cookie()...)}
+	}
+
+	var m Messanger
+	var err error
+	switch p.MessageType() {
+	case Register:
+		m, err = ConvertToRegister(p)
+	case Settings:
+		m, err = ConvertToSettings(p)
+	case Start:
+		m, err = ConvertToStart(p)
+	case End:
+		m, err = ConvertToEnd(p)
+	case Data:
+		m, err = ConvertToData(p)
+	case Inform:
+		m, err = ConvertToInform(p)
+	case NAK:
+		m, err = ConvertToNAK(p)
+	case Version:
+		m, err = ConvertToVersion(p)
+	case Null, Disconnect, ACK:
+		m, err = p, p.Validate()
+	default:
+		return nil, &UnknownTypeError{Type: p.MessageType()}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
@@ -0,0 +1,108 @@
+package npmp
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestParseTypes(t *testing.T) {
+	reg := NewRegisterMessage()
+	reg.AddInterface(&NetInterface{
+		Type:   WiredEthernet,
+		Haddr:  net.HardwareAddr([]byte{0xab, 0xcd, 0xef, 0x12, 0x34, 0x56}),
+		IPAddr: net.IP([]byte{10, 0, 0, 1}),
+	})
+	settings := NewSettingsMessage()
+
+	tests := []struct {
+		m        Messanger
+		expected MessageType
+	}{
+		{reg, Register},
+		{settings, Settings},
+		{NewStartMessage(), Start},
+		{NewEndMessage(), End},
+		{NewDataMessage(), Data},
+		{NewInformMessage(), Inform},
+		{NewNAKMessage(), NAK},
+		{NewDisconnectMessage(), Disconnect},
+		{NewVersionMessage(), Version},
+		{NewACKMessage(), ACK},
+		{newMessage(Null), Null},
+	}
+
+	for _, test := range tests {
+		m, err := Parse(test.m.Bytes())
+		if err != nil {
+			t.Fatalf("Failed to parse %s message: %s", test.expected, err)
+		}
+
+		var ok bool
+		switch test.expected {
+		case Register:
+			var r *RegisterMessage
+			r, ok = m.(*RegisterMessage)
+			if ok && len(r.Interfaces) != 1 {
+				t.Fatalf("Incorrect number of interfaces. Expected 1, got %d", len(r.Interfaces))
+			}
+		case Settings:
+			var s *SettingsMessage
+			s, ok = m.(*SettingsMessage)
+			if ok && len(s.Options) != 0 {
+				t.Fatalf("Incorrect options length. Expected 0, got %d", len(s.Options))
+			}
+		case Start:
+			_, ok = m.(StartMessage)
+		case End:
+			_, ok = m.(EndMessage)
+		case Data:
+			_, ok = m.(DataMessage)
+		case Inform:
+			_, ok = m.(InformMessage)
+		case NAK:
+			_, ok = m.(NAKMessage)
+		case Version:
+			_, ok = m.(VersionMessage)
+		default:
+			_, ok = m.(Message)
+		}
+		if !ok {
+			t.Fatalf("Incorrect concrete type for %s message, got %T", test.expected, m)
+		}
+		if !bytes.Equal(m.Bytes(), test.m.Bytes()) {
+			t.Fatalf("Incorrect bytes. Expected %v, got %v", test.m.Bytes(), m.Bytes())
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	m := NewACKMessage()
+	m.SetCookie([]byte{'X', 'X'})
+	_, err := Parse(m)
+	var cerr *CookieError
+	if !errors.As(err, &cerr) {
+		t.Fatalf("Incorrect error. Expected CookieError, got %v", err)
+	}
+
+	m = NewACKMessage()
+	m.SetMessageType(MessageType(200))
+	_, err = Parse(m)
+	var terr *UnknownTypeError
+	if !errors.As(err, &terr) || terr.Type != MessageType(200) {
+		t.Fatalf("Incorrect error. Expected UnknownTypeError, got %v", err)
+	}
+
+	m = NewACKMessage()
+	m.SetVersion(MaxVersion + 1)
+	_, err = Parse(m)
+	var verr *VersionError
+	if !errors.As(err, &verr) {
+		t.Fatalf("Incorrect error. Expected VersionError, got %v", err)
+	}
+
+	if _, err := Parse([]byte{0, 'P'}); err == nil {
+		t.Fatal("Expected error for short message")
+	}
+}
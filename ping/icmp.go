@@ -0,0 +1,125 @@
+package ping
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"time"
+)
+
+const (
+	icmpEchoRequest   = 8
+	icmpEchoReply     = 0
+	icmpv6EchoRequest = 128
+	icmpv6EchoReply   = 129
+	icmpHeaderLength  = 8
+)
+
+// icmpProber sends echo requests on a raw ICMP socket.
+type icmpProber struct {
+	conn    net.PacketConn
+	dst     *net.IPAddr
+	v6      bool
+	id      uint16
+	timeout time.Duration
+	buf     []byte
+}
+
+func openICMP(ctx context.Context, target string, timeout time.Duration) (*icmpProber, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host(target))
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, errors.New("No addresses for " + target)
+	}
+	p := &icmpProber{
+		dst:     &addrs[0],
+		v6:      addrs[0].IP.To4() == nil,
+		id:      uint16(rand.Intn(1 << 16)),
+		timeout: timeout,
+		buf:     make([]byte, 1500),
+	}
+	network := "ip4:icmp"
+	if p.v6 {
+		network = "ip6:ipv6-icmp"
+	}
+	if p.conn, err = net.ListenPacket(network, ""); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *icmpProber) probe(ctx context.Context, seq uint16) (time.Duration, bool, error) {
+	start := time.Now()
+	p.conn.SetDeadline(start.Add(p.timeout))
+	stop := context.AfterFunc(ctx, func() { p.conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	if _, err := p.conn.WriteTo(p.request(seq), p.dst); err != nil {
+		return 0, false, ctx.Err()
+	}
+	for {
+		n, from, err := p.conn.ReadFrom(p.buf)
+		if err != nil {
+			return 0, false, ctx.Err()
+		}
+		if ip, ok := from.(*net.IPAddr); ok && ip.IP.Equal(p.dst.IP) && p.isReply(p.buf[:n], seq) {
+			return time.Since(start), true, nil
+		}
+	}
+}
+
+func (p *icmpProber) Close() error { return p.conn.Close() }
+
+// request builds an echo request. The kernel fills in the checksum of ICMPv6
+// messages.
+func (p *icmpProber) request(seq uint16) []byte {
+	b := make([]byte, icmpHeaderLength, icmpHeaderLength+56)
+	b[0] = icmpEchoRequest
+	if p.v6 {
+		b[0] = icmpv6EchoRequest
+	}
+	b[4], b[5] = byte(p.id>>8), byte(p.id)
+	b[6], b[7] = byte(seq>>8), byte(seq)
+	b = append(b, payload(seq)...)
+	if !p.v6 {
+		cs := checksum(b)
+		b[2], b[3] = byte(cs>>8), byte(cs)
+	}
+	return b
+}
+
+// isReply reports whether b is the echo reply to the request with seq. The
+// socket receives every ICMP message for the host, including our own requests
+// when pinging a local address.
+func (p *icmpProber) isReply(b []byte, seq uint16) bool {
+	if len(b) < icmpHeaderLength {
+		return false
+	}
+	reply := byte(icmpEchoReply)
+	if p.v6 {
+		reply = icmpv6EchoReply
+	}
+	return b[0] == reply && b[1] == 0 &&
+		uint16(b[4])<<8|uint16(b[5]) == p.id &&
+		uint16(b[6])<<8|uint16(b[7]) == seq &&
+		bytes.Equal(b[icmpHeaderLength:], payload(seq))
+}
+
+// checksum is the Internet checksum of RFC 1071.
+func checksum(b []byte) uint16 {
+	var s uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		s += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		s += uint32(b[len(b)-1]) << 8
+	}
+	for s>>16 != 0 {
+		s = s&0xffff + s>>16
+	}
+	return ^uint16(s)
+}
@@ -0,0 +1,242 @@
+// Package ping runs Ping jobs. Probes are ICMP echo requests, TCP connects or
+// UDP datagrams according to the Transport of the job, and the results are
+// returned as Ping Data messages.
+package ping
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/usi-lfkeitel/npmp"
+	"github.com/usi-lfkeitel/npmp/client"
+)
+
+const (
+	DefaultTimeout  = time.Second
+	DefaultInterval = time.Second
+	DefaultTCPPort  = 80
+	DefaultUDPPort  = 33434
+)
+
+// ErrNotPing is returned when the Runner is given a job that isn't a Ping.
+var ErrNotPing = errors.New("Not a Ping job")
+
+// A Runner is a client.Runner for Ping jobs. The zero value probes with a one
+// second timeout and falls back to TCP when ICMP isn't permitted.
+type Runner struct {
+	// Timeout is how long to wait for each reply, DefaultTimeout if zero.
+	Timeout time.Duration
+
+	// Fallback is the transport used for ICMP jobs when raw ICMP sockets
+	// can't be opened, which usually needs root or CAP_NET_RAW. It's TCP
+	// by default. Set it to UDP, or to ICMP to disable the fallback.
+	Fallback npmp.Transport
+}
+
+// A prober sends a single probe and waits for the reply. ok is false if the
+// probe was lost, err is only set if probing can't continue.
+type prober interface {
+	probe(ctx context.Context, seq uint16) (rtt time.Duration, ok bool, err error)
+	Close() error
+}
+
+// Run pings the target of the job and returns the results as a Ping Data
+// message.
+func (r *Runner) Run(ctx context.Context, job *client.Job) (npmp.DataMessage, error) {
+	if job.Spec == nil {
+		return npmp.DataMessage{}, client.ErrNoJobSpec
+	}
+	res, err := r.Ping(ctx, job.Spec)
+	if err != nil {
+		return npmp.DataMessage{}, err
+	}
+	m := npmp.NewDataMessage()
+	m.SetJobID(job.ID)
+	if err := m.SetPingResult(res); err != nil {
+		return npmp.DataMessage{}, err
+	}
+	return m, nil
+}
+
+// Ping sends spec.Count probes to spec.Target, spec.Interval apart. The
+// target is a host, with a port for TCP and UDP probes. A TCP probe is
+// answered by either accepting or refusing the connection and a UDP probe by
+// any datagram or a port unreachable error.
+func (r *Runner) Ping(ctx context.Context, spec *npmp.Job) (*npmp.PingResult, error) {
+	if spec.Type != npmp.Ping {
+		return nil, ErrNotPing
+	}
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+
+	p, err := r.open(ctx, spec)
+	if err != nil {
+		return nil, err
+	}
+	defer p.Close()
+
+	interval := spec.Interval
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	res := &npmp.PingResult{Target: spec.Target}
+	next := time.Now()
+	for seq := uint16(0); seq < spec.Count; seq++ {
+		if seq > 0 {
+			next = next.Add(interval)
+			if err := sleep(ctx, time.Until(next)); err != nil {
+				return nil, err
+			}
+		}
+		rtt, ok, err := p.probe(ctx, seq)
+		if err != nil {
+			return nil, err
+		}
+		res.Samples = append(res.Samples, npmp.PingSample{Seq: seq, RTT: rtt, Lost: !ok})
+	}
+	res.Summarize()
+	return res, nil
+}
+
+func (r *Runner) open(ctx context.Context, spec *npmp.Job) (prober, error) {
+	timeout := r.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	transport := spec.Transport
+	if transport == npmp.ICMP {
+		p, err := openICMP(ctx, spec.Target, timeout)
+		if err == nil || r.Fallback == npmp.ICMP || !errors.Is(err, os.ErrPermission) {
+			return p, err
+		}
+		transport = r.Fallback
+	}
+
+	switch transport {
+	case npmp.TCP:
+		return &tcpProber{addr: target(spec.Target, DefaultTCPPort), timeout: timeout}, nil
+	case npmp.UDP:
+		return openUDP(ctx, target(spec.Target, DefaultUDPPort), timeout)
+	}
+	return nil, fmt.Errorf("Unsupported ping transport %s", transport)
+}
+
+// target adds the default port to a target without one.
+func target(t string, port int) string {
+	if _, _, err := net.SplitHostPort(t); err == nil {
+		return t
+	}
+	return net.JoinHostPort(t, strconv.Itoa(port))
+}
+
+// host strips the port from a target.
+func host(t string) string {
+	if h, _, err := net.SplitHostPort(t); err == nil {
+		return h
+	}
+	return t
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// answered reports whether a probe error still proves the target is up.
+func answered(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// tcpProber times TCP connection setup.
+type tcpProber struct {
+	addr    string
+	timeout time.Duration
+}
+
+func (p *tcpProber) probe(ctx context.Context, seq uint16) (time.Duration, bool, error) {
+	d := net.Dialer{Timeout: p.timeout}
+	start := time.Now()
+	conn, err := d.DialContext(ctx, "tcp", p.addr)
+	rtt := time.Since(start)
+	if ctx.Err() != nil {
+		return 0, false, ctx.Err()
+	}
+	if err != nil {
+		if answered(err) {
+			return rtt, true, nil
+		}
+		return 0, false, nil
+	}
+	conn.Close()
+	return rtt, true, nil
+}
+
+func (p *tcpProber) Close() error { return nil }
+
+// udpProber sends datagrams on a connected UDP socket.
+type udpProber struct {
+	conn    net.Conn
+	timeout time.Duration
+	buf     []byte
+}
+
+func openUDP(ctx context.Context, addr string, timeout time.Duration) (*udpProber, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &udpProber{conn: conn, timeout: timeout, buf: make([]byte, 1500)}, nil
+}
+
+func (p *udpProber) probe(ctx context.Context, seq uint16) (time.Duration, bool, error) {
+	start := time.Now()
+	p.conn.SetDeadline(start.Add(p.timeout))
+	stop := context.AfterFunc(ctx, func() { p.conn.SetDeadline(time.Now()) })
+	defer stop()
+	if _, err := p.conn.Write(payload(seq)); err != nil {
+		if answered(err) {
+			// The unreachable error of an earlier probe; this one can't
+			// be timed.
+			return 0, false, nil
+		}
+		return 0, false, ctx.Err()
+	}
+	_, err := p.conn.Read(p.buf)
+	rtt := time.Since(start)
+	if ctx.Err() != nil {
+		return 0, false, ctx.Err()
+	}
+	if err == nil || answered(err) {
+		return rtt, true, nil
+	}
+	return 0, false, nil
+}
+
+func (p *udpProber) Close() error { return p.conn.Close() }
+
+// payload returns the probe data, the sequence number padded to the 56 bytes
+// ping sends by default.
+func payload(seq uint16) []byte {
+	b := make([]byte, 56)
+	b[0], b[1] = byte(seq>>8), byte(seq)
+	copy(b[2:], "npmp")
+	return b
+}
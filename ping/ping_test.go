@@ -0,0 +1,153 @@
+package ping
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/usi-lfkeitel/npmp"
+	"github.com/usi-lfkeitel/npmp/client"
+)
+
+func TestChecksum(t *testing.T) {
+	// Echo request with ID 1 and sequence 1 and no data.
+	b := []byte{8, 0, 0, 0, 0, 1, 0, 1}
+	if cs := checksum(b); cs != 0xf7fd {
+		t.Fatalf("Incorrect checksum. Expected 0xf7fd, got %#04x", cs)
+	}
+	b[2], b[3] = 0xf7, 0xfd
+	if cs := checksum(b); cs != 0 {
+		t.Fatalf("Incorrect checksum of checksummed message. Expected 0, got %#04x", cs)
+	}
+}
+
+func TestPingTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	r := &Runner{}
+	spec := &npmp.Job{ID: []byte{1, 2, 3, 4}, Type: npmp.Ping, Transport: npmp.TCP,
+		Target: l.Addr().String(), Count: 3, Interval: 10 * time.Millisecond}
+	res, err := r.Ping(context.Background(), spec)
+	if err != nil {
+		t.Fatalf("Failed to ping: %s", err)
+	}
+	if res.Sent != 3 || res.Received != 3 || len(res.Samples) != 3 || res.Samples[2].Seq != 2 {
+		t.Fatalf("Incorrect result: %+v", res)
+	}
+	if res.Min <= 0 || res.Max < res.Min {
+		t.Fatalf("Incorrect round trip times: min %s, max %s", res.Min, res.Max)
+	}
+
+	// A refused connection is still an answer.
+	addr := l.Addr().String()
+	l.Close()
+	spec.Target = addr
+	if res, err = r.Ping(context.Background(), spec); err != nil {
+		t.Fatalf("Failed to ping: %s", err)
+	}
+	if res.Received != 3 {
+		t.Fatalf("Incorrect received. Expected 3, got %d", res.Received)
+	}
+}
+
+func TestPingUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	defer conn.Close()
+
+	// Nothing answers, every probe is lost.
+	r := &Runner{Timeout: 20 * time.Millisecond}
+	spec := &npmp.Job{ID: []byte{1, 2, 3, 4}, Type: npmp.Ping, Transport: npmp.UDP,
+		Target: conn.LocalAddr().String(), Count: 2, Interval: time.Millisecond}
+	res, err := r.Ping(context.Background(), spec)
+	if err != nil {
+		t.Fatalf("Failed to ping: %s", err)
+	}
+	if res.Sent != 2 || res.Received != 0 || res.Loss() != 100 || !res.Samples[0].Lost {
+		t.Fatalf("Incorrect result: %+v", res)
+	}
+
+	// An echo server answers every probe.
+	go func() {
+		b := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(b[:n], from)
+		}
+	}()
+	r.Timeout = time.Second
+	if res, err = r.Ping(context.Background(), spec); err != nil {
+		t.Fatalf("Failed to ping: %s", err)
+	}
+	if res.Received != 2 {
+		t.Fatalf("Incorrect received. Expected 2, got %d", res.Received)
+	}
+}
+
+func TestRun(t *testing.T) {
+	// Without privileges the ICMP job falls back to TCP, where the refused
+	// connection counts as an answer. Either way localhost answers.
+	job := &client.Job{
+		ID: []byte{5, 6, 7, 8},
+		Spec: &npmp.Job{ID: []byte{5, 6, 7, 8}, Type: npmp.Ping, Transport: npmp.ICMP,
+			Target: "127.0.0.1", Count: 2, Interval: 10 * time.Millisecond},
+	}
+	m, err := (&Runner{}).Run(context.Background(), job)
+	if err != nil {
+		t.Fatalf("Failed to run job: %s", err)
+	}
+	if string(m.JobID()) != string(job.ID) {
+		t.Fatalf("Incorrect job ID. Expected %v, got %v", job.ID, m.JobID())
+	}
+	res, err := m.PingResult()
+	if err != nil {
+		t.Fatalf("Failed to decode result: %s", err)
+	}
+	if res.Target != "127.0.0.1" || res.Sent != 2 || res.Received != 2 {
+		t.Fatalf("Incorrect result: %+v", res)
+	}
+
+	job.Spec.Type = npmp.Iperf3
+	if _, err := (&Runner{}).Run(context.Background(), job); err != ErrNotPing {
+		t.Fatalf("Incorrect error. Expected ErrNotPing, got %v", err)
+	}
+}
+
+func TestPingCancel(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	spec := &npmp.Job{ID: []byte{1, 2, 3, 4}, Type: npmp.Ping, Transport: npmp.UDP,
+		Target: conn.LocalAddr().String(), Count: 100}
+	start := time.Now()
+	if _, err := (&Runner{}).Ping(ctx, spec); err != context.DeadlineExceeded {
+		t.Fatalf("Incorrect error. Expected DeadlineExceeded, got %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("Ping took %s to stop after cancel", d)
+	}
+}
@@ -0,0 +1,460 @@
+package npmp
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"time"
+)
+
+// Result encodings
+//
+// PingResult, IperfResult and UpdateResult are carried in the data of Data
+// messages of the matching DataType. The encodings start with a version byte,
+// currently 1, and use little endian integers. Durations are int64
+// nanoseconds, floats are IEEE 754 float64 and text is a uint16 length
+// followed by UTF-8. Lists are a uint32 count followed by the items.
+
+// resultVersion is the version of the result encodings.
+const resultVersion = 1
+
+// ErrIncorrectDataType is returned when decoding a result from a Data message
+// of a different DataType.
+var ErrIncorrectDataType = errors.New("Incorrect data type")
+
+// ErrInvalidResult is returned when result data is truncated or malformed.
+var ErrInvalidResult = errors.New("Invalid result data")
+
+// ErrUnknownResultVersion is returned when result data was encoded with a
+// newer version of the format.
+var ErrUnknownResultVersion = errors.New("Unknown result version")
+
+// A PingSample is the outcome of a single echo request.
+type PingSample struct {
+	Seq  uint16
+	RTT  time.Duration
+	Lost bool
+}
+
+// A PingResult holds the results of a Ping job.
+type PingResult struct {
+	Target   string
+	Sent     uint32
+	Received uint32
+	Min      time.Duration
+	Avg      time.Duration
+	Max      time.Duration
+	Mdev     time.Duration // Mean deviation of the round trip times
+	Samples  []PingSample
+}
+
+// Loss returns the percentage of probes which were lost.
+func (r *PingResult) Loss() float64 {
+	if r.Sent == 0 {
+		return 0
+	}
+	return float64(r.Sent-r.Received) / float64(r.Sent) * 100
+}
+
+// Summarize sets the counts and round trip statistics from Samples.
+func (r *PingResult) Summarize() {
+	r.Sent, r.Received = uint32(len(r.Samples)), 0
+	r.Min, r.Avg, r.Max, r.Mdev = 0, 0, 0, 0
+
+	var sum time.Duration
+	for _, s := range r.Samples {
+		if s.Lost {
+			continue
+		}
+		if r.Received == 0 || s.RTT < r.Min {
+			r.Min = s.RTT
+		}
+		if s.RTT > r.Max {
+			r.Max = s.RTT
+		}
+		sum += s.RTT
+		r.Received++
+	}
+	if r.Received == 0 {
+		return
+	}
+	r.Avg = sum / time.Duration(r.Received)
+
+	var dev time.Duration
+	for _, s := range r.Samples {
+		if s.Lost {
+			continue
+		}
+		if d := s.RTT - r.Avg; d < 0 {
+			dev -= d
+		} else {
+			dev += d
+		}
+	}
+	r.Mdev = dev / time.Duration(r.Received)
+}
+
+// MarshalBinary encodes the result.
+func (r *PingResult) MarshalBinary() ([]byte, error) {
+	e := &resultEncoder{}
+	e.uint8(resultVersion)
+	e.text(r.Target)
+	e.uint32(r.Sent)
+	e.uint32(r.Received)
+	e.duration(r.Min)
+	e.duration(r.Avg)
+	e.duration(r.Max)
+	e.duration(r.Mdev)
+	e.uint32(uint32(len(r.Samples)))
+	for _, s := range r.Samples {
+		e.uint16(s.Seq)
+		e.duration(s.RTT)
+		e.bool(s.Lost)
+	}
+	return e.b, e.err
+}
+
+// UnmarshalBinary decodes a result encoded by MarshalBinary.
+func (r *PingResult) UnmarshalBinary(b []byte) error {
+	d := &resultDecoder{b: b}
+	if err := d.version(); err != nil {
+		return err
+	}
+	res := PingResult{
+		Target:   d.text(),
+		Sent:     d.uint32(),
+		Received: d.uint32(),
+		Min:      d.duration(),
+		Avg:      d.duration(),
+		Max:      d.duration(),
+		Mdev:     d.duration(),
+	}
+	n := d.count(2 + 8 + 1)
+	for i := 0; i < n; i++ {
+		res.Samples = append(res.Samples, PingSample{
+			Seq:  d.uint16(),
+			RTT:  d.duration(),
+			Lost: d.bool(),
+		})
+	}
+	if err := d.finish(); err != nil {
+		return err
+	}
+	*r = res
+	return nil
+}
+
+// An IperfSummary holds totals for one direction of an iperf test as seen by
+// either the sender or the receiver.
+type IperfSummary struct {
+	Bytes         uint64
+	BitsPerSecond float64
+	Retransmits   uint32        // TCP only
+	Jitter        time.Duration // UDP only
+	LostPackets   uint64        // UDP only
+	Packets       uint64        // UDP only
+}
+
+// LostPercent returns the percentage of UDP packets which were lost.
+func (s *IperfSummary) LostPercent() float64 {
+	if s.Packets == 0 {
+		return 0
+	}
+	return float64(s.LostPackets) / float64(s.Packets) * 100
+}
+
+// An IperfInterval holds the statistics of one reporting interval.
+type IperfInterval struct {
+	Start         time.Duration // Offset from the start of the test
+	End           time.Duration
+	Bytes         uint64
+	BitsPerSecond float64
+	Retransmits   uint32
+	Reverse       bool // Traffic flowed from the server to the client
+}
+
+// An IperfResult holds the results of an Iperf2 or Iperf3 job, or of the
+// built in throughput test.
+type IperfResult struct {
+	Transport     Transport
+	Reverse       bool
+	Bidirectional bool
+	Parallel      uint8
+	Start         time.Time
+	Duration      time.Duration
+
+	Sent     IperfSummary // Traffic in the test direction as seen by the sender
+	Received IperfSummary // Traffic in the test direction as seen by the receiver
+
+	// Traffic in the opposite direction of a bidirectional test.
+	ReverseSent     IperfSummary
+	ReverseReceived IperfSummary
+
+	Intervals []IperfInterval
+}
+
+// MarshalBinary encodes the result.
+func (r *IperfResult) MarshalBinary() ([]byte, error) {
+	e := &resultEncoder{}
+	e.uint8(resultVersion)
+	e.uint8(byte(r.Transport))
+	e.bool(r.Reverse)
+	e.bool(r.Bidirectional)
+	e.uint8(r.Parallel)
+	e.time(r.Start)
+	e.duration(r.Duration)
+	for _, s := range []*IperfSummary{&r.Sent, &r.Received, &r.ReverseSent, &r.ReverseReceived} {
+		e.uint64(s.Bytes)
+		e.float64(s.BitsPerSecond)
+		e.uint32(s.Retransmits)
+		e.duration(s.Jitter)
+		e.uint64(s.LostPackets)
+		e.uint64(s.Packets)
+	}
+	e.uint32(uint32(len(r.Intervals)))
+	for _, i := range r.Intervals {
+		e.duration(i.Start)
+		e.duration(i.End)
+		e.uint64(i.Bytes)
+		e.float64(i.BitsPerSecond)
+		e.uint32(i.Retransmits)
+		e.bool(i.Reverse)
+	}
+	return e.b, e.err
+}
+
+// UnmarshalBinary decodes a result encoded by MarshalBinary.
+func (r *IperfResult) UnmarshalBinary(b []byte) error {
+	d := &resultDecoder{b: b}
+	if err := d.version(); err != nil {
+		return err
+	}
+	res := IperfResult{
+		Transport:     Transport(d.uint8()),
+		Reverse:       d.bool(),
+		Bidirectional: d.bool(),
+		Parallel:      d.uint8(),
+		Start:         d.time(),
+		Duration:      d.duration(),
+	}
+	for _, s := range []*IperfSummary{&res.Sent, &res.Received, &res.ReverseSent, &res.ReverseReceived} {
+		*s = IperfSummary{
+			Bytes:         d.uint64(),
+			BitsPerSecond: d.float64(),
+			Retransmits:   d.uint32(),
+			Jitter:        d.duration(),
+			LostPackets:   d.uint64(),
+			Packets:       d.uint64(),
+		}
+	}
+	n := d.count(8 + 8 + 8 + 8 + 4 + 1)
+	for i := 0; i < n; i++ {
+		res.Intervals = append(res.Intervals, IperfInterval{
+			Start:         d.duration(),
+			End:           d.duration(),
+			Bytes:         d.uint64(),
+			BitsPerSecond: d.float64(),
+			Retransmits:   d.uint32(),
+			Reverse:       d.bool(),
+		})
+	}
+	if err := d.finish(); err != nil {
+		return err
+	}
+	*r = res
+	return nil
+}
+
+// An UpdateResult reports the outcome of a client software update. It is
+// sent in a SoftwareUpdate Data message, which isn't part of a job and has a
+// zero job ID.
+type UpdateResult struct {
+	Version string // Version the client updated to
+	Error   string // Why the update failed, empty on success
+}
+
+// MarshalBinary encodes the result.
+func (r *UpdateResult) MarshalBinary() ([]byte, error) {
+	e := &resultEncoder{}
+	e.uint8(resultVersion)
+	e.text(r.Version)
+	e.text(r.Error)
+	return e.b, e.err
+}
+
+// UnmarshalBinary decodes a result encoded by MarshalBinary.
+func (r *UpdateResult) UnmarshalBinary(b []byte) error {
+	d := &resultDecoder{b: b}
+	if err := d.version(); err != nil {
+		return err
+	}
+	res := UpdateResult{Version: d.text(), Error: d.text()}
+	if err := d.finish(); err != nil {
+		return err
+	}
+	*r = res
+	return nil
+}
+
+// PingResult decodes the data of a Ping Data message.
+func (p DataMessage) PingResult() (*PingResult, error) {
+	if p.Type() != Ping {
+		return nil, ErrIncorrectDataType
+	}
+	r := &PingResult{}
+	if err := r.UnmarshalBinary(p.Data()); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// SetPingResult sets the data type to Ping and the data to the encoded result.
+func (p *DataMessage) SetPingResult(r *PingResult) error {
+	b, err := r.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	p.SetDataType(Ping)
+	p.SetData(b)
+	return nil
+}
+
+// IperfResult decodes the data of an Iperf2 or Iperf3 Data message.
+func (p DataMessage) IperfResult() (*IperfResult, error) {
+	if p.Type() != Iperf2 && p.Type() != Iperf3 {
+		return nil, ErrIncorrectDataType
+	}
+	r := &IperfResult{}
+	if err := r.UnmarshalBinary(p.Data()); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// SetIperfResult sets the data type to t, which must be Iperf2 or Iperf3, and
+// the data to the encoded result.
+func (p *DataMessage) SetIperfResult(t DataType, r *IperfResult) error {
+	if t != Iperf2 && t != Iperf3 {
+		return ErrIncorrectDataType
+	}
+	b, err := r.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	p.SetDataType(t)
+	p.SetData(b)
+	return nil
+}
+
+// UpdateResult decodes the data of a SoftwareUpdate Data message.
+func (p DataMessage) UpdateResult() (*UpdateResult, error) {
+	if p.Type() != SoftwareUpdate {
+		return nil, ErrIncorrectDataType
+	}
+	r := &UpdateResult{}
+	if err := r.UnmarshalBinary(p.Data()); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// SetUpdateResult sets the data type to SoftwareUpdate and the data to the
+// encoded result.
+func (p *DataMessage) SetUpdateResult(r *UpdateResult) error {
+	b, err := r.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	p.SetDataType(SoftwareUpdate)
+	p.SetData(b)
+	return nil
+}
+
+// resultEncoder appends little endian values to a buffer.
+type resultEncoder struct {
+	b   []byte
+	err error
+}
+
+func (e *resultEncoder) uint8(v uint8)   { e.b = append(e.b, v) }
+func (e *resultEncoder) uint16(v uint16) { e.b = binary.LittleEndian.AppendUint16(e.b, v) }
+func (e *resultEncoder) uint32(v uint32) { e.b = binary.LittleEndian.AppendUint32(e.b, v) }
+func (e *resultEncoder) uint64(v uint64) { e.b = binary.LittleEndian.AppendUint64(e.b, v) }
+
+func (e *resultEncoder) float64(v float64)        { e.uint64(math.Float64bits(v)) }
+func (e *resultEncoder) duration(v time.Duration) { e.uint64(uint64(v)) }
+func (e *resultEncoder) time(v time.Time)         { e.uint64(uint64(unixMilli(v))) }
+
+func (e *resultEncoder) bool(v bool) {
+	if v {
+		e.uint8(1)
+	} else {
+		e.uint8(0)
+	}
+}
+
+func (e *resultEncoder) text(s string) {
+	if len(s) > math.MaxUint16 {
+		e.err = ErrInvalidResult
+		return
+	}
+	e.uint16(uint16(len(s)))
+	e.b = append(e.b, s...)
+}
+
+// resultDecoder reads little endian values from a buffer. Reading past the
+// end sets err and returns zero values so a decode can check once at the end.
+type resultDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *resultDecoder) next(n int) []byte {
+	if d.err != nil || len(d.b) < n {
+		d.err = ErrInvalidResult
+		return make([]byte, n)
+	}
+	b := d.b[:n]
+	d.b = d.b[n:]
+	return b
+}
+
+func (d *resultDecoder) version() error {
+	if len(d.b) == 0 {
+		return ErrInvalidResult
+	}
+	if d.uint8() != resultVersion {
+		return ErrUnknownResultVersion
+	}
+	return nil
+}
+
+func (d *resultDecoder) uint8() uint8   { return d.next(1)[0] }
+func (d *resultDecoder) uint16() uint16 { return binary.LittleEndian.Uint16(d.next(2)) }
+func (d *resultDecoder) uint32() uint32 { return binary.LittleEndian.Uint32(d.next(4)) }
+func (d *resultDecoder) uint64() uint64 { return binary.LittleEndian.Uint64(d.next(8)) }
+
+func (d *resultDecoder) float64() float64        { return math.Float64frombits(d.uint64()) }
+func (d *resultDecoder) duration() time.Duration { return time.Duration(d.uint64()) }
+func (d *resultDecoder) time() time.Time         { return fromUnixMilli(int64(d.uint64())) }
+func (d *resultDecoder) bool() bool              { return d.uint8() != 0 }
+func (d *resultDecoder) text() string            { return string(d.next(int(d.uint16()))) }
+
+// count reads a list length and checks the remaining data can hold that many
+// items of size bytes each.
+func (d *resultDecoder) count(size int) int {
+	n := d.uint32()
+	if d.err != nil || uint64(n)*uint64(size) > uint64(len(d.b)) {
+		d.err = ErrInvalidResult
+		return 0
+	}
+	return int(n)
+}
+
+// finish returns any error and checks all data was consumed.
+func (d *resultDecoder) finish() error {
+	if d.err == nil && len(d.b) != 0 {
+		d.err = ErrInvalidResult
+	}
+	return d.err
+}
@@ -0,0 +1,119 @@
+package npmp
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPingResult(t *testing.T) {
+	r := &PingResult{
+		Target: "192.0.2.1",
+		Samples: []PingSample{
+			{Seq: 0, RTT: 10 * time.Millisecond},
+			{Seq: 1, Lost: true},
+			{Seq: 2, RTT: 20 * time.Millisecond},
+			{Seq: 3, RTT: 30 * time.Millisecond},
+		},
+	}
+	r.Summarize()
+	if r.Sent != 4 || r.Received != 3 {
+		t.Fatalf("Incorrect counts. Expected 4 sent and 3 received, got %d and %d", r.Sent, r.Received)
+	}
+	if r.Min != 10*time.Millisecond || r.Avg != 20*time.Millisecond || r.Max != 30*time.Millisecond {
+		t.Fatalf("Incorrect RTTs. Expected 10ms/20ms/30ms, got %s/%s/%s", r.Min, r.Avg, r.Max)
+	}
+	if r.Mdev != 20*time.Millisecond/3 {
+		t.Fatalf("Incorrect mdev. Expected %s, got %s", 20*time.Millisecond/3, r.Mdev)
+	}
+	if r.Loss() != 25 {
+		t.Fatalf("Incorrect loss. Expected 25, got %f", r.Loss())
+	}
+
+	m := NewDataMessage()
+	if err := m.SetPingResult(r); err != nil {
+		t.Fatalf("Failed to set ping result: %s", err)
+	}
+	p, err := Parse(m.Bytes())
+	if err != nil {
+		t.Fatalf("Failed to parse message: %s", err)
+	}
+	dm := p.(DataMessage)
+	if dm.Type() != Ping {
+		t.Fatalf("Incorrect data type. Expected Ping, got %s", dm.Type())
+	}
+	decoded, err := dm.PingResult()
+	if err != nil {
+		t.Fatalf("Failed to decode ping result: %s", err)
+	}
+	if !reflect.DeepEqual(decoded, r) {
+		t.Fatalf("Incorrect ping result. Expected %+v, got %+v", r, decoded)
+	}
+	if _, err := dm.IperfResult(); err != ErrIncorrectDataType {
+		t.Fatalf("Incorrect error. Expected ErrIncorrectDataType, got %v", err)
+	}
+}
+
+func TestIperfResult(t *testing.T) {
+	r := &IperfResult{
+		Transport:     UDP,
+		Bidirectional: true,
+		Parallel:      2,
+		Start:         time.UnixMilli(time.Now().UnixMilli()),
+		Duration:      10 * time.Second,
+		Sent:          IperfSummary{Bytes: 1 << 30, BitsPerSecond: 858993459.2, Packets: 1000},
+		Received:      IperfSummary{Bytes: 1 << 29, BitsPerSecond: 429496729.6, Jitter: 1500 * time.Microsecond, LostPackets: 5, Packets: 1000},
+		ReverseSent:   IperfSummary{Bytes: 1 << 20, BitsPerSecond: 838860.8},
+		Intervals: []IperfInterval{
+			{Start: 0, End: time.Second, Bytes: 1 << 27, BitsPerSecond: 1073741824},
+			{Start: 0, End: time.Second, Bytes: 1 << 17, BitsPerSecond: 1048576, Reverse: true},
+		},
+	}
+	if r.Received.LostPercent() != 0.5 {
+		t.Fatalf("Incorrect lost percent. Expected 0.5, got %f", r.Received.LostPercent())
+	}
+
+	m := NewDataMessage()
+	if err := m.SetIperfResult(Ping, r); err != ErrIncorrectDataType {
+		t.Fatalf("Incorrect error. Expected ErrIncorrectDataType, got %v", err)
+	}
+	if err := m.SetIperfResult(Iperf3, r); err != nil {
+		t.Fatalf("Failed to set iperf result: %s", err)
+	}
+	decoded, err := m.IperfResult()
+	if err != nil {
+		t.Fatalf("Failed to decode iperf result: %s", err)
+	}
+	if !reflect.DeepEqual(decoded, r) {
+		t.Fatalf("Incorrect iperf result. Expected %+v, got %+v", r, decoded)
+	}
+
+	// Truncated data must fail without panicking
+	b := m.Data()
+	for i := 0; i < len(b); i++ {
+		if err := (&IperfResult{}).UnmarshalBinary(b[:i]); err == nil {
+			t.Fatalf("Expected error decoding %d of %d bytes", i, len(b))
+		}
+	}
+}
+
+func TestUpdateResult(t *testing.T) {
+	r := &UpdateResult{Version: "1.1.0", Error: "Checksum mismatch"}
+	m := NewDataMessage()
+	if _, err := m.UpdateResult(); err != ErrIncorrectDataType {
+		t.Fatalf("Incorrect error. Expected ErrIncorrectDataType, got %v", err)
+	}
+	if err := m.SetUpdateResult(r); err != nil {
+		t.Fatalf("Failed to set update result: %s", err)
+	}
+	if m.Type() != SoftwareUpdate {
+		t.Fatalf("Incorrect data type. Expected %s, got %s", SoftwareUpdate, m.Type())
+	}
+	decoded, err := m.UpdateResult()
+	if err != nil {
+		t.Fatalf("Failed to decode update result: %s", err)
+	}
+	if !reflect.DeepEqual(decoded, r) {
+		t.Fatalf("Incorrect update result. Expected %+v, got %+v", r, decoded)
+	}
+}
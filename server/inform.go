@@ -0,0 +1,85 @@
+package server
+
+import "github.com/usi-lfkeitel/npmp"
+
+// An OptionProvider supplies the options a client requests with an Inform
+// message.
+type OptionProvider interface {
+	// Option returns the value of the option with the code for the
+	// session, false if it has none.
+	Option(s *Session, code npmp.OptionCode) ([]byte, bool)
+}
+
+// The OptionProviderFunc type is an adapter to allow the use of ordinary
+// functions as OptionProviders.
+type OptionProviderFunc func(s *Session, code npmp.OptionCode) ([]byte, bool)
+
+// Option calls f(s, code).
+func (f OptionProviderFunc) Option(s *Session, code npmp.OptionCode) ([]byte, bool) {
+	return f(s, code)
+}
+
+// sentOptions is the OptionProvider used when a Server has none. It answers
+// with the options last sent to the client.
+var sentOptions = OptionProviderFunc(func(s *Session, code npmp.OptionCode) ([]byte, bool) {
+	return s.SentOption(code)
+})
+
+// SentOption returns the value of the option with the code in the latest
+// Settings message sent to the client which carried it.
+func (s *Session) SentOption(code npmp.OptionCode) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.sent[code]
+	return v, ok
+}
+
+// recordOptions remembers the options of a Settings message sent to the
+// client.
+func (s *Session) recordOptions(m npmp.Messanger) {
+	settings, ok := m.(*npmp.SettingsMessage)
+	if !ok {
+		return
+	}
+	done := make(map[npmp.OptionCode]bool)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, o := range settings.Options {
+		// Like SettingsMessage.Option, the first option with a code wins.
+		if !done[o.Code] {
+			s.sent[o.Code] = append([]byte(nil), o.Value...)
+			done[o.Code] = true
+		}
+	}
+}
+
+// answerInform builds the Settings message answering an Inform. It holds
+// exactly the requested options and is nil if any of them is unknown or
+// can't be provided.
+func (s *Session) answerInform(m npmp.InformMessage) *npmp.SettingsMessage {
+	p := s.srv.Options
+	if p == nil {
+		p = sentOptions
+	}
+	reply := npmp.NewSettingsMessage()
+	for _, code := range m.Options() {
+		if !definedOption(code) {
+			return nil
+		}
+		if _, dup := reply.Option(code); dup {
+			continue
+		}
+		v, ok := p.Option(s, code)
+		if !ok {
+			return nil
+		}
+		reply.AddOption(npmp.Option{Code: code, Value: v})
+	}
+	return reply
+}
+
+// definedOption reports whether code is an option rather than a framing
+// code or one this package doesn't know.
+func definedOption(code npmp.OptionCode) bool {
+	return code >= npmp.ServerIP && code <= npmp.HeartbeatDuration
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/usi-lfkeitel/npmp"
+)
+
+func TestSessionInform(t *testing.T) {
+	srv := &Server{Heartbeat: time.Hour}
+	c := dialTest(t, startServer(t, srv))
+	c.register()
+
+	// The options sent at registration are answered by default.
+	m := npmp.NewInformMessage()
+	m.SetOptions([]npmp.OptionCode{npmp.HeartbeatDuration, npmp.HeartbeatDuration})
+	c.send(m)
+	reply := c.expect(npmp.Settings).(*npmp.SettingsMessage)
+	if len(reply.Options) != 1 {
+		t.Fatalf("Incorrect number of options. Expected 1, got %d", len(reply.Options))
+	}
+	if d, err := reply.HeartbeatDuration(); err != nil || d != time.Hour {
+		t.Fatalf("Incorrect heartbeat. Expected 1h, got %s (%v)", d, err)
+	}
+
+	for _, code := range []npmp.OptionCode{npmp.ServerIP, npmp.Pad, 200} {
+		m.SetOptions([]npmp.OptionCode{npmp.HeartbeatDuration, code})
+		c.send(m)
+		c.expectNAK(npmp.InvalidData)
+	}
+}
+
+func TestSessionInformProvider(t *testing.T) {
+	srv := &Server{
+		Options: OptionProviderFunc(func(s *Session, code npmp.OptionCode) ([]byte, bool) {
+			if code == npmp.IperfServerAddress {
+				return []byte("iperf.example.com"), true
+			}
+			return s.SentOption(code)
+		}),
+	}
+	c := dialTest(t, startServer(t, srv))
+	c.register()
+
+	m := npmp.NewInformMessage()
+	m.SetOptions([]npmp.OptionCode{npmp.IperfServerAddress, npmp.ProtocolVersion})
+	c.send(m)
+	reply := c.expect(npmp.Settings).(*npmp.SettingsMessage)
+	if len(reply.Options) != 2 {
+		t.Fatalf("Incorrect number of options. Expected 2, got %d", len(reply.Options))
+	}
+	if addr, err := reply.IperfServerAddress(); err != nil || addr != "iperf.example.com" {
+		t.Fatalf("Incorrect address. Expected iperf.example.com, got %q (%v)", addr, err)
+	}
+	if _, err := reply.ProtocolVersion(); err != nil {
+		t.Fatalf("Incorrect protocol version: %s", err)
+	}
+}
@@ -0,0 +1,211 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/usi-lfkeitel/npmp"
+)
+
+// DefaultLeaseDuration is how long a port is leased to a job without a
+// deadline.
+const DefaultLeaseDuration = 5 * time.Minute
+
+// ErrNoPortsAvailable is returned by PortPool.Lease when every port is
+// leased. A Start failing with it is answered by a NAK with
+// NoPortsAvailable.
+var ErrNoPortsAvailable = npmp.ErrNoPortsAvailable
+
+// ErrDeadlinePassed is returned by PortPool.Lease when the deadline is
+// already past. A Start failing with it is answered by a NAK with
+// InvalidData.
+var ErrDeadlinePassed error = &npmp.NAKError{Code: npmp.InvalidData, Diagnostic: "Job deadline passed"}
+
+// A Lease is the use of an iperf server port by a job.
+type Lease struct {
+	Port     uint16
+	ClientID []byte
+	JobID    []byte
+	Deadline time.Time // The lease expires after the deadline
+}
+
+// A LeaseHandler provides the service behind the ports of a PortPool, such
+// as an iperf server.
+type LeaseHandler interface {
+	// StartLease is called by a Session when it leased a port to a job.
+	// Options added to m are sent to the client along with the port. An
+	// error releases the lease and the client's Start is refused.
+	StartLease(l Lease, m *npmp.SettingsMessage) error
+
+	// EndLease is called once the lease is released or has expired.
+	EndLease(l Lease)
+}
+
+// A PortPool leases the iperf server ports in a range to jobs. A port is
+// leased until the job releases it or the lease expires.
+type PortPool struct {
+	// LeaseDuration is how long a lease lasts when no deadline is given.
+	// If zero, DefaultLeaseDuration is used.
+	LeaseDuration time.Duration
+
+	// Handler, if set, is told about the leases started and ended.
+	Handler LeaseHandler
+
+	first, last uint16
+
+	mu     sync.Mutex
+	leases map[uint16]*lease
+}
+
+type lease struct {
+	Lease
+	timer *time.Timer
+	ended bool
+}
+
+// NewPortPool returns a pool of the ports from first to last inclusive.
+func NewPortPool(first, last uint16) *PortPool {
+	if last < first {
+		first, last = last, first
+	}
+	return &PortPool{first: first, last: last, leases: make(map[uint16]*lease)}
+}
+
+// Lease leases the lowest free port to a job until deadline, or for
+// LeaseDuration if deadline is zero. A job leasing a second time keeps its
+// port with the new deadline. A deadline already past is refused with
+// ErrDeadlinePassed.
+func (p *PortPool) Lease(clientID, jobID []byte, deadline time.Time) (Lease, error) {
+	now := time.Now()
+	if deadline.IsZero() {
+		d := p.LeaseDuration
+		if d <= 0 {
+			d = DefaultLeaseDuration
+		}
+		deadline = now.Add(d)
+	} else if !deadline.After(now) {
+		return Lease{}, ErrDeadlinePassed
+	}
+
+	var expired []Lease
+	defer func() { p.ended(expired) }()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if l := p.find(clientID, jobID); l != nil && !l.expired(now) {
+		l.Deadline = deadline
+		l.timer.Reset(time.Until(deadline))
+		return l.copy(), nil
+	}
+	for port := uint32(p.first); port <= uint32(p.last); port++ {
+		if l := p.leases[uint16(port)]; l != nil {
+			if !l.expired(now) {
+				continue
+			}
+			if p.end(l) {
+				expired = append(expired, l.copy())
+			}
+		}
+		l := &lease{Lease: Lease{
+			Port:     uint16(port),
+			ClientID: append([]byte(nil), clientID...),
+			JobID:    append([]byte(nil), jobID...),
+			Deadline: deadline,
+		}}
+		l.timer = time.AfterFunc(time.Until(deadline), func() { p.expire(l) })
+		p.leases[l.Port] = l
+		return l.copy(), nil
+	}
+	return Lease{}, ErrNoPortsAvailable
+}
+
+// Release ends the lease of a job. It returns false if the job had none.
+func (p *PortPool) Release(clientID, jobID []byte) bool {
+	p.mu.Lock()
+	l := p.find(clientID, jobID)
+	ok := l != nil && p.end(l)
+	p.mu.Unlock()
+	if ok {
+		p.ended([]Lease{l.copy()})
+	}
+	return ok
+}
+
+// Lookup returns the current lease of a job.
+func (p *PortPool) Lookup(clientID, jobID []byte) (Lease, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if l := p.find(clientID, jobID); l != nil && !l.expired(time.Now()) {
+		return l.copy(), true
+	}
+	return Lease{}, false
+}
+
+// Leases returns the current leases ordered by port.
+func (p *PortPool) Leases() []Lease {
+	now := time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var leases []Lease
+	for port := uint32(p.first); port <= uint32(p.last); port++ {
+		if l := p.leases[uint16(port)]; l != nil && !l.expired(now) {
+			leases = append(leases, l.copy())
+		}
+	}
+	return leases
+}
+
+// Available returns the number of ports which aren't leased.
+func (p *PortPool) Available() int {
+	return int(p.last) - int(p.first) + 1 - len(p.Leases())
+}
+
+func (p *PortPool) find(clientID, jobID []byte) *lease {
+	for _, l := range p.leases {
+		if string(l.ClientID) == string(clientID) && string(l.JobID) == string(jobID) {
+			return l
+		}
+	}
+	return nil
+}
+
+// end removes a lease. It returns false if the lease had already ended.
+// p.mu must be held.
+func (p *PortPool) end(l *lease) bool {
+	if l.ended {
+		return false
+	}
+	l.ended = true
+	l.timer.Stop()
+	if p.leases[l.Port] == l {
+		delete(p.leases, l.Port)
+	}
+	return true
+}
+
+func (p *PortPool) expire(l *lease) {
+	p.mu.Lock()
+	ok := l.expired(time.Now()) && p.end(l) // Unless renewed meanwhile
+	p.mu.Unlock()
+	if ok {
+		p.ended([]Lease{l.copy()})
+	}
+}
+
+func (p *PortPool) ended(leases []Lease) {
+	if p.Handler == nil {
+		return
+	}
+	for _, l := range leases {
+		p.Handler.EndLease(l)
+	}
+}
+
+func (l *lease) expired(now time.Time) bool { return now.After(l.Deadline) }
+
+func (l *lease) copy() Lease {
+	c := l.Lease
+	c.ClientID = append([]byte(nil), l.ClientID...)
+	c.JobID = append([]byte(nil), l.JobID...)
+	return c
+}
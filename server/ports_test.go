@@ -0,0 +1,53 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPortPool(t *testing.T) {
+	p := NewPortPool(5201, 5202)
+	a, err := p.Lease([]byte("a"), []byte{1}, time.Time{})
+	if err != nil || a.Port != 5201 {
+		t.Fatalf("Incorrect lease. Expected port 5201, got %d (%v)", a.Port, err)
+	}
+	if d := time.Until(a.Deadline); d < DefaultLeaseDuration-time.Second || d > DefaultLeaseDuration {
+		t.Fatalf("Incorrect deadline. Expected %s from now, got %s", DefaultLeaseDuration, d)
+	}
+	b, err := p.Lease([]byte("b"), []byte{1}, time.Now().Add(20*time.Millisecond))
+	if err != nil || b.Port != 5202 {
+		t.Fatalf("Incorrect lease. Expected port 5202, got %d (%v)", b.Port, err)
+	}
+	if _, err := p.Lease([]byte("c"), []byte{1}, time.Now().Add(-time.Second)); err != ErrDeadlinePassed {
+		t.Fatalf("Incorrect error. Expected ErrDeadlinePassed, got %v", err)
+	}
+	if _, err := p.Lease([]byte("c"), []byte{1}, time.Time{}); err != ErrNoPortsAvailable {
+		t.Fatalf("Incorrect error. Expected ErrNoPortsAvailable, got %v", err)
+	}
+	if again, _ := p.Lease([]byte("a"), []byte{1}, time.Time{}); again.Port != a.Port {
+		t.Fatalf("Incorrect repeated lease. Expected port %d, got %d", a.Port, again.Port)
+	}
+
+	// The second lease expires and its port is reused.
+	time.Sleep(30 * time.Millisecond)
+	if _, ok := p.Lookup([]byte("b"), []byte{1}); ok {
+		t.Fatal("Expired lease still found")
+	}
+	if p.Available() != 1 {
+		t.Fatalf("Incorrect available ports. Expected 1, got %d", p.Available())
+	}
+	c, err := p.Lease([]byte("c"), []byte{1}, time.Time{})
+	if err != nil || c.Port != 5202 {
+		t.Fatalf("Incorrect lease. Expected port 5202, got %d (%v)", c.Port, err)
+	}
+
+	if !p.Release([]byte("a"), []byte{1}) {
+		t.Fatal("Failed to release lease")
+	}
+	if p.Release([]byte("a"), []byte{1}) {
+		t.Fatal("Released a lease twice")
+	}
+	if leases := p.Leases(); len(leases) != 1 || string(leases[0].ClientID) != "c" {
+		t.Fatalf("Incorrect leases: %+v", leases)
+	}
+}
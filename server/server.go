@@ -0,0 +1,289 @@
+// Package server implements an NPMP controller. It accepts TCP connections
+// from probes, enforces the legal message sequence of each connection and
+// calls user supplied handlers for the business logic.
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/usi-lfkeitel/npmp"
+)
+
+// ErrServerClosed is returned by Serve and ListenAndServe after Close.
+var ErrServerClosed = errors.New("Server closed")
+
+// Handler holds the callbacks used by a Server. Every callback is optional.
+// A callback returning an error causes a NAK to be sent in reply to the
+// message, otherwise the message is acknowledged. The NAK carries the code
+// and diagnostic of a *npmp.NAKError in the error's chain, such as
+// npmp.ErrUnsupportedVersion, or GeneralError for any other error. Callbacks
+// for a single Session are called sequentially from its read loop.
+type Handler struct {
+	// OnRegister is called for a Register message. A nil error ACKs the
+	// registration, and the returned Settings message is sent afterwards.
+	// An empty Settings message is sent if it returns nil.
+	OnRegister func(s *Session, m *npmp.RegisterMessage) (*npmp.SettingsMessage, error)
+
+	// OnStart is called when the client announces the start of a job.
+	OnStart func(s *Session, m npmp.StartMessage) error
+
+	// OnData is called with the results of an active job, and with the
+	// SoftwareUpdate Data messages reporting client updates, which belong
+	// to no job.
+	OnData func(s *Session, m npmp.DataMessage) error
+
+	// OnEnd is called when the client announces the end of a job.
+	OnEnd func(s *Session, m npmp.EndMessage) error
+
+	// OnInform is called when the client requests options. The returned
+	// Settings message is sent in reply. If it is nil, the server answers
+	// from its OptionProvider.
+	OnInform func(s *Session, m npmp.InformMessage) (*npmp.SettingsMessage, error)
+
+	// OnSettings is called when the client sends its own Settings.
+	OnSettings func(s *Session, m *npmp.SettingsMessage) error
+
+	// OnReply is called with ACK and NAK messages sent by the client.
+	OnReply func(s *Session, m npmp.Messanger)
+
+	// OnLiveness is called when a client misses too many heartbeats and is
+	// marked offline, and when it is heard from again. The session stays
+	// open; the callback may Close it.
+	OnLiveness func(s *Session, alive bool)
+
+	// OnDisconnect is called once the session has ended. err is nil if the
+	// client disconnected cleanly.
+	OnDisconnect func(s *Session, err error)
+}
+
+// A Server accepts NPMP connections and runs a Session for each one.
+type Server struct {
+	Handler Handler
+
+	// Versions are the protocol versions accepted from clients. If nil,
+	// every version in npmp.SupportedVersions is accepted.
+	Versions []byte
+
+	// TLSConfig is used by ListenAndServeTLS. To ask clients for
+	// certificates set its ClientAuth to VerifyClientCertIfGiven or
+	// RequireAndVerifyClientCert and its ClientCAs to the CAs issuing them;
+	// other client authentication is refused. A client presenting a
+	// certificate may only register with the client ID it was issued to, in
+	// hex as the common name or a DNS name of the certificate. Other
+	// registrations, and those over unverified certificates, are answered
+	// by a NAK with NotAuthorized.
+	TLSConfig *tls.Config
+
+	// Keys, if set, requires every frame from a client to carry an
+	// authentication trailer signed with the client's pre-shared key, see
+	// npmp.Authenticator. Frames failing authentication are answered by a
+	// NAK with NotAuthorized. Once a client is authenticated the session
+	// signs its own frames with the same key.
+	Keys npmp.KeyStore
+
+	// MaxFrameSize is the largest frame accepted from a client. If zero,
+	// npmp.DefaultMaxFrameSize is used.
+	MaxFrameSize uint32
+
+	// Ports, if set, leases an iperf server port to every job a client
+	// starts, except Ping jobs. The Start message is then answered by a
+	// Settings message with the IperfServerPort and JobResourceDeadline
+	// options instead of an ACK, or by a NAK with NoPortsAvailable when the
+	// pool is exhausted. The port is released when the job ends.
+	Ports *PortPool
+
+	// Options supplies the options clients request with Inform messages.
+	// The reply to an Inform is a Settings message with exactly the
+	// requested options, or a NAK with InvalidData if any of them is
+	// unknown or not provided. If nil, the options last sent to the client
+	// are used, see Session.SentOption.
+	Options OptionProvider
+
+	// Updates, if set, is checked whenever a client reports its
+	// ClientSoftwareVersion in a Settings message. Clients running an
+	// older version are sent the policy's Settings after the ACK.
+	Updates *UpdatePolicy
+
+	// Heartbeat is sent to clients as the HeartbeatDuration of the
+	// registration Settings unless OnRegister sets one. Once registered,
+	// a session sends a Null message every interval and expects the client
+	// to do the same. If zero and OnRegister sets none, no heartbeats are
+	// sent.
+	Heartbeat time.Duration
+
+	// HeartbeatMisses is the number of heartbeat intervals without a
+	// message after which a client is marked offline. If zero,
+	// npmp.DefaultHeartbeatMisses is used.
+	HeartbeatMisses int
+
+	// ErrorLog specifies an optional logger for errors. If nil, the log
+	// package's standard logger is used.
+	ErrorLog *log.Logger
+
+	replays npmp.ReplayCache // Shared by the sessions
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	sessions  map[*Session]struct{}
+	closed    bool
+}
+
+// ListenAndServe listens on the TCP address addr and calls Serve.
+func (srv *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return srv.Serve(l)
+}
+
+// Serve accepts connections on l and starts a Session for each of them.
+// It always returns a non-nil error and closes l.
+func (srv *Server) Serve(l net.Listener) error {
+	if !srv.trackListener(l, true) {
+		l.Close()
+		return ErrServerClosed
+	}
+	defer srv.trackListener(l, false)
+	defer l.Close()
+
+	var delay time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if srv.isClosed() {
+				return ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				srv.logf("npmp: accept error: %s; retrying in %s", err, delay)
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+
+		s := newSession(srv, conn)
+		if !srv.trackSession(s, true) {
+			conn.Close()
+			return ErrServerClosed
+		}
+		go s.serve()
+	}
+}
+
+// Close stops all listeners and closes every active Session.
+func (srv *Server) Close() error {
+	srv.mu.Lock()
+	srv.closed = true
+	var err error
+	for l := range srv.listeners {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	sessions := make([]*Session, 0, len(srv.sessions))
+	for s := range srv.sessions {
+		sessions = append(sessions, s)
+	}
+	srv.mu.Unlock()
+
+	for _, s := range sessions {
+		s.Close()
+	}
+	return err
+}
+
+// Sessions returns all active sessions.
+func (srv *Server) Sessions() []*Session {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	sessions := make([]*Session, 0, len(srv.sessions))
+	for s := range srv.sessions {
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+// Session returns the registered session with the given client ID, or nil.
+func (srv *Server) Session(clientID []byte) *Session {
+	id := string(clientID)
+	for _, s := range srv.Sessions() {
+		if s.State() == StateReady && string(s.ClientID()) == id {
+			return s
+		}
+	}
+	return nil
+}
+
+func (srv *Server) isClosed() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.closed
+}
+
+func (srv *Server) trackListener(l net.Listener, add bool) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if add {
+		if srv.closed {
+			return false
+		}
+		if srv.listeners == nil {
+			srv.listeners = make(map[net.Listener]struct{})
+		}
+		srv.listeners[l] = struct{}{}
+	} else {
+		delete(srv.listeners, l)
+	}
+	return true
+}
+
+func (srv *Server) trackSession(s *Session, add bool) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if add {
+		if srv.closed {
+			return false
+		}
+		if srv.sessions == nil {
+			srv.sessions = make(map[*Session]struct{})
+		}
+		srv.sessions[s] = struct{}{}
+	} else {
+		delete(srv.sessions, s)
+	}
+	return true
+}
+
+func (srv *Server) versions() []byte {
+	if srv.Versions == nil {
+		return npmp.SupportedVersions()
+	}
+	return srv.Versions
+}
+
+func (srv *Server) maxFrameSize() uint32 {
+	if srv.MaxFrameSize == 0 {
+		return npmp.DefaultMaxFrameSize
+	}
+	return srv.MaxFrameSize
+}
+
+func (srv *Server) logf(format string, args ...interface{}) {
+	if srv.ErrorLog != nil {
+		srv.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
@@ -0,0 +1,643 @@
+package server
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/usi-lfkeitel/npmp"
+)
+
+// testClient is a raw protocol client used to drive a Server.
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	enc  *npmp.Encoder
+	dec  *npmp.Decoder
+}
+
+func dialTest(t *testing.T, addr string) *testClient {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial server: %s", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &testClient{t: t, conn: conn, enc: npmp.NewEncoder(conn), dec: npmp.NewDecoder(conn)}
+}
+
+func (c *testClient) send(m npmp.Messanger) {
+	if err := c.enc.Encode(m); err != nil {
+		c.t.Fatalf("Failed to send message: %s", err)
+	}
+}
+
+func (c *testClient) expect(mt npmp.MessageType) npmp.Messanger {
+	m, err := c.dec.Decode()
+	if err != nil {
+		c.t.Fatalf("Failed to read message: %s", err)
+	}
+	if got := npmp.Message(m.Bytes()).MessageType(); got != mt {
+		c.t.Fatalf("Incorrect message type. Expected %s, got %s", mt, got)
+	}
+	return m
+}
+
+func (c *testClient) expectNAK(code npmp.NACKResponseCode) {
+	m := c.expect(npmp.NAK).(npmp.NAKMessage)
+	if m.ResponseCode() != code {
+		c.t.Fatalf("Incorrect response code. Expected %s, got %s", code, m.ResponseCode())
+	}
+}
+
+// startServer runs srv on a loopback listener and returns its address.
+func startServer(t *testing.T, srv *Server) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+	return l.Addr().String()
+}
+
+var testClientID = []byte{99, 226, 170, 251, 37, 41, 43, 236, 249, 80, 159, 109, 149, 85, 244, 19}
+
+func (c *testClient) register() *npmp.SettingsMessage {
+	reg := npmp.NewRegisterMessage()
+	reg.SetClientID(testClientID)
+	c.send(reg)
+	c.expect(npmp.ACK)
+	return c.expect(npmp.Settings).(*npmp.SettingsMessage)
+}
+
+func TestSessionSequence(t *testing.T) {
+	data := make(chan []byte, 1)
+	disconnected := make(chan error, 1)
+	srv := &Server{
+		Handler: Handler{
+			OnRegister: func(s *Session, m *npmp.RegisterMessage) (*npmp.SettingsMessage, error) {
+				settings := npmp.NewSettingsMessage()
+				settings.AddOption(npmp.Option{Code: npmp.ClientSoftwareVersion, Value: []byte("1.0.0")})
+				return settings, nil
+			},
+			OnData: func(s *Session, m npmp.DataMessage) error {
+				data <- append([]byte(nil), m.Data()...)
+				return nil
+			},
+			OnDisconnect: func(s *Session, err error) { disconnected <- err },
+		},
+	}
+	c := dialTest(t, startServer(t, srv))
+
+	// Jobs aren't allowed before registration
+	c.send(npmp.NewStartMessage())
+	c.expectNAK(npmp.InvalidData)
+
+	settings := c.register()
+	if len(settings.Options) != 2 || settings.Options[0].Code != npmp.ClientSoftwareVersion {
+		t.Fatalf("Incorrect settings. Expected ClientSoftwareVersion and ProtocolVersion, got %v", settings.Options)
+	}
+	if v, err := settings.ProtocolVersion(); err != nil || v != 0 {
+		t.Fatalf("Incorrect protocol version. Expected 0, got %d (%v)", v, err)
+	}
+	if s := srv.Session(testClientID); s == nil || s.State() != StateReady {
+		t.Fatal("Registered session not found")
+	}
+
+	// Registering twice isn't allowed
+	c.send(npmp.NewRegisterMessage())
+	c.expectNAK(npmp.InvalidData)
+
+	jobID := []byte{1, 2, 3, 4}
+	dm := npmp.NewDataMessage()
+	dm.SetJobID(jobID)
+	dm.SetData([]byte("results"))
+
+	// Data for a job that hasn't started
+	c.send(dm)
+	c.expectNAK(npmp.InvalidData)
+
+	start := npmp.NewStartMessage()
+	start.SetJobID(jobID)
+	c.send(start)
+	c.expect(npmp.ACK)
+	c.send(dm)
+	c.expect(npmp.ACK)
+	if d := <-data; !bytes.Equal(d, []byte("results")) {
+		t.Fatalf("Incorrect data. Expected results, got %s", d)
+	}
+
+	end := npmp.NewEndMessage()
+	end.SetJobID(jobID)
+	c.send(end)
+	c.expect(npmp.ACK)
+	c.send(end)
+	c.expectNAK(npmp.InvalidData)
+
+	c.send(npmp.NewDisconnectMessage())
+	if err := <-disconnected; err != nil {
+		t.Fatalf("Unexpected disconnect error: %s", err)
+	}
+}
+
+func TestSessionPushJob(t *testing.T) {
+	registered := make(chan *Session, 1)
+	srv := &Server{
+		Handler: Handler{
+			OnRegister: func(s *Session, m *npmp.RegisterMessage) (*npmp.SettingsMessage, error) {
+				registered <- s
+				return nil, nil
+			},
+		},
+	}
+	c := dialTest(t, startServer(t, srv))
+	c.register()
+	s := <-registered
+
+	jobID := []byte{9, 9, 9, 9}
+	if err := s.StartJob(jobID); err != nil {
+		t.Fatalf("Failed to start job: %s", err)
+	}
+	start := c.expect(npmp.Start).(npmp.StartMessage)
+	if !bytes.Equal(start.JobID(), jobID) {
+		t.Fatalf("Incorrect job ID. Expected %v, got %v", jobID, start.JobID())
+	}
+	c.send(start)
+	c.expect(npmp.ACK)
+
+	if err := s.EndJob(jobID); err != nil {
+		t.Fatalf("Failed to end job: %s", err)
+	}
+	c.expect(npmp.End)
+	if err := s.EndJob(jobID); err != ErrUnknownJob {
+		t.Fatalf("Incorrect error. Expected ErrUnknownJob, got %v", err)
+	}
+
+	s.Close()
+	c.expect(npmp.Disconnect)
+}
+
+func TestSessionInvalidMessage(t *testing.T) {
+	c := dialTest(t, startServer(t, &Server{}))
+
+	m := npmp.NewACKMessage()
+	m.SetCookie([]byte("XX"))
+	c.send(m)
+	c.expectNAK(npmp.InvalidData)
+
+	m = npmp.NewACKMessage()
+	m.SetVersion(npmp.MaxVersion + 1)
+	c.send(m)
+	c.expectNAK(npmp.UnsupportedVersion)
+
+	// The session is still usable
+	c.register()
+}
+
+func TestSessionPortLease(t *testing.T) {
+	srv := &Server{Ports: NewPortPool(5201, 5201)}
+	c := dialTest(t, startServer(t, srv))
+	c.register()
+
+	start := npmp.NewStartMessage()
+	start.SetJobID([]byte{1, 2, 3, 4})
+	c.send(start)
+	settings := c.expect(npmp.Settings).(*npmp.SettingsMessage)
+	if port, err := settings.IperfServerPort(); err != nil || port != 5201 {
+		t.Fatalf("Incorrect port. Expected 5201, got %d (%v)", port, err)
+	}
+	if _, err := settings.JobResourceDeadline(); err != nil {
+		t.Fatalf("Failed to get resource deadline: %s", err)
+	}
+
+	// The only port is taken.
+	second := npmp.NewStartMessage()
+	second.SetJobID([]byte{5, 6, 7, 8})
+	c.send(second)
+	c.expectNAK(npmp.NoPortsAvailable)
+
+	end := npmp.NewEndMessage()
+	end.SetJobID([]byte{1, 2, 3, 4})
+	c.send(end)
+	c.expect(npmp.ACK)
+	if srv.Ports.Available() != 1 {
+		t.Fatalf("Port not released. Expected 1 available, got %d", srv.Ports.Available())
+	}
+
+	c.send(second)
+	c.expect(npmp.Settings)
+	c.conn.Close()
+
+	// Ports of jobs still running are released when the session ends.
+	deadline := time.Now().Add(time.Second)
+	for srv.Ports.Available() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("Port not released after disconnect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSessionPortLeasePing(t *testing.T) {
+	registered := make(chan *Session, 1)
+	srv := &Server{
+		Ports: NewPortPool(5201, 5201),
+		Handler: Handler{
+			OnRegister: func(s *Session, m *npmp.RegisterMessage) (*npmp.SettingsMessage, error) {
+				registered <- s
+				return nil, nil
+			},
+		},
+	}
+	c := dialTest(t, startServer(t, srv))
+	c.register()
+
+	job := &npmp.Job{ID: []byte{1, 2, 3, 4}, Type: npmp.Ping, Target: "10.0.0.1", Count: 1}
+	if err := (<-registered).StartJobSpec(job); err != nil {
+		t.Fatalf("Failed to start job: %s", err)
+	}
+	c.expect(npmp.Settings)
+	c.expect(npmp.Start)
+
+	start := npmp.NewStartMessage()
+	start.SetJobID(job.ID)
+	c.send(start)
+	c.expect(npmp.ACK)
+	if srv.Ports.Available() != 1 {
+		t.Fatal("Port leased to a Ping job")
+	}
+}
+
+func TestSessionPortLeaseDeadlinePassed(t *testing.T) {
+	registered := make(chan *Session, 1)
+	srv := &Server{
+		Ports: NewPortPool(5201, 5201),
+		Handler: Handler{
+			OnRegister: func(s *Session, m *npmp.RegisterMessage) (*npmp.SettingsMessage, error) {
+				registered <- s
+				return nil, nil
+			},
+		},
+	}
+	c := dialTest(t, startServer(t, srv))
+	c.register()
+
+	job := &npmp.Job{ID: []byte{1, 2, 3, 4}, Type: npmp.Iperf3, Target: "10.0.0.1",
+		Duration: time.Second, Parallel: 1, Deadline: time.Now().Add(-time.Minute)}
+	if err := (<-registered).StartJobSpec(job); err != nil {
+		t.Fatalf("Failed to start job: %s", err)
+	}
+	c.expect(npmp.Settings)
+	c.expect(npmp.Start)
+
+	start := npmp.NewStartMessage()
+	start.SetJobID(job.ID)
+	c.send(start)
+	c.expectNAK(npmp.InvalidData)
+	if srv.Ports.Available() != 1 {
+		t.Fatal("Port leased past the job's deadline")
+	}
+}
+
+// testLeaseHandler refuses leases for job 05060708.
+type testLeaseHandler struct {
+	started, ended chan Lease
+}
+
+func (h *testLeaseHandler) StartLease(l Lease, m *npmp.SettingsMessage) error {
+	if bytes.Equal(l.JobID, []byte{5, 6, 7, 8}) {
+		return errors.New("No iperf")
+	}
+	m.SetIperfServerVersion(3)
+	h.started <- l
+	return nil
+}
+
+func (h *testLeaseHandler) EndLease(l Lease) { h.ended <- l }
+
+func TestSessionLeaseHandler(t *testing.T) {
+	h := &testLeaseHandler{started: make(chan Lease, 1), ended: make(chan Lease, 1)}
+	srv := &Server{Ports: NewPortPool(5201, 5201), ErrorLog: log.New(io.Discard, "", 0)}
+	srv.Ports.Handler = h
+	c := dialTest(t, startServer(t, srv))
+	c.register()
+
+	start := npmp.NewStartMessage()
+	start.SetJobID([]byte{1, 2, 3, 4})
+	c.send(start)
+	settings := c.expect(npmp.Settings).(*npmp.SettingsMessage)
+	if l := <-h.started; l.Port != 5201 || !bytes.Equal(l.JobID, []byte{1, 2, 3, 4}) {
+		t.Fatalf("Incorrect lease. Expected port 5201 for job 01020304, got %d for %x", l.Port, l.JobID)
+	}
+	if v, err := settings.IperfServerVersion(); err != nil || v != 3 {
+		t.Fatalf("Incorrect server version. Expected 3, got %d (%v)", v, err)
+	}
+	if addr, err := settings.IperfServerAddress(); err != nil || addr != "127.0.0.1" {
+		t.Fatalf("Incorrect server address. Expected 127.0.0.1, got %q (%v)", addr, err)
+	}
+
+	end := npmp.NewEndMessage()
+	end.SetJobID([]byte{1, 2, 3, 4})
+	c.send(end)
+	c.expect(npmp.ACK)
+	if l := <-h.ended; l.Port != 5201 {
+		t.Fatalf("Incorrect ended lease. Expected port 5201, got %d", l.Port)
+	}
+
+	// A handler error refuses the job and frees the port.
+	start.SetJobID([]byte{5, 6, 7, 8})
+	c.send(start)
+	c.expectNAK(npmp.GeneralError)
+	if srv.Ports.Available() != 1 {
+		t.Fatalf("Port not released. Expected 1 available, got %d", srv.Ports.Available())
+	}
+}
+
+func TestSessionHeartbeat(t *testing.T) {
+	liveness := make(chan bool, 2)
+	srv := &Server{
+		Heartbeat:       50 * time.Millisecond,
+		HeartbeatMisses: 2,
+		Handler: Handler{
+			OnLiveness: func(s *Session, alive bool) { liveness <- alive },
+		},
+	}
+	c := dialTest(t, startServer(t, srv))
+	settings := c.register()
+	if d, err := settings.HeartbeatDuration(); err != nil || d != 50*time.Millisecond {
+		t.Fatalf("Incorrect heartbeat. Expected 50ms, got %s (%v)", d, err)
+	}
+
+	// The server sends heartbeats and marks the silent client offline.
+	c.expect(npmp.Null)
+	if alive := <-liveness; alive {
+		t.Fatal("Incorrect liveness. Expected offline")
+	}
+	if s := srv.Session(testClientID); s == nil || s.Alive() {
+		t.Fatal("Incorrect session state. Expected an offline session")
+	}
+
+	c.send(npmp.NewNullMessage())
+	if alive := <-liveness; !alive {
+		t.Fatal("Incorrect liveness. Expected online")
+	}
+}
+
+func TestSessionHeartbeatSharedSettings(t *testing.T) {
+	shared := npmp.NewSettingsMessage()
+	srv := &Server{
+		Heartbeat: time.Hour,
+		Handler: Handler{
+			OnRegister: func(s *Session, m *npmp.RegisterMessage) (*npmp.SettingsMessage, error) {
+				return shared, nil
+			},
+		},
+	}
+	c := dialTest(t, startServer(t, srv))
+	if d, err := c.register().HeartbeatDuration(); err != nil || d != time.Hour {
+		t.Fatalf("Incorrect heartbeat. Expected 1h, got %s (%v)", d, err)
+	}
+	if _, ok := shared.Option(npmp.HeartbeatDuration); ok {
+		t.Fatal("Incorrect shared settings. Expected no HeartbeatDuration")
+	}
+}
+
+func TestSessionVersion(t *testing.T) {
+	srv := &Server{}
+	c := dialTest(t, startServer(t, srv))
+
+	offer := npmp.NewVersionMessage()
+	offer.SetVersions([]byte{7})
+	c.send(offer)
+	c.expectNAK(npmp.UnsupportedVersion)
+
+	offer.SetVersions([]byte{0, 1, 7})
+	c.send(offer)
+	reply := c.expect(npmp.Version).(npmp.VersionMessage)
+	if !bytes.Equal(reply.Versions(), []byte{1}) || reply.Version() != 1 {
+		t.Fatalf("Incorrect reply. Expected version 1, got %v with header version %d", reply.Versions(), reply.Version())
+	}
+
+	reg := npmp.NewRegisterMessage()
+	reg.SetVersion(1)
+	reg.SetClientID(testClientID)
+	c.send(reg)
+	if ack := c.expect(npmp.ACK); npmp.Message(ack.Bytes()).Version() != 1 {
+		t.Fatalf("Incorrect ACK version. Expected 1, got %d", npmp.Message(ack.Bytes()).Version())
+	}
+	settings := c.expect(npmp.Settings).(*npmp.SettingsMessage)
+	if v, err := settings.ProtocolVersion(); err != nil || v != 1 {
+		t.Fatalf("Incorrect protocol version. Expected 1, got %d (%v)", v, err)
+	}
+	if s := srv.Session(testClientID); s == nil || s.Version() != 1 {
+		t.Fatal("Incorrect session version. Expected 1")
+	}
+
+	// Once registered the version is fixed.
+	offer.SetVersions([]byte{0})
+	c.send(offer)
+	c.expectNAK(npmp.InvalidData)
+	if s := srv.Session(testClientID); s.Version() != 1 {
+		t.Fatalf("Incorrect session version. Expected 1, got %d", s.Version())
+	}
+}
+
+func TestSessionSharedSettings(t *testing.T) {
+	shared := npmp.NewSettingsMessage()
+	shared.SetServerIP(net.IPv4(10, 0, 0, 1))
+	srv := &Server{
+		Handler: Handler{
+			OnRegister: func(s *Session, m *npmp.RegisterMessage) (*npmp.SettingsMessage, error) {
+				return shared, nil
+			},
+		},
+	}
+	addr := startServer(t, srv)
+
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		go func(i int) {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			enc, dec := npmp.NewEncoder(conn), npmp.NewDecoder(conn)
+			reg := npmp.NewRegisterMessage()
+			reg.SetVersion(byte(i % 2))
+			reg.SetClientID(bytes.Repeat([]byte{byte(i)}, 16))
+			enc.Encode(reg)
+			dec.Decode() // ACK
+			m, err := dec.Decode()
+			if err != nil {
+				errs <- err
+				return
+			}
+			settings, ok := m.(*npmp.SettingsMessage)
+			if !ok {
+				errs <- fmt.Errorf("Incorrect message. Expected Settings, got %v", m.Bytes())
+				return
+			}
+			if v, err := settings.ProtocolVersion(); err != nil || v != byte(i%2) {
+				errs <- fmt.Errorf("Incorrect protocol version. Expected %d, got %d (%v)", i%2, v, err)
+				return
+			}
+			errs <- nil
+		}(i)
+	}
+	for i := 0; i < 8; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := shared.Option(npmp.ProtocolVersion); ok || len(shared.Options) != 1 {
+		t.Fatalf("Incorrect shared settings. Expected only the ServerIP, got %+v", shared.Options)
+	}
+}
+
+func TestSessionVersionUnsupported(t *testing.T) {
+	srv := &Server{Versions: []byte{0}}
+	c := dialTest(t, startServer(t, srv))
+
+	offer := npmp.NewVersionMessage()
+	offer.SetVersions([]byte{1})
+	c.send(offer)
+	c.expectNAK(npmp.UnsupportedVersion)
+
+	reg := npmp.NewRegisterMessage()
+	reg.SetVersion(1)
+	reg.SetClientID(testClientID)
+	c.send(reg)
+	c.expectNAK(npmp.UnsupportedVersion)
+
+	reg.SetVersion(0)
+	c.send(reg)
+	c.expect(npmp.ACK)
+	settings := c.expect(npmp.Settings).(*npmp.SettingsMessage)
+	if v, err := settings.ProtocolVersion(); err != nil || v != 0 {
+		t.Fatalf("Incorrect protocol version. Expected 0, got %d (%v)", v, err)
+	}
+}
+
+func TestSessionAuth(t *testing.T) {
+	key := []byte("secret")
+	srv := &Server{Keys: npmp.KeyMap{hex.EncodeToString(testClientID): key}}
+	c := dialTest(t, startServer(t, srv))
+	c.dec.Auth = &npmp.Authenticator{Keys: srv.Keys, Direction: npmp.ServerToClient}
+
+	reg := npmp.NewRegisterMessage()
+	reg.SetClientID(testClientID)
+	c.send(reg)
+	c.expectNAK(npmp.NotAuthorized)
+
+	c.enc.SetKey(testClientID, []byte("wrong"), npmp.ClientToServer)
+	c.send(reg)
+	c.expectNAK(npmp.NotAuthorized)
+
+	// Replies are signed once the client is authenticated.
+	c.enc.SetKey(testClientID, key, npmp.ClientToServer)
+	c.send(reg)
+	c.expect(npmp.ACK)
+	c.expect(npmp.Settings)
+	if s := srv.Session(testClientID); s == nil {
+		t.Fatal("Registered session not found")
+	}
+}
+
+func TestSessionAuthReplay(t *testing.T) {
+	key := []byte("secret")
+	srv := &Server{Keys: npmp.KeyMap{hex.EncodeToString(testClientID): key}}
+	addr := startServer(t, srv)
+
+	var frame bytes.Buffer
+	enc := npmp.NewEncoder(&frame)
+	enc.SetKey(testClientID, key, npmp.ClientToServer)
+	reg := npmp.NewRegisterMessage()
+	reg.SetClientID(testClientID)
+	enc.Encode(reg)
+
+	c := dialTest(t, addr)
+	c.conn.Write(frame.Bytes())
+	c.expect(npmp.ACK)
+
+	// The same frame captured and sent on another connection
+	replay := dialTest(t, addr)
+	replay.conn.Write(frame.Bytes())
+	replay.expectNAK(npmp.NotAuthorized)
+}
+
+func TestSessionSeq(t *testing.T) {
+	srv := &Server{}
+	c := dialTest(t, startServer(t, srv))
+	offer := npmp.NewVersionMessage()
+	offer.SetVersions([]byte{npmp.SeqVersion})
+	c.enc.EncodeSeq(offer, 3)
+	c.expect(npmp.Version)
+	if seq, ok := c.dec.Seq(); seq != 3 || !ok {
+		t.Fatalf("Incorrect sequence number. Expected 3, got %d (%t)", seq, ok)
+	}
+
+	reg := npmp.NewRegisterMessage()
+	reg.SetVersion(npmp.SeqVersion)
+	reg.SetClientID(testClientID)
+	c.send(reg)
+	c.expect(npmp.ACK)
+	c.expect(npmp.Settings)
+
+	// Replies carry the sequence number of the message they answer.
+	data := npmp.NewDataMessage()
+	data.SetJobID([]byte{1, 2, 3, 4})
+	c.enc.EncodeSeq(data, 7)
+	c.enc.EncodeSeq(npmp.NewSettingsMessage(), 8)
+	c.expectNAK(npmp.InvalidData)
+	if seq, ok := c.dec.Seq(); seq != 7 || !ok {
+		t.Fatalf("Incorrect sequence number. Expected 7, got %d (%t)", seq, ok)
+	}
+	c.expect(npmp.ACK)
+	if seq, ok := c.dec.Seq(); seq != 8 || !ok {
+		t.Fatalf("Incorrect sequence number. Expected 8, got %d (%t)", seq, ok)
+	}
+
+	c.send(npmp.NewSettingsMessage())
+	c.expect(npmp.ACK)
+	if _, ok := c.dec.Seq(); ok {
+		t.Fatal("Incorrect sequence number. Expected none")
+	}
+}
+
+func TestSessionHandlerError(t *testing.T) {
+	srv := &Server{
+		Handler: Handler{
+			OnSettings: func(s *Session, m *npmp.SettingsMessage) error {
+				if _, ok := m.Option(npmp.VendorOptions); ok {
+					return fmt.Errorf("Storing settings: %w", &npmp.NAKError{Code: npmp.NotAuthorized, Diagnostic: "read only"})
+				}
+				return errors.New("Database unavailable")
+			},
+		},
+	}
+	c := dialTest(t, startServer(t, srv))
+	c.register()
+
+	m := npmp.NewSettingsMessage()
+	m.SetOption(npmp.VendorOptions, nil)
+	c.send(m)
+	nak := c.expect(npmp.NAK).(npmp.NAKMessage)
+	if nak.ResponseCode() != npmp.NotAuthorized || nak.Diagnostic() != "read only" {
+		t.Fatalf("Incorrect NAK. Expected NotAuthorized with diagnostic, got %s %q", nak.ResponseCode(), nak.Diagnostic())
+	}
+
+	c.send(npmp.NewSettingsMessage())
+	nak = c.expect(npmp.NAK).(npmp.NAKMessage)
+	if nak.ResponseCode() != npmp.GeneralError || nak.Diagnostic() != "" {
+		t.Fatalf("Incorrect NAK. Expected GeneralError without diagnostic, got %s %q", nak.ResponseCode(), nak.Diagnostic())
+	}
+}
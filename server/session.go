@@ -0,0 +1,621 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/usi-lfkeitel/npmp"
+)
+
+// ErrNotReady is returned when a job is started or ended on a Session that
+// hasn't completed registration.
+var ErrNotReady = errors.New("Session not registered")
+
+// ErrUnknownJob is returned when ending a job that isn't active.
+var ErrUnknownJob = errors.New("Unknown job ID")
+
+// State is the position of a Session in the protocol sequence.
+type State int
+
+const (
+	StateNew    State = iota // Waiting for a Register message
+	StateReady               // Registered, jobs may run
+	StateClosed              // Connection closed
+)
+
+func (s State) String() string {
+	switch s {
+	case StateNew:
+		return "New"
+	case StateReady:
+		return "Ready"
+	case StateClosed:
+		return "Closed"
+	}
+	return "Unknown"
+}
+
+// A Session is a single client connection. The session enforces the legal
+// message sequence: a client must register and receive an ACK and Settings
+// before any job messages are accepted. A Version message may be sent at any
+// time to negotiate the protocol version, which is otherwise the version of
+// the Register message. A job is begun by a Start message
+// from the client, either on its own accord or in answer to StartJob, is
+// followed by any number of Data messages and finished by an End message.
+// A Disconnect ends the session. Out of sequence messages are answered with
+// a NAK carrying InvalidData.
+type Session struct {
+	srv    *Server
+	conn   net.Conn
+	dec    *npmp.Decoder
+	signed bool // Whether enc signs frames, only used by the read loop
+
+	// Sequence number of the message being handled, only used by the read
+	// loop. Replies carry it back to the client.
+	seq       uint32
+	sequenced bool
+
+	wmu sync.Mutex // Serializes writes
+	enc *npmp.Encoder
+
+	hb   npmp.HeartbeatMonitor
+	ctx  context.Context // Done when the session ends
+	stop context.CancelFunc
+
+	mu       sync.Mutex
+	state    State
+	version  byte
+	software string // Reported ClientSoftwareVersion
+	clientID []byte
+	jobs     map[string]bool      // Job ID to whether the client has started it
+	specs    map[string]*npmp.Job // Jobs sent with StartJobSpec
+	sent     map[npmp.OptionCode][]byte
+}
+
+func newSession(srv *Server, conn net.Conn) *Session {
+	dec := npmp.NewDecoder(conn)
+	dec.MaxFrameSize = srv.maxFrameSize()
+	if srv.Keys != nil {
+		dec.Auth = &npmp.Authenticator{Keys: srv.Keys, Replays: &srv.replays}
+	}
+	s := &Session{
+		srv:   srv,
+		conn:  conn,
+		dec:   dec,
+		enc:   npmp.NewEncoder(conn),
+		jobs:  make(map[string]bool),
+		specs: make(map[string]*npmp.Job),
+		sent:  make(map[npmp.OptionCode][]byte),
+	}
+	s.ctx, s.stop = context.WithCancel(context.Background())
+	s.hb.Misses = srv.HeartbeatMisses
+	s.hb.OnChange = func(alive bool) {
+		if srv.Handler.OnLiveness != nil {
+			srv.Handler.OnLiveness(s, alive)
+		}
+	}
+	return s
+}
+
+// ClientID returns the ID given in the client's Register message. It is nil
+// until the client has sent one.
+func (s *Session) ClientID() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.clientID
+}
+
+// State returns the current state of the session.
+func (s *Session) State() State {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state
+}
+
+// Version returns the protocol version in use, which is written in the header
+// of every message sent once it has been negotiated or the client registered.
+func (s *Session) Version() byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.version
+}
+
+// SoftwareVersion returns the software version last reported by the client,
+// empty if it hasn't reported one.
+func (s *Session) SoftwareVersion() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.software
+}
+
+// Alive returns false once the client has missed too many heartbeats and
+// true again after it is next heard from.
+func (s *Session) Alive() bool { return s.hb.Alive() }
+
+// RemoteAddr returns the remote network address of the client.
+func (s *Session) RemoteAddr() net.Addr { return s.conn.RemoteAddr() }
+
+// Send writes a message to the client. It is safe to call from multiple
+// goroutines.
+func (s *Session) Send(m npmp.Messanger) error {
+	return s.write(m, 0, false)
+}
+
+// reply sends the answer to the message being handled with its sequence
+// number, if it had one.
+func (s *Session) reply(m npmp.Messanger) error {
+	return s.write(m, s.seq, s.sequenced)
+}
+
+func (s *Session) write(m npmp.Messanger, seq uint32, sequenced bool) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	var err error
+	if sequenced {
+		err = s.enc.EncodeSeq(m, seq)
+	} else {
+		err = s.enc.Encode(m)
+	}
+	if err != nil {
+		return err
+	}
+	s.recordOptions(m)
+	return nil
+}
+
+// StartJob instructs the client to start the job with the given 4 byte ID.
+// Any Settings the job needs, such as a JobSpec, should be sent first. The
+// job is pending until the client answers with its own Start message.
+func (s *Session) StartJob(id []byte) error {
+	s.mu.Lock()
+	if s.state != StateReady {
+		s.mu.Unlock()
+		return ErrNotReady
+	}
+	s.jobs[string(id)] = false
+	s.mu.Unlock()
+
+	m := npmp.NewStartMessage()
+	m.SetJobID(id)
+	return s.Send(m)
+}
+
+// StartJobSpec sends the job definition in a Settings message and starts it.
+func (s *Session) StartJobSpec(j *npmp.Job) error {
+	m := npmp.NewSettingsMessage()
+	if err := m.AddJob(j); err != nil {
+		return err
+	}
+	if s.State() != StateReady {
+		return ErrNotReady
+	}
+	s.mu.Lock()
+	s.specs[string(j.ID)] = j
+	s.mu.Unlock()
+	if err := s.Send(m); err != nil {
+		return err
+	}
+	return s.StartJob(j.ID)
+}
+
+// EndJob instructs the client to stop the pending or active job with the
+// given ID.
+func (s *Session) EndJob(id []byte) error {
+	if !s.endJob(id) {
+		return ErrUnknownJob
+	}
+	m := npmp.NewEndMessage()
+	m.SetJobID(id)
+	return s.Send(m)
+}
+
+// Close sends a Disconnect message and closes the connection.
+func (s *Session) Close() error {
+	s.mu.Lock()
+	if s.state == StateClosed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.state = StateClosed
+	s.mu.Unlock()
+
+	s.Send(npmp.NewDisconnectMessage())
+	return s.conn.Close()
+}
+
+func (s *Session) serve() {
+	err := s.readLoop()
+	s.stop()
+
+	s.mu.Lock()
+	closedLocally := s.state == StateClosed
+	s.state = StateClosed
+	s.mu.Unlock()
+	s.conn.Close()
+	s.srv.trackSession(s, false)
+	s.releaseAll()
+
+	if closedLocally || err == io.EOF {
+		err = nil
+	}
+	if err != nil {
+		s.srv.logf("npmp: session %s: %s", s.RemoteAddr(), err)
+	}
+	if s.srv.Handler.OnDisconnect != nil {
+		s.srv.Handler.OnDisconnect(s, err)
+	}
+}
+
+func (s *Session) readLoop() error {
+	for {
+		m, err := s.dec.Decode()
+		s.seq, s.sequenced = s.dec.Seq()
+		if err != nil {
+			var derr *npmp.DecodeError
+			if !errors.As(err, &derr) {
+				return err
+			}
+			s.hb.Seen()
+			code := npmp.InvalidData
+			var verr *npmp.VersionError
+			var aerr *npmp.AuthError
+			if errors.As(err, &verr) {
+				code = npmp.UnsupportedVersion
+			} else if errors.As(err, &aerr) {
+				code = npmp.NotAuthorized
+			}
+			if err := s.nak(code); err != nil {
+				return err
+			}
+			continue
+		}
+
+		s.hb.Seen()
+		s.sign()
+		done, err := s.handle(m)
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+// handle processes a single message. It returns true when the session
+// should end.
+func (s *Session) handle(m npmp.Messanger) (bool, error) {
+	h := &s.srv.Handler
+	mt := npmp.Message(m.Bytes()).MessageType()
+
+	switch mt {
+	case npmp.Disconnect:
+		return true, nil
+	case npmp.Null:
+		return false, nil
+	case npmp.Version:
+		if s.State() != StateNew {
+			// The version can't change once registered.
+			return false, s.nak(npmp.InvalidData)
+		}
+		return false, s.negotiate(m.(npmp.VersionMessage))
+	}
+
+	if s.State() == StateNew {
+		if mt != npmp.Register {
+			return false, s.nak(npmp.InvalidData)
+		}
+		return false, s.register(m.(*npmp.RegisterMessage))
+	}
+
+	switch m := m.(type) {
+	case npmp.StartMessage:
+		if !s.startJob(m.JobID()) {
+			return false, s.nak(npmp.InvalidData)
+		}
+		reply, err := s.leasePort(m.JobID())
+		if err != nil {
+			s.endJob(m.JobID())
+			var nerr *npmp.NAKError
+			if !errors.As(err, &nerr) {
+				s.srv.logf("npmp: session %s: %s", s.RemoteAddr(), err)
+			}
+			return false, s.nakError(err)
+		}
+		if h.OnStart != nil {
+			if err := h.OnStart(s, m); err != nil {
+				s.endJob(m.JobID())
+				return false, s.nakError(err)
+			}
+		}
+		if reply != nil {
+			return false, s.reply(reply)
+		}
+	case npmp.DataMessage:
+		if m.Type() != npmp.SoftwareUpdate && !s.hasJob(m.JobID()) {
+			return false, s.nak(npmp.InvalidData)
+		}
+		if h.OnData != nil {
+			if err := h.OnData(s, m); err != nil {
+				return false, s.nakError(err)
+			}
+		}
+	case npmp.EndMessage:
+		if !s.endJob(m.JobID()) {
+			return false, s.nak(npmp.InvalidData)
+		}
+		if h.OnEnd != nil {
+			if err := h.OnEnd(s, m); err != nil {
+				return false, s.nakError(err)
+			}
+		}
+	case npmp.InformMessage:
+		var reply *npmp.SettingsMessage
+		if h.OnInform != nil {
+			var err error
+			if reply, err = h.OnInform(s, m); err != nil {
+				return false, s.nakError(err)
+			}
+		}
+		if reply == nil {
+			if reply = s.answerInform(m); reply == nil {
+				return false, s.nak(npmp.InvalidData)
+			}
+		}
+		return false, s.reply(reply)
+	case *npmp.SettingsMessage:
+		if h.OnSettings != nil {
+			if err := h.OnSettings(s, m); err != nil {
+				return false, s.nakError(err)
+			}
+		}
+		if err := s.reply(npmp.NewACKMessage()); err != nil {
+			return false, err
+		}
+		return false, s.offerUpdate(m)
+	case npmp.NAKMessage:
+		if h.OnReply != nil {
+			h.OnReply(s, m)
+		}
+		return false, nil
+	default:
+		if mt == npmp.ACK {
+			if h.OnReply != nil {
+				h.OnReply(s, m)
+			}
+			return false, nil
+		}
+		// A second Register or a message type with no meaning to the server
+		return false, s.nak(npmp.InvalidData)
+	}
+	return false, s.reply(npmp.NewACKMessage())
+}
+
+// sign makes the session sign its frames with the key of the client once a
+// frame from it has been authenticated.
+func (s *Session) sign() {
+	if s.signed || s.dec.Auth == nil {
+		return
+	}
+	id := s.dec.Auth.ClientID()
+	key, ok := s.srv.Keys.Key(id)
+	if !ok {
+		return
+	}
+	s.wmu.Lock()
+	s.enc.SetKey(id, key, npmp.ServerToClient)
+	s.wmu.Unlock()
+	s.signed = true
+}
+
+// negotiate answers a Version message sent before Register with the highest
+// version supported by both sides and uses it from then on.
+func (s *Session) negotiate(m npmp.VersionMessage) error {
+	v, ok := npmp.NegotiateVersion(s.srv.versions(), m.Versions())
+	if !ok {
+		return s.nak(npmp.UnsupportedVersion)
+	}
+	s.mu.Lock()
+	s.version = v
+	s.mu.Unlock()
+
+	reply := npmp.NewVersionMessage()
+	reply.SetVersions([]byte{v})
+	s.wmu.Lock()
+	s.enc.SetVersion(v)
+	s.wmu.Unlock()
+	return s.reply(reply)
+}
+
+// register handles the Register message which moves the session to
+// StateReady when accepted. The version of the message becomes the version
+// of the session.
+func (s *Session) register(m *npmp.RegisterMessage) error {
+	v := m.Version()
+	if _, ok := npmp.NegotiateVersion(s.srv.versions(), []byte{v}); !ok {
+		return s.nak(npmp.UnsupportedVersion)
+	}
+	if err := verifyCertificate(s.conn, m.ClientID()); err != nil {
+		s.srv.logf("npmp: session %s: %s", s.RemoteAddr(), err)
+		return s.nak(npmp.NotAuthorized)
+	}
+	s.mu.Lock()
+	s.clientID = append([]byte(nil), m.ClientID()...)
+	s.version = v
+	s.mu.Unlock()
+
+	var settings *npmp.SettingsMessage
+	if s.srv.Handler.OnRegister != nil {
+		var err error
+		if settings, err = s.srv.Handler.OnRegister(s, m); err != nil {
+			return s.nakError(err)
+		}
+	}
+	// The version and the server's defaults are set on a copy, since the
+	// handler may return the same message to every session.
+	settings = cloneSettings(settings)
+	settings.SetProtocolVersion(v)
+	if _, ok := settings.Option(npmp.HeartbeatDuration); !ok && s.srv.Heartbeat > 0 {
+		if err := settings.SetHeartbeatDuration(s.srv.Heartbeat); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	if s.state == StateNew {
+		s.state = StateReady
+	}
+	s.mu.Unlock()
+
+	s.wmu.Lock()
+	s.enc.SetVersion(v)
+	s.wmu.Unlock()
+	if err := s.reply(npmp.NewACKMessage()); err != nil {
+		return err
+	}
+	if err := s.reply(settings); err != nil {
+		return err
+	}
+	if d, err := settings.HeartbeatDuration(); err == nil && d > 0 {
+		go s.hb.Run(s.ctx, d, func() error { return s.Send(npmp.NewNullMessage()) })
+	}
+	return nil
+}
+
+// cloneSettings returns a copy of m which can be changed without changing m,
+// or an empty Settings message if m is nil.
+func cloneSettings(m *npmp.SettingsMessage) *npmp.SettingsMessage {
+	if m == nil {
+		return npmp.NewSettingsMessage()
+	}
+	return &npmp.SettingsMessage{
+		Message: append(npmp.Message(nil), m.Message...),
+		Options: append([]npmp.Option(nil), m.Options...),
+	}
+}
+
+func (s *Session) nak(code npmp.NACKResponseCode) error {
+	m := npmp.NewNAKMessage()
+	m.SetResponseCode(code)
+	return s.reply(m)
+}
+
+// nakError answers the message being handled with the NAK reporting err,
+// see npmp.NewNAKFromError.
+func (s *Session) nakError(err error) error {
+	return s.reply(npmp.NewNAKFromError(err))
+}
+
+// startJob marks a job active. It returns false if it already was.
+func (s *Session) startJob(id []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.jobs[string(id)] {
+		return false
+	}
+	s.jobs[string(id)] = true
+	return true
+}
+
+// hasJob returns true if the job is active.
+func (s *Session) hasJob(id []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.jobs[string(id)]
+}
+
+// endJob removes a pending or active job and releases its port. It returns
+// false if there was no such job.
+func (s *Session) endJob(id []byte) bool {
+	s.mu.Lock()
+	_, ok := s.jobs[string(id)]
+	delete(s.jobs, string(id))
+	delete(s.specs, string(id))
+	clientID := s.clientID
+	s.mu.Unlock()
+
+	if ok && s.srv.Ports != nil {
+		s.srv.Ports.Release(clientID, id)
+	}
+	return ok
+}
+
+// leasePort leases an iperf server port to a job the client started unless
+// the server has no PortPool or the job is a Ping. It returns the Settings
+// message announcing the port and its deadline, or nil if no port is needed.
+// If the pool has a Handler which doesn't give the IperfServerAddress, the
+// address the client connected to is sent.
+func (s *Session) leasePort(id []byte) (*npmp.SettingsMessage, error) {
+	if s.srv.Ports == nil {
+		return nil, nil
+	}
+	s.mu.Lock()
+	spec := s.specs[string(id)]
+	clientID := s.clientID
+	s.mu.Unlock()
+	if spec != nil && spec.Type == npmp.Ping {
+		return nil, nil
+	}
+
+	var deadline time.Time
+	if spec != nil {
+		deadline = spec.Deadline
+	}
+	pool := s.srv.Ports
+	l, err := pool.Lease(clientID, id, deadline)
+	if err != nil {
+		return nil, err
+	}
+	m := npmp.NewSettingsMessage()
+	m.SetIperfServerPort(l.Port)
+	m.SetJobResourceDeadline(l.Deadline)
+	if pool.Handler == nil {
+		return m, nil
+	}
+	if err := pool.Handler.StartLease(l, m); err != nil {
+		return nil, err
+	}
+	if _, ok := m.Option(npmp.IperfServerAddress); !ok {
+		if addr, ok := s.conn.LocalAddr().(*net.TCPAddr); ok {
+			m.SetIperfServerAddress(addr.IP.String())
+		}
+	}
+	return m, nil
+}
+
+// offerUpdate records the software version a client reported and sends it
+// the Settings of the server's UpdatePolicy if it is stale.
+func (s *Session) offerUpdate(m *npmp.SettingsMessage) error {
+	v, err := m.ClientSoftwareVersion()
+	if err != nil {
+		return nil
+	}
+	s.mu.Lock()
+	s.software = v
+	s.mu.Unlock()
+
+	p := s.srv.Updates
+	if p == nil || !p.Stale(v) {
+		return nil
+	}
+	settings, err := p.Settings()
+	if err != nil {
+		s.srv.logf("npmp: session %s: update policy: %s", s.RemoteAddr(), err)
+		return nil
+	}
+	return s.Send(settings)
+}
+
+// releaseAll releases the ports of every job when the session ends.
+func (s *Session) releaseAll() {
+	s.mu.Lock()
+	ids := make([][]byte, 0, len(s.jobs))
+	for id := range s.jobs {
+		ids = append(ids, []byte(id))
+	}
+	s.mu.Unlock()
+	for _, id := range ids {
+		s.endJob(id)
+	}
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strings"
+)
+
+// ErrClientIDMismatch is returned when the certificate of a client doesn't
+// match the client ID it registered with.
+var ErrClientIDMismatch = errors.New("Certificate doesn't match client ID")
+
+// ErrUnverifiedCertificate is returned when a client presented a certificate
+// which wasn't verified against a CA.
+var ErrUnverifiedCertificate = errors.New("Certificate not verified")
+
+// ErrClientAuth is returned by ListenAndServeTLS when TLSConfig asks for
+// client certificates without verifying them.
+var ErrClientAuth = errors.New("Client certificates must be verified against ClientCAs")
+
+// ListenAndServeTLS listens on the TCP address addr and calls Serve with
+// connections secured by TLS. The certificate and key of the server are
+// loaded from certFile and keyFile, which may be empty if TLSConfig already
+// holds a certificate. ErrClientAuth is returned if TLSConfig asks for client
+// certificates without verifying them.
+func (srv *Server) ListenAndServeTLS(addr, certFile, keyFile string) error {
+	config := &tls.Config{}
+	if srv.TLSConfig != nil {
+		config = srv.TLSConfig.Clone()
+	}
+	if config.ClientAuth != tls.NoClientCert &&
+		(config.ClientAuth < tls.VerifyClientCertIfGiven || config.ClientCAs == nil) {
+		return ErrClientAuth
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		config.Certificates = append(config.Certificates, cert)
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return srv.Serve(tls.NewListener(l, config))
+}
+
+// verifyCertificate checks that the certificate the client presented, if
+// any, was verified and issued to clientID. The client ID is matched in hex
+// against the common name and the DNS names of the certificate.
+func verifyCertificate(conn net.Conn, clientID []byte) error {
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	state := tc.ConnectionState()
+	certs := state.PeerCertificates
+	if len(certs) == 0 {
+		return nil
+	}
+	if len(state.VerifiedChains) == 0 {
+		return ErrUnverifiedCertificate
+	}
+	if !certificateMatches(certs[0], hex.EncodeToString(clientID)) {
+		return ErrClientIDMismatch
+	}
+	return nil
+}
+
+func certificateMatches(cert *x509.Certificate, id string) bool {
+	if strings.EqualFold(cert.Subject.CommonName, id) {
+		return true
+	}
+	for _, name := range cert.DNSNames {
+		if strings.EqualFold(name, id) {
+			return true
+		}
+	}
+	return false
+}
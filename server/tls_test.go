@@ -0,0 +1,160 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/usi-lfkeitel/npmp"
+)
+
+// testCA issues certificates for tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %s", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "npmp test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create CA certificate: %s", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// issue returns a certificate for the common name, valid for 127.0.0.1.
+func (ca *testCA) issue(t *testing.T, cn string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %s", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %s", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func dialTLSTest(t *testing.T, addr string, config *tls.Config) *testClient {
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		t.Fatalf("Failed to dial server: %s", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &testClient{t: t, conn: conn, enc: npmp.NewEncoder(conn), dec: npmp.NewDecoder(conn)}
+}
+
+func TestSessionTLS(t *testing.T) {
+	ca := newTestCA(t)
+	srv := &Server{TLSConfig: &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "npmp server")},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.pool,
+	}}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	go srv.Serve(tls.NewListener(l, srv.TLSConfig))
+	t.Cleanup(func() { srv.Close() })
+	addr := l.Addr().String()
+
+	// A certificate for another client can't register as testClientID.
+	c := dialTLSTest(t, addr, &tls.Config{
+		RootCAs:      ca.pool,
+		Certificates: []tls.Certificate{ca.issue(t, "00000000000000000000000000000000")},
+	})
+	reg := npmp.NewRegisterMessage()
+	reg.SetClientID(testClientID)
+	c.send(reg)
+	c.expectNAK(npmp.NotAuthorized)
+	c.conn.Close()
+
+	c = dialTLSTest(t, addr, &tls.Config{
+		RootCAs:      ca.pool,
+		Certificates: []tls.Certificate{ca.issue(t, hex.EncodeToString(testClientID))},
+	})
+	c.register()
+	if s := srv.Session(testClientID); s == nil {
+		t.Fatal("Registered session not found")
+	}
+}
+
+func TestSessionTLSUnverified(t *testing.T) {
+	ca := newTestCA(t)
+	config := &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "npmp server")},
+		ClientAuth:   tls.RequestClientCert,
+	}
+	srv := &Server{}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	go srv.Serve(tls.NewListener(l, config))
+	t.Cleanup(func() { srv.Close() })
+
+	// A certificate from a CA the server doesn't know
+	other := newTestCA(t)
+	c := dialTLSTest(t, l.Addr().String(), &tls.Config{
+		RootCAs:      ca.pool,
+		Certificates: []tls.Certificate{other.issue(t, hex.EncodeToString(testClientID))},
+	})
+	reg := npmp.NewRegisterMessage()
+	reg.SetClientID(testClientID)
+	c.send(reg)
+	c.expectNAK(npmp.NotAuthorized)
+}
+
+func TestListenAndServeTLSErrors(t *testing.T) {
+	srv := &Server{}
+	if err := srv.ListenAndServeTLS("127.0.0.1:0", "missing.crt", "missing.key"); err == nil {
+		t.Fatal("Incorrect result. Expected an error for missing certificate files")
+	}
+
+	ca := newTestCA(t)
+	for _, config := range []*tls.Config{
+		{ClientAuth: tls.RequestClientCert, ClientCAs: ca.pool},
+		{ClientAuth: tls.RequireAnyClientCert},
+		{ClientAuth: tls.RequireAndVerifyClientCert},
+	} {
+		srv := &Server{TLSConfig: config}
+		if err := srv.ListenAndServeTLS("127.0.0.1:0", "", ""); err != ErrClientAuth {
+			t.Fatalf("Incorrect error for client auth %d. Expected ErrClientAuth, got %v", config.ClientAuth, err)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package server
+
+import (
+	"net/url"
+
+	"github.com/usi-lfkeitel/npmp"
+)
+
+// An UpdatePolicy offers the desired client software to clients reporting an
+// older ClientSoftwareVersion.
+type UpdatePolicy struct {
+	Version string   // Desired software version
+	Repo    *url.URL // Location of the software, sent as ClientSoftwareRepo
+}
+
+// Stale reports whether a client running version v should update, see
+// npmp.CompareVersions.
+func (p *UpdatePolicy) Stale(v string) bool {
+	return npmp.CompareVersions(v, p.Version) < 0
+}
+
+// Settings returns the Settings message sent to stale clients.
+func (p *UpdatePolicy) Settings() (*npmp.SettingsMessage, error) {
+	m := npmp.NewSettingsMessage()
+	if err := m.SetClientSoftwareVersion(p.Version); err != nil {
+		return nil, err
+	}
+	if err := m.SetClientSoftwareRepo(p.Repo); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
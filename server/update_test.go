@@ -0,0 +1,77 @@
+package server
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/usi-lfkeitel/npmp"
+)
+
+func TestUpdatePolicyStale(t *testing.T) {
+	p := &UpdatePolicy{Version: "1.10.0"}
+	tests := []struct {
+		version string
+		stale   bool
+	}{
+		{"1.9.2", true},
+		{"v1.9", true},
+		{"1.10", true},
+		{"1.10.0", false},
+		{"1.10.1", false},
+		{"2.0.0", false},
+	}
+	for _, tt := range tests {
+		if got := p.Stale(tt.version); got != tt.stale {
+			t.Fatalf("Incorrect result for %s. Expected %t, got %t", tt.version, tt.stale, got)
+		}
+	}
+}
+
+func TestSessionUpdate(t *testing.T) {
+	repo, _ := url.Parse("https://example.com/probe")
+	data := make(chan npmp.DataMessage, 1)
+	srv := &Server{
+		Updates: &UpdatePolicy{Version: "1.1.0", Repo: repo},
+		Handler: Handler{
+			OnData: func(s *Session, m npmp.DataMessage) error {
+				data <- m
+				return nil
+			},
+		},
+	}
+	c := dialTest(t, startServer(t, srv))
+	c.register()
+
+	// A current client is only acknowledged, so the next message read is
+	// the ACK of the second Settings.
+	m := npmp.NewSettingsMessage()
+	m.SetClientSoftwareVersion("1.1.0")
+	c.send(m)
+	c.expect(npmp.ACK)
+
+	// A stale client is offered the update.
+	m = npmp.NewSettingsMessage()
+	m.SetClientSoftwareVersion("1.0.0")
+	c.send(m)
+	c.expect(npmp.ACK)
+	offer := c.expect(npmp.Settings).(*npmp.SettingsMessage)
+	if v, err := offer.ClientSoftwareVersion(); err != nil || v != "1.1.0" {
+		t.Fatalf("Incorrect version. Expected 1.1.0, got %q (%v)", v, err)
+	}
+	if u, err := offer.ClientSoftwareRepo(); err != nil || u.String() != repo.String() {
+		t.Fatalf("Incorrect repo. Expected %s, got %v (%v)", repo, u, err)
+	}
+	if s := srv.Session(testClientID); s == nil || s.SoftwareVersion() != "1.0.0" {
+		t.Fatal("Incorrect session software version. Expected 1.0.0")
+	}
+
+	// The outcome is reported outside of a job.
+	d := npmp.NewDataMessage()
+	d.SetUpdateResult(&npmp.UpdateResult{Version: "1.1.0"})
+	c.send(d)
+	c.expect(npmp.ACK)
+	res, err := (<-data).UpdateResult()
+	if err != nil || res.Version != "1.1.0" || res.Error != "" {
+		t.Fatalf("Incorrect update result. Expected 1.1.0, got %+v (%v)", res, err)
+	}
+}
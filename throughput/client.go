@@ -0,0 +1,231 @@
+package throughput
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/usi-lfkeitel/npmp"
+	"github.com/usi-lfkeitel/npmp/client"
+)
+
+var (
+	// ErrNotThroughput is returned for jobs that aren't Iperf2 or Iperf3.
+	ErrNotThroughput = errors.New("Not a throughput job")
+
+	// ErrBidirectional is returned for bidirectional jobs, which aren't
+	// supported.
+	ErrBidirectional = errors.New("Bidirectional tests not supported")
+)
+
+// Run runs the test described by spec against the server at addr. The
+// Transport, Duration, Parallel, Bitrate, Reverse and Interval of the job are
+// used.
+func Run(ctx context.Context, addr string, spec *npmp.Job) (*npmp.IperfResult, error) {
+	if spec.Type != npmp.Iperf2 && spec.Type != npmp.Iperf3 {
+		return nil, ErrNotThroughput
+	}
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+	if spec.Bidirectional {
+		return nil, ErrBidirectional
+	}
+	req := &request{
+		transport: spec.Transport,
+		reverse:   spec.Reverse,
+		parallel:  int(spec.Parallel),
+		duration:  spec.Duration,
+		bitrate:   spec.Bitrate,
+		length:    DatagramLength,
+	}
+	if req.parallel > MaxParallel {
+		return nil, &npmp.JobError{Field: "Parallel", Reason: "too many streams"}
+	}
+
+	var d net.Dialer
+	ctrl, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conns := &closers{}
+	conns.add(ctrl)
+	defer conns.Close()
+	stop := context.AfterFunc(ctx, func() { conns.Close() })
+	defer stop()
+
+	res, err := runClient(ctx, addr, ctrl, conns, req, spec.Interval)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return res, err
+}
+
+func runClient(ctx context.Context, addr string, ctrl net.Conn, conns *closers, req *request, interval time.Duration) (*npmp.IperfResult, error) {
+	ctrl.SetDeadline(time.Now().Add(handshakeTimeout))
+	b, _ := req.MarshalBinary()
+	if _, err := ctrl.Write(b); err != nil {
+		return nil, err
+	}
+	reply := make([]byte, replyLength)
+	if _, err := io.ReadFull(ctrl, reply); err != nil {
+		return nil, err
+	}
+	if reply[0] != statusOK {
+		return nil, ErrRejected
+	}
+	token := binary.LittleEndian.Uint32(reply[1:])
+
+	var d net.Dialer
+	var streams []net.Conn
+	for i := 0; i < req.parallel; i++ {
+		c, err := d.DialContext(ctx, network(req.transport), addr)
+		if err != nil {
+			return nil, err
+		}
+		conns.add(c)
+		streams = append(streams, c)
+		switch {
+		case req.transport == npmp.TCP:
+			_, err = c.Write(append(append([]byte(nil), streamMagic...), reply[1:]...))
+		case req.reverse:
+			_, err = c.Write(hello(token))
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	res := &npmp.IperfResult{
+		Transport: req.transport,
+		Reverse:   req.reverse,
+		Parallel:  uint8(req.parallel),
+		Start:     time.Now(),
+	}
+	m := newMeter(interval, req.reverse)
+	m.start(res.Start)
+	ctrl.SetDeadline(res.Start.Add(req.duration + resultTimeout))
+
+	var peer *npmp.IperfResult
+	var err error
+	if req.reverse {
+		peer, err = receive(ctrl, m, clientReceivers(streams, req, token, m), func() {
+			if req.transport == npmp.TCP {
+				waitTCP(streams)
+				return
+			}
+			time.Sleep(udpDrain)
+			m.stop()
+			for _, c := range streams {
+				c.Close()
+			}
+		})
+	} else {
+		peer, err = send(ctrl, m, time.Now().Add(req.duration), clientSenders(streams, req, token, m, ctx.Done()))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res.Duration = m.duration()
+	res.Intervals = m.report()
+	if req.reverse {
+		res.Sent, res.Received = peer.Sent, m.summary(false)
+	} else {
+		res.Sent, res.Received = m.summary(true), peer.Received
+	}
+	return res, nil
+}
+
+func clientSenders(streams []net.Conn, req *request, token uint32, m *meter, done <-chan struct{}) []func(time.Time) {
+	rate := req.streamRate()
+	var senders []func(time.Time)
+	for _, c := range streams {
+		c := c
+		if req.transport == npmp.TCP {
+			senders = append(senders, func(end time.Time) { sendTCP(c, end, rate, m, done) })
+			continue
+		}
+		write := func(b []byte) error {
+			_, err := c.Write(b)
+			return err
+		}
+		senders = append(senders, func(end time.Time) { sendUDP(write, token, req.length, end, rate, m, done) })
+	}
+	return senders
+}
+
+func clientReceivers(streams []net.Conn, req *request, token uint32, m *meter) []func() {
+	var receivers []func()
+	for _, c := range streams {
+		c := c
+		if req.transport == npmp.TCP {
+			receivers = append(receivers, func() { recvTCP(c, m) })
+			continue
+		}
+		receivers = append(receivers, func() {
+			// The hello is sent until the server's first datagram shows it
+			// arrived.
+			got := make(chan struct{})
+			go resendHello(c, token, got)
+			first := true
+			defer func() {
+				if first {
+					close(got)
+				}
+			}()
+			key := c.LocalAddr().String()
+			buf := make([]byte, 64<<10)
+			for {
+				n, err := c.Read(buf)
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				if err == nil {
+					if first {
+						close(got)
+						first = false
+					}
+					m.datagram(key, buf[:n], time.Now())
+				}
+			}
+		})
+	}
+	return receivers
+}
+
+// A Runner is a client.Runner for Iperf2 and Iperf3 jobs which runs them
+// with the built in test instead of iperf.
+type Runner struct{}
+
+// Run runs the job against the host of its target. The port is the one in
+// the target, or the IperfServerPort of the job's settings, or DefaultPort.
+// The result has the data type of the job.
+func (Runner) Run(ctx context.Context, job *client.Job) (npmp.DataMessage, error) {
+	if job.Spec == nil {
+		return npmp.DataMessage{}, client.ErrNoJobSpec
+	}
+	addr := job.Spec.Target
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		port := int(job.Settings.IperfServerPort)
+		if port == 0 {
+			port = DefaultPort
+		}
+		addr = net.JoinHostPort(addr, strconv.Itoa(port))
+	}
+
+	res, err := Run(ctx, addr, job.Spec)
+	if err != nil {
+		return npmp.DataMessage{}, err
+	}
+	m := npmp.NewDataMessage()
+	m.SetJobID(job.ID)
+	if err := m.SetIperfResult(job.Spec.Type, res); err != nil {
+		return npmp.DataMessage{}, err
+	}
+	return m, nil
+}
@@ -0,0 +1,439 @@
+package throughput
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/usi-lfkeitel/npmp"
+)
+
+// ErrServerClosed is returned by Serve and ListenAndServe after Close.
+var ErrServerClosed = errors.New("Server closed")
+
+// A Server accepts throughput tests. Several tests can run at once.
+type Server struct {
+	// MaxDuration is the longest test accepted. If zero,
+	// DefaultMaxDuration is used.
+	MaxDuration time.Duration
+
+	// MaxBitrate is the highest bitrate in bits per second the server sends
+	// at in a reverse test. Faster or unlimited requests are sent at
+	// MaxBitrate. If zero, DefaultMaxBitrate is used.
+	MaxBitrate uint64
+
+	// ErrorLog specifies an optional logger for errors. If nil, the log
+	// package's standard logger is used.
+	ErrorLog *log.Logger
+
+	mu     sync.Mutex
+	l      net.Listener
+	pc     net.PacketConn
+	tests  map[uint32]*test
+	closed bool
+}
+
+// A test is a test being run by a Server.
+type test struct {
+	req     *request
+	token   uint32
+	ip      net.IP // Of the control connection
+	m       *meter
+	conns   closers
+	streams chan net.Conn // TCP streams as they connect
+	peers   chan net.Addr // UDP streams of a reverse test as they say hello
+	mu      sync.Mutex
+	seen    map[string]bool
+}
+
+// ListenAndServe listens on the TCP and UDP address addr and calls Serve.
+func (srv *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	port := l.Addr().(*net.TCPAddr).Port
+	pc, err := net.ListenPacket("udp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		l.Close()
+		return err
+	}
+	return srv.Serve(l, pc)
+}
+
+// Serve accepts tests on l. UDP tests use pc, which should be bound to the
+// same port as l. If pc is nil only TCP tests are accepted. Serve always
+// returns a non-nil error and closes l and pc.
+func (srv *Server) Serve(l net.Listener, pc net.PacketConn) error {
+	srv.mu.Lock()
+	if srv.closed || srv.l != nil {
+		srv.mu.Unlock()
+		l.Close()
+		if pc != nil {
+			pc.Close()
+		}
+		return ErrServerClosed
+	}
+	srv.l, srv.pc = l, pc
+	srv.mu.Unlock()
+	defer l.Close()
+	if pc != nil {
+		defer pc.Close()
+		go srv.serveUDP(pc)
+	}
+
+	var delay time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if srv.isClosed() {
+				return ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				srv.logf("npmp: throughput accept error: %s; retrying in %s", err, delay)
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+		go srv.serveConn(conn)
+	}
+}
+
+// Close stops the server and aborts running tests.
+func (srv *Server) Close() error {
+	srv.mu.Lock()
+	srv.closed = true
+	var err error
+	if srv.l != nil {
+		err = srv.l.Close()
+	}
+	if srv.pc != nil {
+		srv.pc.Close()
+	}
+	tests := make([]*test, 0, len(srv.tests))
+	for _, t := range srv.tests {
+		tests = append(tests, t)
+	}
+	srv.mu.Unlock()
+
+	for _, t := range tests {
+		t.conns.Close()
+	}
+	return err
+}
+
+// Addr returns the address the server listens on, or nil before Serve.
+func (srv *Server) Addr() net.Addr {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.l == nil {
+		return nil
+	}
+	return srv.l.Addr()
+}
+
+// serveConn reads the first message of a connection, which is either a test
+// request or the start of a TCP stream.
+func (srv *Server) serveConn(c net.Conn) {
+	c.SetDeadline(time.Now().Add(handshakeTimeout))
+	b := make([]byte, requestLength)
+	if _, err := io.ReadFull(c, b[:4]); err != nil {
+		c.Close()
+		return
+	}
+
+	switch string(b[:4]) {
+	case string(controlMagic):
+		req := &request{}
+		if _, err := io.ReadFull(c, b[4:]); err != nil || req.UnmarshalBinary(b) != nil {
+			c.Close()
+			return
+		}
+		srv.runTest(c, req)
+	case string(streamMagic):
+		if _, err := io.ReadFull(c, b[:4]); err != nil {
+			c.Close()
+			return
+		}
+		t := srv.test(binary.LittleEndian.Uint32(b))
+		if t == nil || !t.addStream(c) {
+			c.Close()
+		}
+	default:
+		c.Close()
+	}
+}
+
+// serveUDP receives the datagrams of every UDP test.
+func (srv *Server) serveUDP(pc net.PacketConn) {
+	buf := make([]byte, 64<<10)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		if n < datagramHeaderLength {
+			continue
+		}
+		t := srv.test(binary.LittleEndian.Uint32(buf))
+		if t == nil {
+			continue
+		}
+		if !t.from(addr) {
+			continue
+		}
+		if binary.LittleEndian.Uint32(buf[4:]) == helloSeq {
+			t.hello(addr)
+		} else if !t.req.reverse {
+			t.m.datagram(addr.String(), buf[:n], time.Now())
+		}
+	}
+}
+
+func (srv *Server) runTest(ctrl net.Conn, req *request) {
+	reply := make([]byte, replyLength)
+	if reply[0] = srv.check(req); reply[0] != statusOK {
+		ctrl.Write(reply)
+		ctrl.Close()
+		return
+	}
+
+	srv.limit(req)
+
+	t, err := srv.addTest(req, ctrl.RemoteAddr())
+	if err != nil {
+		srv.logf("npmp: throughput test from %s: %s", ctrl.RemoteAddr(), err)
+		ctrl.Close()
+		return
+	}
+	defer srv.removeTest(t)
+	defer t.conns.Close()
+	if !t.conns.add(ctrl) {
+		return
+	}
+
+	binary.LittleEndian.PutUint32(reply[1:], t.token)
+	if req.transport == npmp.UDP && !req.reverse {
+		// There are no streams to wait for, datagrams may arrive as soon as
+		// the client has the token.
+		t.m.start(time.Now())
+	}
+	if _, err := ctrl.Write(reply); err != nil {
+		return
+	}
+	if err := srv.run(ctrl, t); err != nil && !srv.isClosed() {
+		srv.logf("npmp: throughput test from %s: %s", ctrl.RemoteAddr(), err)
+	}
+}
+
+// check returns the status of the reply to req.
+func (srv *Server) check(req *request) byte {
+	maxDuration := srv.MaxDuration
+	if maxDuration <= 0 {
+		maxDuration = DefaultMaxDuration
+	}
+	switch {
+	case req.transport != npmp.TCP && req.transport != npmp.UDP,
+		req.parallel < 1 || req.parallel > MaxParallel,
+		req.duration <= 0 || req.duration > maxDuration,
+		req.transport == npmp.UDP && req.length < datagramHeaderLength:
+		return statusInvalid
+	case req.transport == npmp.UDP && srv.pc == nil:
+		return statusUnsupported
+	}
+	return statusOK
+}
+
+// limit caps the bitrate of a reverse test to MaxBitrate.
+func (srv *Server) limit(req *request) {
+	if !req.reverse {
+		return
+	}
+	maxBitrate := srv.MaxBitrate
+	if maxBitrate == 0 {
+		maxBitrate = DefaultMaxBitrate
+	}
+	if req.bitrate > maxBitrate || req.bitrate == 0 && req.transport == npmp.TCP {
+		req.bitrate = maxBitrate
+	}
+}
+
+// run waits for the streams of the test and runs it.
+func (srv *Server) run(ctrl net.Conn, t *test) error {
+	req := t.req
+	timeout := time.NewTimer(handshakeTimeout)
+	defer timeout.Stop()
+	var streams []net.Conn
+	var peers []net.Addr
+	for req.transport == npmp.TCP && len(streams) < req.parallel {
+		select {
+		case c := <-t.streams:
+			streams = append(streams, c)
+		case <-timeout.C:
+			return errors.New("Timed out waiting for streams")
+		}
+	}
+	for req.transport == npmp.UDP && req.reverse && len(peers) < req.parallel {
+		select {
+		case a := <-t.peers:
+			peers = append(peers, a)
+		case <-timeout.C:
+			return errors.New("Timed out waiting for streams")
+		}
+	}
+	if req.transport == npmp.TCP || req.reverse {
+		t.m.start(time.Now())
+	}
+	ctrl.SetDeadline(time.Now().Add(req.duration + resultTimeout))
+
+	var err error
+	if req.reverse {
+		_, err = send(ctrl, t.m, time.Now().Add(req.duration), srv.senders(t, streams, peers))
+		return err
+	}
+	var receivers []func()
+	for _, c := range streams {
+		c := c
+		receivers = append(receivers, func() { recvTCP(c, t.m) })
+	}
+	_, err = receive(ctrl, t.m, receivers, func() {
+		if req.transport == npmp.TCP {
+			waitTCP(streams)
+			return
+		}
+		time.Sleep(udpDrain)
+		t.m.stop()
+	})
+	return err
+}
+
+func (srv *Server) senders(t *test, streams []net.Conn, peers []net.Addr) []func(time.Time) {
+	rate := t.req.streamRate()
+	var senders []func(time.Time)
+	for _, c := range streams {
+		c := c
+		senders = append(senders, func(end time.Time) { sendTCP(c, end, rate, t.m, nil) })
+	}
+	for _, a := range peers {
+		a := a
+		write := func(b []byte) error {
+			_, err := srv.pc.WriteTo(b, a)
+			return err
+		}
+		senders = append(senders, func(end time.Time) { sendUDP(write, t.token, t.req.length, end, rate, t.m, nil) })
+	}
+	return senders
+}
+
+func (srv *Server) addTest(req *request, ctrl net.Addr) (*test, error) {
+	t := &test{
+		req:     req,
+		ip:      addrIP(ctrl),
+		m:       newMeter(0, req.reverse),
+		streams: make(chan net.Conn, req.parallel),
+		peers:   make(chan net.Addr, req.parallel),
+		seen:    make(map[string]bool),
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.tests == nil {
+		srv.tests = make(map[uint32]*test)
+	}
+	var b [4]byte
+	for {
+		if _, err := rand.Read(b[:]); err != nil {
+			return nil, err
+		}
+		t.token = binary.LittleEndian.Uint32(b[:])
+		if _, ok := srv.tests[t.token]; !ok {
+			break
+		}
+	}
+	srv.tests[t.token] = t
+	return t, nil
+}
+
+func (srv *Server) removeTest(t *test) {
+	srv.mu.Lock()
+	delete(srv.tests, t.token)
+	srv.mu.Unlock()
+}
+
+func (srv *Server) test(token uint32) *test {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.tests[token]
+}
+
+func (srv *Server) isClosed() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.closed
+}
+
+func (srv *Server) logf(format string, args ...interface{}) {
+	if srv.ErrorLog != nil {
+		srv.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// addStream hands a TCP stream to the test, false if it has all its streams.
+func (t *test) addStream(c net.Conn) bool {
+	c.SetDeadline(time.Time{})
+	if !t.conns.add(c) {
+		return false
+	}
+	select {
+	case t.streams <- c:
+		return true
+	default:
+		return false
+	}
+}
+
+// from reports whether a datagram from addr may belong to the test. Only the
+// host of the control connection may take part.
+func (t *test) from(addr net.Addr) bool {
+	return t.ip != nil && t.ip.Equal(addrIP(addr))
+}
+
+// hello records the address of a UDP stream of a reverse test.
+func (t *test) hello(addr net.Addr) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.seen[addr.String()] || len(t.seen) >= t.req.parallel {
+		return
+	}
+	t.seen[addr.String()] = true
+	t.peers <- addr
+}
+
+// addrIP returns the IP of a TCP or UDP address, nil for other addresses.
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	return nil
+}
@@ -0,0 +1,553 @@
+// Package throughput is a built in TCP and UDP throughput test, for probes
+// where running iperf isn't practical. A Server accepts tests and Run, or a
+// Runner for client jobs, runs one against it. Results are reported as
+// npmp.IperfResult values like those of iperf3.
+//
+// # Protocol
+//
+// A test starts with a control connection over TCP. Integers are little
+// endian. The client sends a request:
+//
+//	magic       "PMTP"
+//	version     1 byte, 1
+//	transport   1 byte, TCP or UDP
+//	flags       1 byte, bit 0 reverse
+//	parallel    1 byte, number of streams
+//	duration    uint32 milliseconds
+//	bitrate     uint64 bits per second over all streams, 0 for unlimited
+//	length      uint16 UDP datagram length
+//
+// The server answers with a status byte, 0 if the test is accepted, and a
+// random uint32 token. The client then opens the streams. A TCP stream is a
+// connection to the same address starting with "PMTS" and the token. UDP
+// streams are datagrams between a client socket per stream and the server's
+// UDP socket on the same port, each starting with the token, a uint32
+// sequence number and the int64 send time in nanoseconds. In a reverse test a
+// UDP stream first sends a datagram with sequence number 0xffffffff so the
+// server knows where to send. As it may be lost, the hello is sent again every
+// 100 milliseconds until the first datagram arrives, for at most the 10
+// second handshake timeout. The server ignores repeated hellos and datagrams
+// from hosts other than the one of the control connection.
+//
+// The sending side sends for the duration, closes its TCP streams and writes
+// its result on the control connection. The receiving side then finishes
+// receiving and writes its own result. A result is a uint32 length followed
+// by an encoded npmp.IperfResult with only Sent or Received set.
+package throughput
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/usi-lfkeitel/npmp"
+)
+
+const (
+	DefaultPort        = 5201
+	DefaultMaxDuration = 5 * time.Minute
+	DefaultUDPBitrate  = 1000000    // Used for UDP tests without a bitrate, like iperf
+	DefaultMaxBitrate  = 1000000000 // Highest bitrate a Server sends at
+	DatagramLength     = 1400
+	MaxParallel        = 128
+)
+
+const (
+	protocolVersion      = 1
+	requestLength        = 22
+	replyLength          = 5
+	datagramHeaderLength = 16
+	helloSeq             = math.MaxUint32
+	maxResultLength      = 1 << 16
+	tcpBufferLength      = 128 << 10
+
+	handshakeTimeout = 10 * time.Second
+	helloInterval    = 100 * time.Millisecond
+	resultTimeout    = 10 * time.Second // Beyond the duration of the test
+	udpDrain         = 100 * time.Millisecond
+)
+
+// Reply status codes.
+const (
+	statusOK byte = iota
+	statusInvalid
+	statusUnsupported
+)
+
+var (
+	controlMagic = []byte("PMTP")
+	streamMagic  = []byte("PMTS")
+)
+
+var (
+	// ErrRejected is returned when the server refuses a test.
+	ErrRejected = errors.New("Test rejected by server")
+
+	// ErrProtocol is returned when the peer sends something unexpected.
+	ErrProtocol = errors.New("Invalid throughput test message")
+)
+
+// request is the test requested by a client.
+type request struct {
+	transport npmp.Transport
+	reverse   bool
+	parallel  int
+	duration  time.Duration
+	bitrate   uint64
+	length    int
+}
+
+func (r *request) MarshalBinary() ([]byte, error) {
+	b := make([]byte, requestLength)
+	copy(b, controlMagic)
+	b[4] = protocolVersion
+	b[5] = byte(r.transport)
+	if r.reverse {
+		b[6] |= 1
+	}
+	b[7] = byte(r.parallel)
+	binary.LittleEndian.PutUint32(b[8:], uint32(r.duration.Milliseconds()))
+	binary.LittleEndian.PutUint64(b[12:], r.bitrate)
+	binary.LittleEndian.PutUint16(b[20:], uint16(r.length))
+	return b, nil
+}
+
+// UnmarshalBinary decodes a request, the magic included.
+func (r *request) UnmarshalBinary(b []byte) error {
+	if len(b) != requestLength || string(b[:4]) != string(controlMagic) || b[4] != protocolVersion {
+		return ErrProtocol
+	}
+	*r = request{
+		transport: npmp.Transport(b[5]),
+		reverse:   b[6]&1 != 0,
+		parallel:  int(b[7]),
+		duration:  time.Duration(binary.LittleEndian.Uint32(b[8:])) * time.Millisecond,
+		bitrate:   binary.LittleEndian.Uint64(b[12:]),
+		length:    int(binary.LittleEndian.Uint16(b[20:])),
+	}
+	return nil
+}
+
+// network returns the name of the network for dialing or listening.
+func network(t npmp.Transport) string {
+	if t == npmp.UDP {
+		return "udp"
+	}
+	return "tcp"
+}
+
+// streamRate is the bitrate of each stream, 0 for unlimited.
+func (r *request) streamRate() float64 {
+	rate := r.bitrate
+	if rate == 0 && r.transport == npmp.UDP {
+		rate = DefaultUDPBitrate
+	}
+	return float64(rate) / float64(r.parallel)
+}
+
+func writeResult(w io.Writer, res *npmp.IperfResult) error {
+	b, err := res.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	frame := make([]byte, 4, 4+len(b))
+	binary.LittleEndian.PutUint32(frame, uint32(len(b)))
+	_, err = w.Write(append(frame, b...))
+	return err
+}
+
+func readResult(r io.Reader) (*npmp.IperfResult, error) {
+	var h [4]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return nil, err
+	}
+	l := binary.LittleEndian.Uint32(h[:])
+	if l > maxResultLength {
+		return nil, ErrProtocol
+	}
+	b := make([]byte, l)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	res := &npmp.IperfResult{}
+	if err := res.UnmarshalBinary(b); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrProtocol, err)
+	}
+	return res, nil
+}
+
+// udpStream holds the receiver statistics of a UDP stream.
+type udpStream struct {
+	received uint64
+	expected uint64        // Highest sequence number seen plus one
+	jitter   float64       // RFC 3550 interarrival jitter in seconds
+	transit  time.Duration // Of the previous datagram
+}
+
+// A meter counts the traffic of one side of a test and divides it into
+// intervals.
+type meter struct {
+	interval time.Duration
+	reverse  bool
+
+	mu        sync.Mutex
+	begin     time.Time
+	last      time.Time
+	stopped   bool
+	bytes     uint64
+	packets   uint64 // Datagrams sent
+	mark      uint64 // bytes at markTime
+	markTime  time.Time
+	intervals []npmp.IperfInterval
+	streams   map[string]*udpStream
+}
+
+func newMeter(interval time.Duration, reverse bool) *meter {
+	if interval <= 0 {
+		interval = time.Second
+	}
+	return &meter{interval: interval, reverse: reverse, streams: make(map[string]*udpStream)}
+}
+
+// start begins counting.
+func (m *meter) start(t time.Time) {
+	m.mu.Lock()
+	m.begin, m.last, m.markTime = t, t, t
+	m.mu.Unlock()
+}
+
+// add counts n bytes moved at t.
+func (m *meter) add(n int, t time.Time) {
+	m.mu.Lock()
+	m.addLocked(n, t)
+	m.mu.Unlock()
+}
+
+func (m *meter) addLocked(n int, t time.Time) {
+	if m.stopped || m.begin.IsZero() {
+		return
+	}
+	m.roll(t)
+	m.bytes += uint64(n)
+	if t.After(m.last) {
+		m.last = t
+	}
+}
+
+// sent counts a datagram sent at t.
+func (m *meter) sent(n int, t time.Time) {
+	m.mu.Lock()
+	if !m.stopped {
+		m.packets++
+	}
+	m.addLocked(n, t)
+	m.mu.Unlock()
+}
+
+// datagram counts a datagram received from the stream with the given key at
+// t.
+func (m *meter) datagram(key string, b []byte, t time.Time) {
+	if len(b) < datagramHeaderLength {
+		return
+	}
+	seq := binary.LittleEndian.Uint32(b[4:])
+	sentAt := time.Duration(binary.LittleEndian.Uint64(b[8:]))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.stopped || m.begin.IsZero() {
+		return
+	}
+	s := m.streams[key]
+	if s == nil {
+		s = &udpStream{}
+		m.streams[key] = s
+	}
+	transit := t.Sub(m.begin) - sentAt
+	if s.received > 0 {
+		d := (transit - s.transit).Seconds()
+		s.jitter += (math.Abs(d) - s.jitter) / 16
+	}
+	s.transit = transit
+	s.received++
+	if uint64(seq) >= s.expected {
+		s.expected = uint64(seq) + 1
+	}
+	m.addLocked(len(b), t)
+}
+
+// roll closes the intervals which ended before t.
+func (m *meter) roll(t time.Time) {
+	for !t.Before(m.markTime.Add(m.interval)) {
+		m.closeInterval(m.markTime.Add(m.interval))
+	}
+}
+
+func (m *meter) closeInterval(end time.Time) {
+	d := end.Sub(m.markTime)
+	bytes := m.bytes - m.mark
+	m.intervals = append(m.intervals, npmp.IperfInterval{
+		Start:         m.markTime.Sub(m.begin),
+		End:           end.Sub(m.begin),
+		Bytes:         bytes,
+		BitsPerSecond: float64(bytes*8) / d.Seconds(),
+		Reverse:       m.reverse,
+	})
+	m.mark, m.markTime = m.bytes, end
+}
+
+// stop stops counting and closes the last interval unless it's very short.
+func (m *meter) stop() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.stopped {
+		return
+	}
+	m.stopped = true
+	if m.begin.IsZero() {
+		return
+	}
+	m.roll(m.last)
+	if m.last.Sub(m.markTime) >= m.interval/10 {
+		m.closeInterval(m.last)
+	}
+}
+
+// summary returns the totals as seen by the sender or the receiver.
+func (m *meter) summary(sender bool) npmp.IperfSummary {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := npmp.IperfSummary{Bytes: m.bytes}
+	if d := m.last.Sub(m.begin); d > 0 {
+		s.BitsPerSecond = float64(m.bytes*8) / d.Seconds()
+	}
+	if sender {
+		s.Packets = m.packets
+		return s
+	}
+	var jitter float64
+	for _, st := range m.streams {
+		s.Packets += st.expected
+		if st.expected > st.received {
+			s.LostPackets += st.expected - st.received
+		}
+		jitter += st.jitter
+	}
+	if len(m.streams) > 0 {
+		s.Jitter = time.Duration(jitter / float64(len(m.streams)) * float64(time.Second))
+	}
+	return s
+}
+
+// duration returns the time counted.
+func (m *meter) duration() time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.last.Sub(m.begin)
+}
+
+func (m *meter) report() []npmp.IperfInterval {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]npmp.IperfInterval(nil), m.intervals...)
+}
+
+// send runs the sending side of a test until end and exchanges results with
+// the receiver.
+func send(ctrl net.Conn, m *meter, end time.Time, senders []func(end time.Time)) (*npmp.IperfResult, error) {
+	var wg sync.WaitGroup
+	for _, f := range senders {
+		wg.Add(1)
+		go func(f func(time.Time)) {
+			defer wg.Done()
+			f(end)
+		}(f)
+	}
+	wg.Wait()
+	m.stop()
+
+	if err := writeResult(ctrl, &npmp.IperfResult{Sent: m.summary(true)}); err != nil {
+		return nil, err
+	}
+	return readResult(ctrl)
+}
+
+// receive runs the receiving side of a test and exchanges results with the
+// sender. finish is called once the sender's result arrived and must make
+// the receivers return.
+func receive(ctrl net.Conn, m *meter, receivers []func(), finish func()) (*npmp.IperfResult, error) {
+	var wg sync.WaitGroup
+	for _, f := range receivers {
+		wg.Add(1)
+		go func(f func()) {
+			defer wg.Done()
+			f()
+		}(f)
+	}
+
+	peer, err := readResult(ctrl)
+	if err != nil {
+		return nil, err
+	}
+	finish()
+	wg.Wait()
+	m.stop()
+	if err := writeResult(ctrl, &npmp.IperfResult{Received: m.summary(false)}); err != nil {
+		return nil, err
+	}
+	return peer, nil
+}
+
+// waitTCP bounds how long the receivers wait for the sender to close TCP
+// streams.
+func waitTCP(streams []net.Conn) {
+	for _, c := range streams {
+		c.SetReadDeadline(time.Now().Add(resultTimeout))
+	}
+}
+
+// A pacer limits a stream to a bitrate.
+type pacer struct {
+	rate  float64 // Bits per second, 0 for unlimited
+	start time.Time
+	bytes uint64
+}
+
+// wait sleeps until the next write is due, but not past end.
+func (p *pacer) wait(end time.Time) {
+	if p.rate <= 0 {
+		return
+	}
+	due := p.start.Add(time.Duration(float64(p.bytes*8) / p.rate * float64(time.Second)))
+	if due.After(end) {
+		due = end
+	}
+	if d := time.Until(due); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// sendTCP writes to c until end or until done is closed, then closes c.
+func sendTCP(c net.Conn, end time.Time, rate float64, m *meter, done <-chan struct{}) {
+	defer c.Close()
+	chunk := tcpBufferLength
+	if rate > 0 {
+		// Send about every 10ms to keep limited streams smooth.
+		chunk = max(1024, min(chunk, int(rate/8/100)))
+	}
+	buf := make([]byte, chunk)
+	p := &pacer{rate: rate, start: time.Now()}
+	c.SetWriteDeadline(end)
+	for time.Now().Before(end) {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		p.wait(end)
+		n, err := c.Write(buf)
+		p.bytes += uint64(n)
+		m.add(n, time.Now())
+		if err != nil {
+			return
+		}
+	}
+}
+
+// recvTCP reads from c until the sender closes it.
+func recvTCP(c net.Conn, m *meter) {
+	buf := make([]byte, tcpBufferLength)
+	for {
+		n, err := c.Read(buf)
+		m.add(n, time.Now())
+		if err != nil {
+			return
+		}
+	}
+}
+
+// sendUDP sends datagrams of the given length until end or until done is
+// closed.
+func sendUDP(write func([]byte) error, token uint32, length int, end time.Time, rate float64, m *meter, done <-chan struct{}) {
+	b := make([]byte, max(length, datagramHeaderLength))
+	binary.LittleEndian.PutUint32(b, token)
+	p := &pacer{rate: rate, start: time.Now()}
+	for seq := uint32(0); time.Now().Before(end) && seq < helloSeq; seq++ {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		p.wait(end)
+		now := time.Now()
+		binary.LittleEndian.PutUint32(b[4:], seq)
+		binary.LittleEndian.PutUint64(b[8:], uint64(now.Sub(m.begin)))
+		p.bytes += uint64(len(b))
+		if err := write(b); err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue // Probably a full buffer, the datagram is lost
+		}
+		m.sent(len(b), now)
+	}
+}
+
+// resendHello sends the hello of a reverse UDP stream again every
+// helloInterval until got is closed or the server stops waiting for it.
+func resendHello(c net.Conn, token uint32, got <-chan struct{}) {
+	t := time.NewTicker(helloInterval)
+	defer t.Stop()
+	for i := 1; i < int(handshakeTimeout/helloInterval); i++ {
+		select {
+		case <-got:
+			return
+		case <-t.C:
+		}
+		if _, err := c.Write(hello(token)); err != nil {
+			return
+		}
+	}
+}
+
+// hello returns the datagram a reverse UDP stream starts with.
+func hello(token uint32) []byte {
+	b := make([]byte, datagramHeaderLength)
+	binary.LittleEndian.PutUint32(b, token)
+	binary.LittleEndian.PutUint32(b[4:], helloSeq)
+	return b
+}
+
+// closers closes the connections of a test when it's aborted.
+type closers struct {
+	mu     sync.Mutex
+	closed bool
+	list   []io.Closer
+}
+
+// add tracks c, closing it at once if the test was already aborted.
+func (cs *closers) add(c io.Closer) bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.closed {
+		c.Close()
+		return false
+	}
+	cs.list = append(cs.list, c)
+	return true
+}
+
+func (cs *closers) Close() error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.closed = true
+	for _, c := range cs.list {
+		c.Close()
+	}
+	return nil
+}
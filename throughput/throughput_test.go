@@ -0,0 +1,244 @@
+package throughput
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/usi-lfkeitel/npmp"
+	"github.com/usi-lfkeitel/npmp/client"
+)
+
+func startServer(t *testing.T) (*Server, string) {
+	srv := &Server{MaxDuration: 10 * time.Second}
+	return srv, serve(t, srv)
+}
+
+func serve(t *testing.T, srv *Server) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	pc, err := net.ListenPacket("udp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	go srv.Serve(l, pc)
+	t.Cleanup(func() { srv.Close() })
+	return l.Addr().String()
+}
+
+func testJob(transport npmp.Transport, reverse bool, parallel uint8, bitrate uint64) *npmp.Job {
+	return &npmp.Job{
+		ID:        []byte{1, 2, 3, 4},
+		Type:      npmp.Iperf3,
+		Transport: transport,
+		Target:    "127.0.0.1",
+		Duration:  300 * time.Millisecond,
+		Interval:  100 * time.Millisecond,
+		Parallel:  parallel,
+		Bitrate:   bitrate,
+		Reverse:   reverse,
+	}
+}
+
+func TestTCP(t *testing.T) {
+	_, addr := startServer(t)
+	for _, reverse := range []bool{false, true} {
+		res, err := Run(context.Background(), addr, testJob(npmp.TCP, reverse, 2, 0))
+		if err != nil {
+			t.Fatalf("Failed to run test (reverse %t): %s", reverse, err)
+		}
+		if res.Transport != npmp.TCP || res.Reverse != reverse || res.Parallel != 2 {
+			t.Fatalf("Incorrect test parameters: %+v", res)
+		}
+		if res.Sent.Bytes == 0 || res.Sent.Bytes != res.Received.Bytes {
+			t.Fatalf("Incorrect bytes. Expected equal non zero counts, sent %d and received %d", res.Sent.Bytes, res.Received.Bytes)
+		}
+		if res.Received.BitsPerSecond <= 0 || res.Duration < 250*time.Millisecond {
+			t.Fatalf("Incorrect receiver summary: %+v over %s", res.Received, res.Duration)
+		}
+		if len(res.Intervals) < 2 || res.Intervals[0].Reverse != reverse || res.Intervals[1].Start != 100*time.Millisecond {
+			t.Fatalf("Incorrect intervals: %+v", res.Intervals)
+		}
+	}
+}
+
+func TestTCPBitrate(t *testing.T) {
+	_, addr := startServer(t)
+	res, err := Run(context.Background(), addr, testJob(npmp.TCP, false, 1, 8000000))
+	if err != nil {
+		t.Fatalf("Failed to run test: %s", err)
+	}
+	// 8 Mbit/s for 300ms is 300 KB.
+	if res.Sent.Bytes < 200000 || res.Sent.Bytes > 400000 {
+		t.Fatalf("Incorrect bytes for limited test. Expected about 300000, got %d", res.Sent.Bytes)
+	}
+}
+
+func TestMaxBitrate(t *testing.T) {
+	addr := serve(t, &Server{MaxBitrate: 8000000})
+	res, err := Run(context.Background(), addr, testJob(npmp.TCP, true, 1, 0))
+	if err != nil {
+		t.Fatalf("Failed to run test: %s", err)
+	}
+	// 8 Mbit/s for 300ms is 300 KB.
+	if res.Sent.Bytes < 200000 || res.Sent.Bytes > 400000 {
+		t.Fatalf("Incorrect bytes for capped test. Expected about 300000, got %d", res.Sent.Bytes)
+	}
+}
+
+func TestUDP(t *testing.T) {
+	_, addr := startServer(t)
+	for _, reverse := range []bool{false, true} {
+		res, err := Run(context.Background(), addr, testJob(npmp.UDP, reverse, 2, 2000000))
+		if err != nil {
+			t.Fatalf("Failed to run test (reverse %t): %s", reverse, err)
+		}
+		if res.Transport != npmp.UDP || res.Reverse != reverse {
+			t.Fatalf("Incorrect test parameters: %+v", res)
+		}
+		if res.Sent.Packets == 0 || res.Received.Packets == 0 || res.Received.Packets > res.Sent.Packets {
+			t.Fatalf("Incorrect packets. Sent %d, received %d", res.Sent.Packets, res.Received.Packets)
+		}
+		if res.Received.Bytes == 0 || res.Received.LostPackets > res.Received.Packets {
+			t.Fatalf("Incorrect receiver summary: %+v", res.Received)
+		}
+	}
+}
+
+func TestRejected(t *testing.T) {
+	_, addr := startServer(t)
+	job := testJob(npmp.TCP, false, 1, 0)
+	job.Duration = time.Minute
+	if _, err := Run(context.Background(), addr, job); err != ErrRejected {
+		t.Fatalf("Incorrect error. Expected ErrRejected, got %v", err)
+	}
+	job.Bidirectional = true
+	if _, err := Run(context.Background(), addr, job); err != ErrBidirectional {
+		t.Fatalf("Incorrect error. Expected ErrBidirectional, got %v", err)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	_, addr := startServer(t)
+	job := testJob(npmp.TCP, true, 1, 0)
+	job.Duration = 5 * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := Run(ctx, addr, job); err != context.DeadlineExceeded {
+		t.Fatalf("Incorrect error. Expected DeadlineExceeded, got %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("Test took %s to stop after cancel", d)
+	}
+}
+
+func TestRunner(t *testing.T) {
+	_, addr := startServer(t)
+	_, port, _ := net.SplitHostPort(addr)
+	job := &client.Job{ID: []byte{1, 2, 3, 4}, Spec: testJob(npmp.TCP, false, 1, 0)}
+	p, _ := strconv.Atoi(port)
+	job.Settings.IperfServerPort = uint16(p)
+
+	m, err := Runner{}.Run(context.Background(), job)
+	if err != nil {
+		t.Fatalf("Failed to run job: %s", err)
+	}
+	if m.Type() != npmp.Iperf3 || string(m.JobID()) != string(job.ID) {
+		t.Fatalf("Incorrect message. Expected Iperf3 for job %v, got %s for job %v", job.ID, m.Type(), m.JobID())
+	}
+	res, err := m.IperfResult()
+	if err != nil {
+		t.Fatalf("Failed to decode result: %s", err)
+	}
+	if res.Received.Bytes == 0 {
+		t.Fatal("Incorrect result. Expected received bytes")
+	}
+}
+
+func TestForeignHello(t *testing.T) {
+	_, addr := startServer(t)
+	ctrl, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	defer ctrl.Close()
+	req := &request{transport: npmp.UDP, reverse: true, parallel: 1, duration: time.Second, bitrate: 1000000, length: DatagramLength}
+	b, _ := req.MarshalBinary()
+	if _, err := ctrl.Write(b); err != nil {
+		t.Fatalf("Failed to send request: %s", err)
+	}
+	reply := make([]byte, replyLength)
+	if _, err := io.ReadFull(ctrl, reply); err != nil || reply[0] != statusOK {
+		t.Fatalf("Incorrect reply. Expected OK, got %v (%v)", reply, err)
+	}
+
+	hello := make([]byte, datagramHeaderLength)
+	copy(hello, reply[1:])
+	binary.LittleEndian.PutUint32(hello[4:], helloSeq)
+	recv := func(local string) bool {
+		pc, err := net.ListenPacket("udp", local)
+		if err != nil {
+			t.Fatalf("Failed to listen: %s", err)
+		}
+		defer pc.Close()
+		raddr, _ := net.ResolveUDPAddr("udp", addr)
+		if _, err := pc.WriteTo(hello, raddr); err != nil {
+			t.Fatalf("Failed to send hello: %s", err)
+		}
+		pc.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+		_, _, err = pc.ReadFrom(make([]byte, 64<<10))
+		return err == nil
+	}
+	if recv("127.0.0.2:0") {
+		t.Fatal("Incorrect stream. Expected no data for a hello from another host")
+	}
+	if !recv("127.0.0.1:0") {
+		t.Fatal("Incorrect stream. Expected data for a hello from the client host")
+	}
+}
+
+// lossyPacketConn drops the first hello it reads.
+type lossyPacketConn struct {
+	net.PacketConn
+	dropped bool
+}
+
+func (p *lossyPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := p.PacketConn.ReadFrom(b)
+		if err == nil && !p.dropped && n >= datagramHeaderLength && binary.LittleEndian.Uint32(b[4:]) == helloSeq {
+			p.dropped = true
+			continue
+		}
+		return n, addr, err
+	}
+}
+
+func TestLostHello(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	pc, err := net.ListenPacket("udp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	srv := &Server{MaxDuration: 10 * time.Second}
+	go srv.Serve(l, &lossyPacketConn{PacketConn: pc})
+	defer srv.Close()
+
+	res, err := Run(context.Background(), l.Addr().String(), testJob(npmp.UDP, true, 1, 2000000))
+	if err != nil {
+		t.Fatalf("Failed to run test: %s", err)
+	}
+	if res.Received.Packets == 0 {
+		t.Fatalf("Incorrect packets. Expected some received, got %d", res.Received.Packets)
+	}
+}
@@ -0,0 +1,219 @@
+// Package update installs the client software an NPMP server offers through
+// the ClientSoftwareVersion and ClientSoftwareRepo options. An Updater is a
+// client.Updater.
+//
+// Next to the artifact at the repo URL, the server publishes its SHA-256
+// checksum at the same URL with ".sha256" appended, in the format written by
+// sha256sum. If the Updater has a PublicKey, an Ed25519 signature over the
+// 32 byte digest followed by the version as UTF-8 text is published with
+// ".sig" appended, so that an artifact can't be offered as another version.
+package update
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/usi-lfkeitel/npmp"
+)
+
+// DefaultMaxSize is the largest artifact an Updater downloads by default.
+const DefaultMaxSize = 256 << 20
+
+var (
+	// ErrChecksumMismatch is returned when the artifact doesn't match its
+	// published checksum.
+	ErrChecksumMismatch = errors.New("Checksum mismatch")
+
+	// ErrBadSignature is returned when the signature of the checksum doesn't
+	// verify with the Updater's PublicKey.
+	ErrBadSignature = errors.New("Bad signature")
+
+	// ErrTooLarge is returned when the artifact is larger than MaxSize.
+	ErrTooLarge = errors.New("Artifact too large")
+
+	// ErrNotNewer is returned when the offered version isn't newer than the
+	// running one.
+	ErrNotNewer = errors.New("Version not newer than the running one")
+)
+
+// An Updater downloads and verifies client software and stages it at Path.
+// The staged file is replaced atomically, so Path always holds either the
+// previous or the new software in full. Restarting into it is left to the
+// caller.
+type Updater struct {
+	// Path is where the software is staged. Its directory must be writable.
+	Path string
+
+	// Version is the version of the running software. Offers of a version
+	// not newer are refused, see npmp.CompareVersions.
+	Version string
+
+	// PublicKey, if set, is the key the checksum and version must be
+	// signed with.
+	PublicKey ed25519.PublicKey
+
+	// MaxSize is the largest artifact accepted. If zero, DefaultMaxSize is
+	// used.
+	MaxSize int64
+
+	// Client is used for downloads. If nil, http.DefaultClient is used.
+	Client *http.Client
+}
+
+// Update downloads the version of the software at repo, verifies it and
+// stages it at Path.
+func (u *Updater) Update(ctx context.Context, version string, repo *url.URL) error {
+	if repo == nil {
+		return errors.New("No repo")
+	}
+	if npmp.CompareVersions(version, u.Version) <= 0 {
+		return ErrNotNewer
+	}
+	b, err := u.fetch(ctx, suffixed(repo, ".sha256"), 1024)
+	if err != nil {
+		return err
+	}
+	sum, err := parseChecksum(b)
+	if err != nil {
+		return err
+	}
+	if u.PublicKey != nil {
+		sig, err := u.fetch(ctx, suffixed(repo, ".sig"), ed25519.SignatureSize)
+		if err != nil {
+			return err
+		}
+		if !ed25519.Verify(u.PublicKey, signedMessage(sum, version), sig) {
+			return ErrBadSignature
+		}
+	}
+	return u.stage(ctx, repo, sum)
+}
+
+// stage downloads the artifact to a temporary file next to Path and renames
+// it over Path once its checksum matches.
+func (u *Updater) stage(ctx context.Context, repo *url.URL, sum []byte) error {
+	resp, err := u.get(ctx, repo)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	f, err := os.CreateTemp(filepath.Dir(u.Path), "."+filepath.Base(u.Path)+".*")
+	if err != nil {
+		return err
+	}
+	staged := false
+	defer func() {
+		if !staged {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), io.LimitReader(resp.Body, u.maxSize()+1))
+	if err != nil {
+		return err
+	}
+	if n > u.maxSize() {
+		return ErrTooLarge
+	}
+	if !bytes.Equal(h.Sum(nil), sum) {
+		return ErrChecksumMismatch
+	}
+	if err := f.Chmod(0755); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), u.Path); err != nil {
+		return err
+	}
+	staged = true
+	return nil
+}
+
+// fetch returns the body at u, which may be at most max bytes.
+func (u *Updater) fetch(ctx context.Context, loc *url.URL, max int64) ([]byte, error) {
+	resp, err := u.get(ctx, loc)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(resp.Body, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > max {
+		return nil, fmt.Errorf("Fetching %s: response too large", loc.Redacted())
+	}
+	return b, nil
+}
+
+func (u *Updater) get(ctx context.Context, loc *url.URL) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, loc.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	client := u.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Fetching %s: %s", loc.Redacted(), resp.Status)
+	}
+	return resp, nil
+}
+
+func (u *Updater) maxSize() int64 {
+	if u.MaxSize > 0 {
+		return u.MaxSize
+	}
+	return DefaultMaxSize
+}
+
+// suffixed returns a copy of u with s appended to its path.
+func suffixed(u *url.URL, s string) *url.URL {
+	ret := *u
+	ret.Path += s
+	ret.RawPath = ""
+	return &ret
+}
+
+// signedMessage returns what the signature of an artifact covers.
+func signedMessage(sum []byte, version string) []byte {
+	return append(append([]byte(nil), sum...), version...)
+}
+
+// parseChecksum reads the hex digest at the start of a sha256sum line.
+func parseChecksum(b []byte) ([]byte, error) {
+	fields := strings.Fields(string(b))
+	if len(fields) == 0 {
+		return nil, errors.New("Empty checksum")
+	}
+	sum, err := hex.DecodeString(fields[0])
+	if err != nil || len(sum) != sha256.Size {
+		return nil, errors.New("Invalid checksum")
+	}
+	return sum, nil
+}
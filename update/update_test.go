@@ -0,0 +1,128 @@
+package update
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testRepo serves an artifact with its checksum and signature for version.
+func testRepo(t *testing.T, artifact []byte, version string, key ed25519.PrivateKey) *url.URL {
+	sum := sha256.Sum256(artifact)
+	files := map[string][]byte{
+		"/probe":        artifact,
+		"/probe.sha256": []byte(hex.EncodeToString(sum[:]) + "  probe\n"),
+	}
+	if key != nil {
+		files["/probe.sig"] = ed25519.Sign(key, signedMessage(sum[:], version))
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(b)
+	}))
+	t.Cleanup(ts.Close)
+	u, _ := url.Parse(ts.URL + "/probe")
+	return u
+}
+
+func TestUpdate(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	repo := testRepo(t, []byte("new probe"), "1.1.0", priv)
+
+	path := filepath.Join(t.TempDir(), "probe")
+	if err := os.WriteFile(path, []byte("old probe"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	u := &Updater{Path: path, Version: "1.0.9", PublicKey: pub}
+	if err := u.Update(context.Background(), "1.1.0", repo); err != nil {
+		t.Fatalf("Update failed: %s", err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "new probe" {
+		t.Fatalf("Incorrect staged file. Expected %q, got %q", "new probe", b)
+	}
+	if fi, _ := os.Stat(path); fi.Mode().Perm() != 0755 {
+		t.Fatalf("Incorrect mode. Expected %v, got %v", os.FileMode(0755), fi.Mode().Perm())
+	}
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 1 {
+		t.Fatalf("Incorrect number of files. Expected 1, got %d", len(entries))
+	}
+}
+
+func TestUpdateRejected(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	otherPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	signed := testRepo(t, []byte("new probe"), "1.1.0", priv)
+	unsigned := testRepo(t, []byte("new probe"), "1.1.0", nil)
+
+	// A checksum that doesn't match the artifact.
+	tampered := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/probe.sha256" {
+			w.Write([]byte("0000000000000000000000000000000000000000000000000000000000000000  probe\n"))
+			return
+		}
+		w.Write([]byte("new probe"))
+	}))
+	defer tampered.Close()
+	tamperedURL, _ := url.Parse(tampered.URL + "/probe")
+
+	tests := []struct {
+		name    string
+		key     ed25519.PublicKey
+		repo    *url.URL
+		version string
+		running string
+		err     error
+	}{
+		{"wrong key", otherPub, signed, "1.1.0", "1.0.0", ErrBadSignature},
+		{"missing signature", pub, unsigned, "1.1.0", "1.0.0", nil},
+		{"checksum", nil, tamperedURL, "1.1.0", "1.0.0", ErrChecksumMismatch},
+		{"other version", pub, signed, "1.2.0", "1.0.0", ErrBadSignature},
+		{"downgrade", pub, signed, "1.1.0", "1.2.0", ErrNotNewer},
+		{"same version", pub, signed, "1.1.0", "1.1.0", ErrNotNewer},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "probe")
+		os.WriteFile(path, []byte("old probe"), 0755)
+
+		u := &Updater{Path: path, Version: tt.running, PublicKey: tt.key}
+		err := u.Update(context.Background(), tt.version, tt.repo)
+		if err == nil {
+			t.Fatalf("%s: Incorrect result. Expected an error", tt.name)
+		}
+		if tt.err != nil && !errors.Is(err, tt.err) {
+			t.Fatalf("%s: Incorrect error. Expected %v, got %v", tt.name, tt.err, err)
+		}
+		if b, _ := os.ReadFile(path); string(b) != "old probe" {
+			t.Fatalf("%s: Incorrect staged file. Expected the old file, got %q", tt.name, b)
+		}
+		if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+			t.Fatalf("%s: Incorrect number of files. Expected 1, got %d", tt.name, len(entries))
+		}
+	}
+}
+
+func TestUpdateTooLarge(t *testing.T) {
+	repo := testRepo(t, []byte("new probe"), "1.1.0", nil)
+	u := &Updater{Path: filepath.Join(t.TempDir(), "probe"), MaxSize: 4}
+	if err := u.Update(context.Background(), "1.1.0", repo); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("Incorrect error. Expected %v, got %v", ErrTooLarge, err)
+	}
+}
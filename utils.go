@@ -1,7 +1,5 @@
 package npmp
 
-import "errors"
-
 // newMessage will return a base Message of type mt. This function
 // is for internal use only. Many message types require a slightly
 // larger base.
@@ -27,6 +25,12 @@ func NewSettingsMessage() *SettingsMessage {
 	return &SettingsMessage{Message: newMessage(Settings)}
 }
 
+// NewNullMessage returns a Message of type Null, which is used as a
+// heartbeat.
+func NewNullMessage() Message {
+	return newMessage(Null)
+}
+
 // NewDisconnectMessage returns a Message of type Disconnect.
 func NewDisconnectMessage() Message {
 	return newMessage(Disconnect)
@@ -64,9 +68,9 @@ func NewInformMessage() InformMessage {
 	return InformMessage{newMessage(Inform)}
 }
 
-// NewVersionMessage returns a Message with type Version.
-func NewVersionMessage() Message {
-	return newMessage(Version)
+// NewVersionMessage returns a VersionMessage with no versions.
+func NewVersionMessage() VersionMessage {
+	return VersionMessage{newMessage(Version)}
 }
 
 // NewACKMessage returns a Message with type ACK.
@@ -88,10 +92,6 @@ func NewNAKMessage() NAKMessage {
 // network interface information within the message. This is more of a
 // convenience function.
 func ConvertToRegister(p Message) (*RegisterMessage, error) {
-	if p.MessageType() != Register {
-		return nil, errors.New("Incorrect message type")
-	}
-
 	r := &RegisterMessage{Message: p}
 	if err := r.Process(); err != nil {
 		return nil, err
@@ -103,13 +103,51 @@ func ConvertToRegister(p Message) (*RegisterMessage, error) {
 // It calles the Process() method on the SettingsMessage which parses the
 // Option data within the message. This is more of a convenience function.
 func ConvertToSettings(p Message) (*SettingsMessage, error) {
-	if p.MessageType() != Settings {
-		return nil, errors.New("Incorrect message type")
-	}
-
 	r := &SettingsMessage{Message: p}
 	if err := r.Process(); err != nil {
 		return nil, err
 	}
 	return r, nil
 }
+
+// ConvertToStart will take a Message and convert it into a StartMessage
+// after validating its length.
+func ConvertToStart(p Message) (StartMessage, error) {
+	r := StartMessage{p}
+	return r, r.Validate()
+}
+
+// ConvertToEnd will take a Message and convert it into an EndMessage
+// after validating its length.
+func ConvertToEnd(p Message) (EndMessage, error) {
+	r := EndMessage{p}
+	return r, r.Validate()
+}
+
+// ConvertToData will take a Message and convert it into a DataMessage
+// after validating its length.
+func ConvertToData(p Message) (DataMessage, error) {
+	r := DataMessage{p}
+	return r, r.Validate()
+}
+
+// ConvertToInform will take a Message and convert it into an InformMessage
+// after validating its length.
+func ConvertToInform(p Message) (InformMessage, error) {
+	r := InformMessage{p}
+	return r, r.Validate()
+}
+
+// ConvertToVersion will take a Message and convert it into a VersionMessage
+// after validating its length.
+func ConvertToVersion(p Message) (VersionMessage, error) {
+	r := VersionMessage{p}
+	return r, r.Validate()
+}
+
+// ConvertToNAK will take a Message and convert it into a NAKMessage
+// after validating its length.
+func ConvertToNAK(p Message) (NAKMessage, error) {
+	r := NAKMessage{p}
+	return r, r.Validate()
+}
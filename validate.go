@@ -0,0 +1,115 @@
+package npmp
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Decoding guarantee
+//
+// The accessors on the message types index directly into the underlying
+// []byte and assume the message has been validated. Data received from the
+// network should always be decoded with Parse, one of the ConvertTo*
+// functions, or a Validate() call before any accessor is used. These return
+// an error for malformed or truncated input and never panic.
+
+// ErrIncorrectType is returned when a message is converted to a type that
+// doesn't match its header.
+var ErrIncorrectType = errors.New("Incorrect message type")
+
+// ErrTruncatedOption is returned when an Option header or value runs past the
+// end of a Settings message.
+var ErrTruncatedOption = errors.New("Option length exceeds message")
+
+// ErrTruncatedInterface is returned when an interface record runs past the
+// end of a Register message.
+var ErrTruncatedInterface = errors.New("Interface record exceeds message")
+
+// headerLength is the length of the base header shared by all messages.
+const headerLength = 4
+
+// minLength is the smallest valid length of each message type including the
+// base header.
+var minLength = map[MessageType]int{
+	Null:       headerLength,
+	Register:   headerLength + 17, // Client ID + interface count
+	Disconnect: headerLength,
+	Start:      headerLength + 4, // Job ID
+	End:        headerLength + 4, // Job ID
+	Data:       headerLength + 5, // Job ID + data type
+	Inform:     headerLength,
+	Version:    headerLength,
+	ACK:        headerLength,
+	NAK:        headerLength + 1, // Response code
+	Settings:   headerLength,
+}
+
+// A LengthError is returned when a message is too short for its type.
+type LengthError struct {
+	Type   MessageType
+	Length int // Actual length of the message
+	Min    int // Minimum length required
+}
+
+func (e *LengthError) Error() string {
+	return fmt.Sprintf("%s message too small: %d bytes, need %d", e.Type, e.Length, e.Min)
+}
+
+// Validate checks the message is long enough to contain the base header and
+// the fixed fields of its MessageType.
+func (p Message) Validate() error {
+	if len(p) < headerLength {
+		return &LengthError{Type: Null, Length: len(p), Min: headerLength}
+	}
+	min, ok := minLength[p.MessageType()]
+	if !ok {
+		return &UnknownTypeError{Type: p.MessageType()}
+	}
+	if len(p) < min {
+		return &LengthError{Type: p.MessageType(), Length: len(p), Min: min}
+	}
+	return nil
+}
+
+// validateType validates p and ensures it is of type mt.
+func (p Message) validateType(mt MessageType) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	if p.MessageType() != mt {
+		return ErrIncorrectType
+	}
+	return nil
+}
+
+// Validate checks the message is a Register message containing every
+// interface record announced by its interface count.
+func (p *RegisterMessage) Validate() error {
+	if err := p.Message.validateType(Register); err != nil {
+		return err
+	}
+	_, err := p.interfaces()
+	return err
+}
+
+// Validate checks the message is a Start message containing a job ID.
+func (p StartMessage) Validate() error { return p.Message.validateType(Start) }
+
+// Validate checks the message is an End message containing a job ID.
+func (p EndMessage) Validate() error { return p.Message.validateType(End) }
+
+// Validate checks the message is a Data message containing a job ID and data type.
+func (p DataMessage) Validate() error { return p.Message.validateType(Data) }
+
+// Validate checks the message is an Inform message.
+func (p InformMessage) Validate() error { return p.Message.validateType(Inform) }
+
+// Validate checks the message is a Version message.
+func (p VersionMessage) Validate() error { return p.Message.validateType(Version) }
+
+// Validate checks the message is a NAK message containing a response code.
+func (p NAKMessage) Validate() error { return p.Message.validateType(NAK) }
+
+// Validate checks the message is a Settings message. The options themselves
+// are checked by Process().
+func (p *SettingsMessage) Validate() error { return p.Message.validateType(Settings) }
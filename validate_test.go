@@ -0,0 +1,94 @@
+package npmp
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func validMessages() []Messanger {
+	reg := NewRegisterMessage()
+	reg.AddInterface(&NetInterface{
+		Type:   WiredEthernet,
+		Haddr:  net.HardwareAddr([]byte{0xab, 0xcd, 0xef, 0x12, 0x34, 0x56}),
+		IPAddr: net.IP([]byte{10, 0, 0, 1}),
+	})
+	reg1 := NewRegisterMessage()
+	reg1.SetVersion(1)
+	reg1.AddInterface(&NetInterface{
+		Type:  WirelessEthernet,
+		Haddr: net.HardwareAddr([]byte{0xab, 0xcd, 0xef, 0x12, 0x34, 0x56}),
+		Addrs: []*net.IPNet{{IP: net.ParseIP("2001:db8::1"), Mask: net.CIDRMask(64, 128)}},
+	})
+	settings := NewSettingsMessage()
+	settings.AddOption(Option{Code: HeartbeatDuration, Value: []byte{1, 2, 3, 4}})
+	data := NewDataMessage()
+	data.SetData([]byte("results"))
+	inform := NewInformMessage()
+	inform.SetOptions([]OptionCode{ServerIP, HeartbeatDuration})
+
+	return []Messanger{
+		reg,
+		reg1,
+		settings,
+		data,
+		inform,
+		NewStartMessage(),
+		NewEndMessage(),
+		NewNAKMessage(),
+		NewDisconnectMessage(),
+		NewVersionMessage(),
+		NewACKMessage(),
+	}
+}
+
+func TestTruncatedMessages(t *testing.T) {
+	for _, m := range validMessages() {
+		b := m.Bytes()
+		if _, err := Parse(b); err != nil {
+			t.Fatalf("Failed to parse valid message %v: %s", b, err)
+		}
+		for i := 0; i < len(b); i++ {
+			// A truncated message may still be valid if only variable
+			// length data was cut off. It must never panic.
+			Parse(b[:i])
+		}
+	}
+
+	start := NewStartMessage()
+	_, err := Parse(start.Bytes()[:6])
+	var lerr *LengthError
+	if !errors.As(err, &lerr) {
+		t.Fatalf("Incorrect error. Expected LengthError, got %v", err)
+	}
+	if lerr.Type != Start || lerr.Min != 8 {
+		t.Fatalf("Incorrect LengthError. Expected Start with min 8, got %s with min %d", lerr.Type, lerr.Min)
+	}
+
+	reg := NewRegisterMessage()
+	reg.Message[20] = 3 // Claim interfaces that don't exist
+	if err := reg.Validate(); !errors.As(err, &lerr) {
+		t.Fatalf("Incorrect error. Expected LengthError, got %v", err)
+	}
+}
+
+func TestConvertIncorrectType(t *testing.T) {
+	if _, err := ConvertToStart(NewEndMessage().Message); err != ErrIncorrectType {
+		t.Fatalf("Incorrect error. Expected ErrIncorrectType, got %v", err)
+	}
+	if _, err := ConvertToSettings(NewACKMessage()); err != ErrIncorrectType {
+		t.Fatalf("Incorrect error. Expected ErrIncorrectType, got %v", err)
+	}
+	if err := Message(nil).Validate(); err == nil {
+		t.Fatal("Expected error validating empty message")
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	for _, m := range validMessages() {
+		f.Add(m.Bytes())
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		Parse(b)
+	})
+}
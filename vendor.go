@@ -0,0 +1,216 @@
+package npmp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Vendor options
+//
+// The value of the VendorOptions option is a list of vendor blocks, one per
+// vendor, with integers little endian:
+//
+//	Enterprise ID  uint32, the IANA private enterprise number of the vendor
+//	Length         uint32 length of the sub-options
+//	Sub-options    code byte, uint32 length and value, like Settings options
+//
+// Vendors register a VendorCodec for their enterprise ID to read and write
+// their sub-options with VendorOption and SetVendorOption. The blocks of
+// other vendors are kept byte for byte when a sub-option is set.
+
+// ErrUnknownVendor is returned when no VendorCodec is registered for an
+// enterprise ID.
+var ErrUnknownVendor = errors.New("Unknown vendor")
+
+// A VendorCodec encodes and decodes the sub-options of a vendor.
+type VendorCodec interface {
+	// DecodeOption returns the value of the sub-option with the code.
+	DecodeOption(code byte, value []byte) (interface{}, error)
+
+	// EncodeOption returns the encoding of v for the sub-option code.
+	EncodeOption(code byte, v interface{}) ([]byte, error)
+}
+
+var (
+	vendorsMu sync.RWMutex
+	vendors   = make(map[uint32]VendorCodec)
+)
+
+// RegisterVendor makes the codec of a vendor available to VendorOption,
+// SetVendorOption and ValidateOptions. It panics if the codec is nil or the
+// enterprise ID is already registered.
+func RegisterVendor(enterpriseID uint32, c VendorCodec) {
+	vendorsMu.Lock()
+	defer vendorsMu.Unlock()
+	if c == nil {
+		panic("npmp: RegisterVendor codec is nil")
+	}
+	if _, dup := vendors[enterpriseID]; dup {
+		panic(fmt.Sprintf("npmp: RegisterVendor called twice for enterprise ID %d", enterpriseID))
+	}
+	vendors[enterpriseID] = c
+}
+
+func vendorCodec(enterpriseID uint32) (VendorCodec, error) {
+	vendorsMu.RLock()
+	defer vendorsMu.RUnlock()
+	c, ok := vendors[enterpriseID]
+	if !ok {
+		return nil, ErrUnknownVendor
+	}
+	return c, nil
+}
+
+// A VendorBlock holds the encoded sub-options of one vendor.
+type VendorBlock struct {
+	EnterpriseID uint32
+	Data         []byte
+}
+
+// Options splits the block into its sub-options.
+func (b VendorBlock) Options() ([]Option, error) {
+	var opts []Option
+	for d := b.Data; len(d) > 0; {
+		if len(d) < 5 {
+			return nil, &OptionError{Code: VendorOptions, Reason: "truncated sub-option"}
+		}
+		l := binary.LittleEndian.Uint32(d[1:5])
+		if uint64(l) > uint64(len(d)-5) {
+			return nil, &OptionError{Code: VendorOptions, Reason: "truncated sub-option"}
+		}
+		opts = append(opts, Option{Code: OptionCode(d[0]), Value: d[5 : 5+l]})
+		d = d[5+l:]
+	}
+	return opts, nil
+}
+
+// VendorBlocks returns the blocks of the VendorOptions option.
+func (p *SettingsMessage) VendorBlocks() ([]VendorBlock, error) {
+	v, ok := p.Option(VendorOptions)
+	if !ok {
+		return nil, ErrNoOption
+	}
+	var blocks []VendorBlock
+	for len(v) > 0 {
+		if len(v) < 8 {
+			return nil, &OptionError{Code: VendorOptions, Reason: "truncated vendor block"}
+		}
+		l := binary.LittleEndian.Uint32(v[4:8])
+		if uint64(l) > uint64(len(v)-8) {
+			return nil, &OptionError{Code: VendorOptions, Reason: "truncated vendor block"}
+		}
+		blocks = append(blocks, VendorBlock{EnterpriseID: binary.LittleEndian.Uint32(v), Data: v[8 : 8+l]})
+		v = v[8+l:]
+	}
+	return blocks, nil
+}
+
+// SetVendorBlocks replaces the VendorOptions option with the blocks.
+func (p *SettingsMessage) SetVendorBlocks(blocks []VendorBlock) {
+	var v []byte
+	for _, b := range blocks {
+		v = binary.LittleEndian.AppendUint32(v, b.EnterpriseID)
+		v = binary.LittleEndian.AppendUint32(v, uint32(len(b.Data)))
+		v = append(v, b.Data...)
+	}
+	p.SetOption(VendorOptions, v)
+}
+
+// VendorOption returns the first sub-option with the code of a vendor,
+// decoded by its registered VendorCodec.
+func (p *SettingsMessage) VendorOption(enterpriseID uint32, code byte) (interface{}, error) {
+	c, err := vendorCodec(enterpriseID)
+	if err != nil {
+		return nil, err
+	}
+	blocks, err := p.VendorBlocks()
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range blocks {
+		if b.EnterpriseID != enterpriseID {
+			continue
+		}
+		opts, err := b.Options()
+		if err != nil {
+			return nil, err
+		}
+		for _, o := range opts {
+			if byte(o.Code) == code {
+				return c.DecodeOption(code, o.Value)
+			}
+		}
+	}
+	return nil, ErrNoOption
+}
+
+// SetVendorOption encodes v with the registered VendorCodec of a vendor and
+// replaces any sub-options of the vendor with the code by it.
+func (p *SettingsMessage) SetVendorOption(enterpriseID uint32, code byte, v interface{}) error {
+	c, err := vendorCodec(enterpriseID)
+	if err != nil {
+		return err
+	}
+	value, err := c.EncodeOption(code, v)
+	if err != nil {
+		return err
+	}
+	blocks, err := p.VendorBlocks()
+	if err != nil && err != ErrNoOption {
+		return err
+	}
+
+	i := 0
+	for i < len(blocks) && blocks[i].EnterpriseID != enterpriseID {
+		i++
+	}
+	if i == len(blocks) {
+		blocks = append(blocks, VendorBlock{EnterpriseID: enterpriseID})
+	}
+	opts, err := blocks[i].Options()
+	if err != nil {
+		return err
+	}
+	var data []byte
+	for _, o := range opts {
+		if byte(o.Code) != code {
+			data = appendSubOption(data, byte(o.Code), o.Value)
+		}
+	}
+	blocks[i].Data = appendSubOption(data, code, value)
+	p.SetVendorBlocks(blocks)
+	return nil
+}
+
+func appendSubOption(b []byte, code byte, value []byte) []byte {
+	b = append(b, code)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(value)))
+	return append(b, value...)
+}
+
+// validateVendorOptions checks the structure of the VendorOptions option and
+// the sub-options of registered vendors.
+func (p *SettingsMessage) validateVendorOptions() error {
+	blocks, err := p.VendorBlocks()
+	if err != nil {
+		return err
+	}
+	for _, b := range blocks {
+		c, err := vendorCodec(b.EnterpriseID)
+		if err != nil {
+			continue // Other vendors' blocks are opaque
+		}
+		opts, err := b.Options()
+		if err != nil {
+			return err
+		}
+		for _, o := range opts {
+			if _, err := c.DecodeOption(byte(o.Code), o.Value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
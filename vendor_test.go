@@ -0,0 +1,112 @@
+package npmp
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+const testEnterpriseID = 32473 // Reserved for documentation, RFC 5612
+
+// testVendorCodec encodes sub-option 1 as text.
+type testVendorCodec struct{}
+
+func (testVendorCodec) DecodeOption(code byte, value []byte) (interface{}, error) {
+	if code != 1 {
+		return value, nil
+	}
+	if len(value) == 0 {
+		return nil, errors.New("Empty name")
+	}
+	return string(value), nil
+}
+
+func (testVendorCodec) EncodeOption(code byte, v interface{}) ([]byte, error) {
+	s, ok := v.(string)
+	if !ok {
+		return nil, errors.New("Name must be a string")
+	}
+	return []byte(s), nil
+}
+
+func init() {
+	RegisterVendor(testEnterpriseID, testVendorCodec{})
+}
+
+func TestVendorOption(t *testing.T) {
+	// A block of an unregistered vendor, which isn't even a list of
+	// sub-options.
+	unknown := []byte{1, 0, 0, 0, 3, 0, 0, 0, 0xde, 0xad, 0xbe}
+	m := NewSettingsMessage()
+	m.SetOption(VendorOptions, append([]byte(nil), unknown...))
+
+	if _, err := m.VendorOption(testEnterpriseID, 1); err != ErrNoOption {
+		t.Fatalf("Incorrect error. Expected ErrNoOption, got %v", err)
+	}
+	if err := m.SetVendorOption(testEnterpriseID, 1, "probe"); err != nil {
+		t.Fatalf("Failed to set vendor option: %s", err)
+	}
+	if err := m.SetVendorOption(testEnterpriseID, 1, "edge-probe"); err != nil {
+		t.Fatalf("Failed to set vendor option: %s", err)
+	}
+	if err := m.SetVendorOption(testEnterpriseID, 1, 5); err == nil {
+		t.Fatal("Incorrect result. Expected an error for a value the codec rejects")
+	}
+	if err := m.SetVendorOption(1, 1, "probe"); err != ErrUnknownVendor {
+		t.Fatalf("Incorrect error. Expected ErrUnknownVendor, got %v", err)
+	}
+
+	p, err := Parse(m.Bytes())
+	if err != nil {
+		t.Fatalf("Failed to parse message: %s", err)
+	}
+	decoded := p.(*SettingsMessage)
+	if err := decoded.ValidateOptions(); err != nil {
+		t.Fatalf("Failed to validate options: %s", err)
+	}
+	v, err := decoded.VendorOption(testEnterpriseID, 1)
+	if err != nil || v != "edge-probe" {
+		t.Fatalf("Incorrect vendor option. Expected edge-probe, got %v (%v)", v, err)
+	}
+
+	blocks, err := decoded.VendorBlocks()
+	if err != nil {
+		t.Fatalf("Failed to read vendor blocks: %s", err)
+	}
+	if len(blocks) != 2 {
+		t.Fatalf("Incorrect number of blocks. Expected 2, got %d", len(blocks))
+	}
+	value, _ := decoded.Option(VendorOptions)
+	if !bytes.Equal(value[:len(unknown)], unknown) {
+		t.Fatalf("Incorrect unknown vendor block. Expected %v, got %v", unknown, value[:len(unknown)])
+	}
+	opts, err := blocks[1].Options()
+	if err != nil || len(opts) != 1 {
+		t.Fatalf("Incorrect sub-options. Expected 1, got %d (%v)", len(opts), err)
+	}
+}
+
+func TestVendorOptionInvalid(t *testing.T) {
+	tests := [][]byte{
+		{0xd9, 0x7e, 0, 0, 10, 0, 0, 0, 1},            // Truncated block
+		{0xd9, 0x7e, 0, 0, 5, 0, 0, 0, 1, 9, 0, 0, 0}, // Truncated sub-option
+		{0xd9, 0x7e, 0, 0, 5, 0, 0, 0, 1, 0, 0, 0, 0}, // Rejected by the codec
+		{0xd9, 0x7e, 0, 0},                            // Truncated header
+	}
+	for i, tt := range tests {
+		m := NewSettingsMessage()
+		m.SetOption(VendorOptions, tt)
+		if err := m.ValidateOptions(); err == nil {
+			t.Fatalf("Incorrect result for case %d. Expected an error", i)
+		}
+	}
+}
+
+func TestRegisterVendorTwice(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("Incorrect result. Expected a panic")
+		}
+	}()
+	RegisterVendor(testEnterpriseID, testVendorCodec{})
+}
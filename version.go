@@ -0,0 +1,36 @@
+package npmp
+
+// Version negotiation
+//
+// A client may send a Version message listing every protocol version it
+// supports before it registers. The server answers with a Version message
+// carrying the highest version both support, or a NAK with
+// UnsupportedVersion if there is none. The registration Settings carry the
+// version in use as the ProtocolVersion option. Both sides then write that
+// version in the header of every message they send. A Register message is
+// always written in the version it is encoded for.
+
+// SupportedVersions returns every protocol version understood by the package,
+// lowest first.
+func SupportedVersions() []byte {
+	v := make([]byte, MaxVersion+1)
+	for i := range v {
+		v[i] = byte(i)
+	}
+	return v
+}
+
+// NegotiateVersion returns the highest version in both ours and theirs. It
+// returns false if they have none in common.
+func NegotiateVersion(ours, theirs []byte) (byte, bool) {
+	var best byte
+	found := false
+	for _, a := range ours {
+		for _, b := range theirs {
+			if a == b && (!found || a > best) {
+				best, found = a, true
+			}
+		}
+	}
+	return best, found
+}
@@ -0,0 +1,55 @@
+package npmp
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestNegotiateVersion(t *testing.T) {
+	tests := []struct {
+		ours, theirs []byte
+		expected     byte
+		ok           bool
+	}{
+		{[]byte{0, 1}, []byte{0, 1, 2}, 1, true},
+		{[]byte{1, 0}, []byte{0}, 0, true},
+		{[]byte{0, 3}, []byte{3, 2, 0}, 3, true},
+		{[]byte{1}, []byte{0, 2}, 0, false},
+		{nil, []byte{0}, 0, false},
+	}
+	for _, test := range tests {
+		v, ok := NegotiateVersion(test.ours, test.theirs)
+		if v != test.expected || ok != test.ok {
+			t.Fatalf("Incorrect version for %v and %v. Expected %d %t, got %d %t", test.ours, test.theirs, test.expected, test.ok, v, ok)
+		}
+	}
+
+	if v := SupportedVersions(); len(v) != int(MaxVersion)+1 || v[0] != 0 || v[len(v)-1] != MaxVersion {
+		t.Fatalf("Incorrect supported versions. Expected 0 to %d, got %v", MaxVersion, v)
+	}
+}
+
+func TestVersionMessageParse(t *testing.T) {
+	m := NewVersionMessage()
+	m.SetVersions([]byte{0, 1, 7})
+	m.SetVersion(7) // Sent by a peer newer than this package
+
+	p, err := Parse(m.Bytes())
+	if err != nil {
+		t.Fatalf("Failed to parse Version message: %s", err)
+	}
+	vm, ok := p.(VersionMessage)
+	if !ok {
+		t.Fatalf("Incorrect concrete type. Expected VersionMessage, got %T", p)
+	}
+	if !bytes.Equal(vm.Versions(), []byte{0, 1, 7}) {
+		t.Fatalf("Incorrect versions. Expected [0 1 7], got %v", vm.Versions())
+	}
+
+	// Other messages of an unknown version are still rejected.
+	ack := NewACKMessage()
+	ack.SetVersion(7)
+	if _, err := Parse(ack); err == nil {
+		t.Fatal("Incorrect result. Expected an error for an ACK of version 7")
+	}
+}